@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"tiberious/db"
+	"tiberious/settings"
+	"tiberious/types"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidCredentials is returned when an account name and password
+	// don't match.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrAccountConflict is returned when an external account's login name
+	// belongs to a user the provider didn't create.
+	ErrAccountConflict = errors.New("account belongs to another user")
+)
+
+type (
+	// Authenticator provides access to user authentication.
+	Authenticator interface {
+		// Authenticate returns the user for an authentication token or
+		// ErrInvalidCredentials.
+		Authenticate(token types.AuthToken) (*types.User, error)
+	}
+
+	// Verifier checks credentials against an external account provider.
+	Verifier interface {
+		// Verify returns the identity for an authentication token or
+		// ErrInvalidCredentials.
+		Verify(token types.AuthToken) (*Identity, error)
+	}
+
+	// Identity holds the account details returned by a Verifier.
+	Identity struct {
+		LoginName string
+		Username  string
+		Email     string
+	}
+
+	dbAuthenticator struct {
+		dbClient db.Client
+	}
+
+	externalAuthenticator struct {
+		config   *settings.Config
+		log      *logrus.Logger
+		dbClient db.Client
+		verifier Verifier
+	}
+)
+
+// NewAuthenticator returns a new Authenticator for the provider set in config
+// ("db" (default), "ldap" or "http").
+func NewAuthenticator(config *settings.Config, dbClient db.Client, log *logrus.Logger) (Authenticator, error) {
+	var (
+		verifier Verifier
+		err      error
+	)
+	switch config.AuthProvider {
+	case "db", "":
+		return &dbAuthenticator{dbClient: dbClient}, nil
+	case "ldap":
+		verifier, err = NewLDAPVerifier(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewLDAPVerifier")
+		}
+	case "http":
+		verifier, err = NewHTTPVerifier(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewHTTPVerifier")
+		}
+	default:
+		return nil, errors.Errorf("unknown auth provider %q", config.AuthProvider)
+	}
+
+	log.Infof("Authenticating users with %s", config.AuthProvider)
+	return &externalAuthenticator{
+		config:   config,
+		log:      log,
+		dbClient: dbClient,
+		verifier: verifier,
+	}, nil
+}
+
+// Authenticate checks the token against the users stored in the database.
+func (a *dbAuthenticator) Authenticate(token types.AuthToken) (*types.User, error) {
+	user, err := a.dbClient.GetUserByLoginName(token.AccountName)
+	if err != nil {
+		return nil, errors.Wrap(err, "dbClient.GetUserByLoginName")
+	}
+
+	if user == nil || !user.IsPassword(token.Password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Hash passwords still stored as plain text now that we know them.
+	if user.HasLegacyPassword() {
+		user.SetPassword(token.Password)
+		if err = a.dbClient.WriteUserData(user); err != nil {
+			return nil, errors.Wrap(err, "dbClient.WriteUserData")
+		}
+	}
+
+	return user, nil
+}
+
+/* Authenticate checks the token with the external provider, users that don't
+ * exist in the database yet are created on their first login. */
+func (a *externalAuthenticator) Authenticate(token types.AuthToken) (*types.User, error) {
+	// An empty password is an anonymous bind to most providers.
+	if token.AccountName == "" || token.Password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	id, err := a.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := a.dbClient.GetUserByLoginName(id.LoginName)
+	if err != nil {
+		return nil, errors.Wrap(err, "dbClient.GetUserByLoginName")
+	}
+	if user != nil {
+		/* Only users created by this provider are its accounts, taking over
+		 * anyone else with the same login name would let the provider's
+		 * accounts log in as local users. */
+		if user.Provider != a.config.AuthProvider {
+			return nil, ErrAccountConflict
+		}
+
+		// Keep the email address in sync with the provider.
+		if id.Email != "" && id.Email != user.Email {
+			user.Email = id.Email
+			user.Verified = true
+			if err = a.dbClient.WriteUserData(user); err != nil {
+				return nil, errors.Wrap(err, "dbClient.WriteUserData")
+			}
+		}
+		return user, nil
+	}
+
+	return a.provision(id)
+}
+
+// provision creates a new user in the database for an external identity.
+func (a *externalAuthenticator) provision(id *Identity) (*types.User, error) {
+	uid, err := a.dbClient.GetUniqueID()
+	if err != nil {
+		return nil, errors.Wrap(err, "dbClient.GetUniqueID")
+	}
+
+	user := &types.User{
+		ID:        uid,
+		Type:      a.config.AuthUserType,
+		Username:  id.Username,
+		LoginName: id.LoginName,
+		Email:     id.Email,
+		Provider:  a.config.AuthProvider,
+		// The provider is trusted for the email address.
+		Verified: id.Email != "",
+	}
+	if user.Username == "" {
+		user.Username = id.LoginName
+	}
+
+	ok, err := a.dbClient.ReserveUsername(user.Username, uid.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "dbClient.ReserveUsername")
+	}
+	if !ok {
+		// Fall back to something unique the user can change later.
+		user.Username = user.Username + "-" + uid.String()[:8]
+	}
+
+	if err = a.dbClient.WriteUserData(user); err != nil {
+		// Someone else took the login name since we looked it up.
+		if errors.Cause(err) == db.ErrNameTaken {
+			return nil, ErrAccountConflict
+		}
+		return nil, errors.Wrap(err, "dbClient.WriteUserData")
+	}
+
+	a.log.Infof("provisioned %s %s for %s", user.Type, user.ID.String(), user.LoginName)
+	return user, nil
+}
@@ -0,0 +1,83 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"tiberious/auth"
+	"tiberious/settings"
+	"tiberious/types"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("the external authenticator", func() {
+	var (
+		server        *httptest.Server
+		authenticator auth.Authenticator
+		email         string
+	)
+
+	BeforeEach(func() {
+		email = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var token types.AuthToken
+			if err := json.NewDecoder(r.Body).Decode(&token); err != nil || token.Password != "enterprise" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"email": email})
+		}))
+
+		_, err := settings.Init(true)
+		Expect(err).To(BeNil())
+		config := settings.GetConfig()
+		config.AuthProvider = "http"
+		config.AuthURL = server.URL
+
+		authenticator, err = auth.NewAuthenticator(config, f.dbClient, logrus.New())
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("creates users on their first login", func() {
+		user, err := authenticator.Authenticate(types.AuthToken{AccountName: "spock", Password: "enterprise"})
+		Expect(err).To(BeNil())
+		Expect(user.Provider).To(Equal("http"))
+
+		again, err := authenticator.Authenticate(types.AuthToken{AccountName: "spock", Password: "enterprise"})
+		Expect(err).To(BeNil())
+		Expect(again.ID).To(Equal(user.ID))
+	})
+
+	It("stores email addresses changed by the provider", func() {
+		_, err := authenticator.Authenticate(types.AuthToken{AccountName: "uhura", Password: "enterprise"})
+		Expect(err).To(BeNil())
+
+		email = "uhura@tiberious.nowhere"
+		_, err = authenticator.Authenticate(types.AuthToken{AccountName: "uhura", Password: "enterprise"})
+		Expect(err).To(BeNil())
+
+		user, err := f.dbClient.GetUserByLoginName("uhura")
+		Expect(err).To(BeNil())
+		Expect(user.Email).To(Equal(email))
+		Expect(user.Verified).To(BeTrue())
+	})
+
+	It("refuses login names of users it didn't create", func() {
+		local := &types.User{ID: uuid.NewRandom(), Type: "user", Username: "sulu", LoginName: "sulu"}
+		local.SetPassword("excelsior")
+		Expect(f.dbClient.WriteUserData(local)).To(BeNil())
+
+		_, err := authenticator.Authenticate(types.AuthToken{AccountName: "sulu", Password: "enterprise"})
+		Expect(err).To(Equal(auth.ErrAccountConflict))
+	})
+})
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"tiberious/settings"
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+type httpVerifier struct {
+	url    string
+	client *http.Client
+}
+
+/* NewHTTPVerifier returns a Verifier that POSTs the authentication token as
+ * JSON to config.AuthURL. A 200 response accepts the credentials and may
+ * include a JSON body with "username" and "email", 401 and 403 responses
+ * reject them. */
+func NewHTTPVerifier(config *settings.Config) (Verifier, error) {
+	if config.AuthURL == "" {
+		return nil, errors.New("Missing AuthURL in config file")
+	}
+
+	return &httpVerifier{
+		url:    config.AuthURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (v *httpVerifier) Verify(token types.AuthToken) (*Identity, error) {
+	body, err := json.Marshal(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Marshal")
+	}
+
+	res, err := v.client.Post(v.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "client.Post")
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, errors.Errorf("unexpected auth response %s", res.Status)
+	}
+
+	var info struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	// The body is optional so only a malformed one is an error.
+	if err = json.NewDecoder(res.Body).Decode(&info); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "json.Decode")
+	}
+
+	return &Identity{
+		LoginName: token.AccountName,
+		Username:  info.Username,
+		Email:     info.Email,
+	}, nil
+}
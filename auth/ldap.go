@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"tiberious/settings"
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ldap.v2"
+)
+
+// ldapTimeout limits connecting to the server and each request.
+const ldapTimeout = 10 * time.Second
+
+type ldapVerifier struct {
+	addr       string
+	useTLS     bool
+	bindDN     string
+	mailDomain string
+}
+
+/* NewLDAPVerifier returns a Verifier that performs an LDAPv3 simple bind on
+ * config.LDAPAddress as config.LDAPBindDN (where %s is replaced with the
+ * escaped account name). */
+func NewLDAPVerifier(config *settings.Config) (Verifier, error) {
+	if config.LDAPAddress == "" {
+		return nil, errors.New("Missing LDAPAddress in config file")
+	}
+	if !strings.Contains(config.LDAPBindDN, "%s") {
+		return nil, errors.New("LDAPBindDN must contain %s for the account name")
+	}
+
+	return &ldapVerifier{
+		addr:       config.LDAPAddress,
+		useTLS:     config.LDAPTLS,
+		bindDN:     config.LDAPBindDN,
+		mailDomain: config.LDAPMailDomain,
+	}, nil
+}
+
+func (v *ldapVerifier) Verify(token types.AuthToken) (*Identity, error) {
+	conn, err := v.dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+	defer conn.Close()
+
+	dn := fmt.Sprintf(v.bindDN, escapeDN(token.AccountName))
+	if err = conn.Bind(dn, token.Password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, errors.Wrap(err, "conn.Bind")
+	}
+
+	id := &Identity{LoginName: token.AccountName}
+	if v.mailDomain != "" {
+		id.Email = token.AccountName + "@" + v.mailDomain
+	}
+
+	return id, nil
+}
+
+// dial connects to the server, over TLS if LDAPTLS is set.
+func (v *ldapVerifier) dial() (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if v.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", v.addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", v.addr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Dial")
+	}
+
+	ret := ldap.NewConn(conn, v.useTLS)
+	ret.Start()
+	ret.SetTimeout(ldapTimeout)
+	return ret, nil
+}
+
+// escapeDN escapes an attribute value for use in a DN (RFC 4514).
+func escapeDN(s string) string {
+	var b bytes.Buffer
+	for i, c := range s {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;", c):
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString("\\00")
+		case (c == ' ' || c == '#') && i == 0:
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case c == ' ' && i == len(s)-1:
+			b.WriteString("\\ ")
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,148 @@
+package auth_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"tiberious/auth"
+	"tiberious/settings"
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/* ldapStandIn accepts a single connection and answers its bind request with
+ * success if the request contains the given DN and password, binds are
+ * rejected with invalidCredentials (49) otherwise. */
+func ldapStandIn(dn, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Bind requests from the verifier are always short form lengths.
+		head := make([]byte, 2)
+		if _, err = io.ReadFull(conn, head); err != nil {
+			return
+		}
+		req := make([]byte, head[1])
+		if _, err = io.ReadFull(conn, req); err != nil {
+			return
+		}
+
+		code := byte(49)
+		if bytes.Contains(req, []byte(dn)) && bytes.HasSuffix(req, append([]byte{0x80, byte(len(password))}, password...)) {
+			code = 0
+		}
+
+		// LDAPMessage { messageID 1, BindResponse { resultCode, "", "" } }
+		conn.Write([]byte{0x30, 0x0c, 0x02, 0x01, 0x01, 0x61, 0x07, 0x0a, 0x01, code, 0x04, 0x00, 0x04, 0x00})
+	}()
+
+	return ln.Addr().String()
+}
+
+var _ = Describe("verifiers", func() {
+	var config *settings.Config
+
+	BeforeEach(func() {
+		_, err := settings.Init(true)
+		Expect(err).To(BeNil())
+		config = settings.GetConfig()
+	})
+
+	Describe("using the ldap verifier", func() {
+		BeforeEach(func() {
+			config.LDAPBindDN = "uid=%s,ou=people,dc=tiberious,dc=nowhere"
+			config.LDAPMailDomain = "tiberious.nowhere"
+		})
+
+		It("requires %s in the bind DN", func() {
+			config.LDAPAddress = "localhost:389"
+			config.LDAPBindDN = "uid=kirk,dc=tiberious,dc=nowhere"
+			_, err := auth.NewLDAPVerifier(config)
+			Expect(err).ToNot(BeNil())
+		})
+		It("accepts valid credentials", func() {
+			config.LDAPAddress = ldapStandIn("uid=kirk,ou=people,dc=tiberious,dc=nowhere", "enterprise")
+			v, err := auth.NewLDAPVerifier(config)
+			Expect(err).To(BeNil())
+
+			id, err := v.Verify(types.AuthToken{AccountName: "kirk", Password: "enterprise"})
+			Expect(err).To(BeNil())
+			Expect(id.LoginName).To(Equal("kirk"))
+			Expect(id.Email).To(Equal("kirk@tiberious.nowhere"))
+		})
+		It("rejects invalid credentials", func() {
+			config.LDAPAddress = ldapStandIn("uid=kirk,ou=people,dc=tiberious,dc=nowhere", "enterprise")
+			v, err := auth.NewLDAPVerifier(config)
+			Expect(err).To(BeNil())
+
+			_, err = v.Verify(types.AuthToken{AccountName: "kirk", Password: "klingon"})
+			Expect(err).To(Equal(auth.ErrInvalidCredentials))
+		})
+		It("escapes the account name", func() {
+			config.LDAPAddress = ldapStandIn("uid=kirk\\,ou=admins,ou=people,dc=tiberious,dc=nowhere", "enterprise")
+			v, err := auth.NewLDAPVerifier(config)
+			Expect(err).To(BeNil())
+
+			_, err = v.Verify(types.AuthToken{AccountName: "kirk,ou=admins", Password: "enterprise"})
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("using the http verifier", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var token types.AuthToken
+				if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if token.AccountName != "kirk" || token.Password != "enterprise" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`{"username":"JTKirk","email":"kirk@tiberious.nowhere"}`))
+			}))
+			config.AuthURL = server.URL
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("accepts valid credentials", func() {
+			v, err := auth.NewHTTPVerifier(config)
+			Expect(err).To(BeNil())
+
+			id, err := v.Verify(types.AuthToken{AccountName: "kirk", Password: "enterprise"})
+			Expect(err).To(BeNil())
+			Expect(id.LoginName).To(Equal("kirk"))
+			Expect(id.Username).To(Equal("JTKirk"))
+			Expect(id.Email).To(Equal("kirk@tiberious.nowhere"))
+		})
+		It("rejects invalid credentials", func() {
+			v, err := auth.NewHTTPVerifier(config)
+			Expect(err).To(BeNil())
+
+			_, err = v.Verify(types.AuthToken{AccountName: "kirk", Password: "klingon"})
+			Expect(err).To(Equal(auth.ErrInvalidCredentials))
+		})
+	})
+})
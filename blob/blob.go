@@ -0,0 +1,57 @@
+package blob
+
+import (
+	"io"
+
+	"tiberious/settings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrDisabled is returned when storing files without a configured store.
+	ErrDisabled = errors.New("blob store disabled")
+
+	// ErrNotFound is returned when opening a file that doesn't exist.
+	ErrNotFound = errors.New("blob not found")
+
+	// ErrInvalidID is returned for IDs that can't be used as a file name.
+	ErrInvalidID = errors.New("invalid blob id")
+)
+
+type (
+	// Store provides access to stored files (attachments) by ID.
+	Store interface {
+		Create(id string) (io.WriteCloser, error)
+		Open(id string) (io.ReadCloser, error)
+		Delete(id string) error
+	}
+
+	disabledStore struct{}
+)
+
+// NewStore returns a new Store for the blob store set in config ("disk" or ""
+// to disable storing files).
+func NewStore(config *settings.Config, log *logrus.Logger) (Store, error) {
+	switch config.BlobStore {
+	case "disk":
+		return newDiskStore(config, log)
+	case "":
+		return disabledStore{}, nil
+	default:
+		return nil, errors.Errorf("unknown blob store %q", config.BlobStore)
+	}
+}
+
+func (disabledStore) Create(id string) (io.WriteCloser, error) {
+	return nil, ErrDisabled
+}
+
+func (disabledStore) Open(id string) (io.ReadCloser, error) {
+	return nil, ErrDisabled
+}
+
+func (disabledStore) Delete(id string) error {
+	return ErrDisabled
+}
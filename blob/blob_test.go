@@ -0,0 +1,89 @@
+package blob_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"tiberious/blob"
+	"tiberious/settings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("blob", func() {
+	var config *settings.Config
+
+	BeforeEach(func() {
+		_, err := settings.Init(true)
+		Expect(err).To(BeNil())
+		config = settings.GetConfig()
+	})
+
+	Describe("calling NewStore", func() {
+		It("is disabled without a store", func() {
+			config.BlobStore = ""
+			s, err := blob.NewStore(config, logrus.New())
+			Expect(err).To(BeNil())
+			_, err = s.Create(uuid.NewRandom().String())
+			Expect(err).To(Equal(blob.ErrDisabled))
+		})
+		It("rejects unknown stores", func() {
+			config.BlobStore = "tape"
+			_, err := blob.NewStore(config, logrus.New())
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("using the disk store", func() {
+		var (
+			dir string
+			s   blob.Store
+			id  = uuid.NewRandom().String()
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "tiberious-blob")
+			Expect(err).To(BeNil())
+
+			config.BlobStore = "disk"
+			config.BlobPath = dir
+			s, err = blob.NewStore(config, logrus.New())
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("stores and deletes files", func() {
+			w, err := s.Create(id)
+			Expect(err).To(BeNil())
+			_, err = w.Write([]byte("file contents"))
+			Expect(err).To(BeNil())
+			Expect(w.Close()).To(BeNil())
+
+			_, err = s.Create(id)
+			Expect(err).ToNot(BeNil())
+
+			r, err := s.Open(id)
+			Expect(err).To(BeNil())
+			b, err := ioutil.ReadAll(r)
+			Expect(err).To(BeNil())
+			Expect(r.Close()).To(BeNil())
+			Expect(string(b)).To(Equal("file contents"))
+
+			Expect(s.Delete(id)).To(BeNil())
+			_, err = s.Open(id)
+			Expect(err).To(Equal(blob.ErrNotFound))
+		})
+		It("only accepts IDs", func() {
+			_, err := s.Create("../escape")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
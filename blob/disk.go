@@ -0,0 +1,88 @@
+package blob
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"tiberious/settings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// diskStore keeps every file under BlobPath named after its ID.
+type diskStore struct {
+	dir string
+	log *logrus.Logger
+}
+
+func newDiskStore(config *settings.Config, log *logrus.Logger) (Store, error) {
+	if err := os.MkdirAll(config.BlobPath, 0700); err != nil {
+		return nil, errors.Wrap(err, "os.MkdirAll")
+	}
+
+	return &diskStore{
+		dir: config.BlobPath,
+		log: log,
+	}, nil
+}
+
+// path returns the file of an ID, only UUIDs are accepted so IDs can never
+// point outside of the store.
+func (s *diskStore) path(id string) (string, error) {
+	parsed := uuid.Parse(id)
+	if parsed == nil {
+		return "", ErrInvalidID
+	}
+
+	return filepath.Join(s.dir, parsed.String()), nil
+}
+
+// Create creates a new file, existing files are never overwritten.
+func (s *diskStore) Create(id string) (io.WriteCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "s.path")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "os.OpenFile")
+	}
+
+	return f, nil
+}
+
+// Open opens a file for reading.
+func (s *diskStore) Open(id string) (io.ReadCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "s.path")
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "os.Open")
+	}
+
+	return f, nil
+}
+
+// Delete removes a file, missing files are ignored.
+func (s *diskStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return errors.Wrap(err, "s.path")
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "os.Remove")
+	}
+
+	return nil
+}
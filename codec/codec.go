@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// Websocket subprotocols selecting a codec, connections without one use JSON
+// in binary frames.
+const (
+	JSONText   = "jim.json"
+	JSONBinary = "jim.json.binary"
+	MsgPack    = "jim.msgpack"
+)
+
+var (
+	// ErrInvalidUTF8 is returned when decoding strings that aren't valid UTF-8.
+	ErrInvalidUTF8 = errors.New("invalid utf-8")
+
+	// ErrInvalidData is returned when decoding malformed or unsupported data.
+	ErrInvalidData = errors.New("invalid data")
+)
+
+// Codec encodes the objects sent to a client and decodes those it sends.
+type Codec interface {
+	// Name is the websocket subprotocol selecting the codec.
+	Name() string
+	// MessageType is the websocket frame type used for encoded objects.
+	MessageType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// Join combines encoded objects into an encoded array of them.
+	Join(objs [][]byte) []byte
+}
+
+// Default is the codec for connections that didn't negotiate one.
+var Default Codec = jsonCodec{name: JSONBinary, messageType: websocket.BinaryMessage}
+
+// codecs are ordered by preference when a client offers several.
+var codecs = []Codec{
+	msgpackCodec{},
+	Default,
+	jsonCodec{name: JSONText, messageType: websocket.TextMessage},
+}
+
+// Subprotocols returns the names of every codec in order of preference.
+func Subprotocols() []string {
+	var ret []string
+	for _, c := range codecs {
+		ret = append(ret, c.Name())
+	}
+
+	return ret
+}
+
+// ForSubprotocol returns the codec for a negotiated subprotocol, Default if
+// none was.
+func ForSubprotocol(name string) Codec {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+
+	return Default
+}
@@ -0,0 +1,252 @@
+package codec_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"tiberious/codec"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+type object struct {
+	Action string            `json:"action"`
+	Time   int64             `json:"time"`
+	Limit  int               `json:"limit"`
+	Ratio  float64           `json:"ratio"`
+	Typing *bool             `json:"typing"`
+	Data   []byte            `json:"data"`
+	List   []string          `json:"list"`
+	Meta   map[string]string `json:"meta"`
+}
+
+var _ = Describe("codec", func() {
+	var (
+		typing = false
+		obj    = object{
+			Action: "msg",
+			Time:   1490000000,
+			Limit:  -40,
+			Ratio:  0.5,
+			Typing: &typing,
+			Data:   []byte{0, 1, 2, 255},
+			List:   []string{"a", "ünïcode", ""},
+			Meta:   map[string]string{"key": "value"},
+		}
+	)
+
+	Describe("calling ForSubprotocol", func() {
+		It("defaults to JSON in binary frames", func() {
+			c := codec.ForSubprotocol("")
+			Expect(c).To(Equal(codec.Default))
+			Expect(c.Name()).To(Equal(codec.JSONBinary))
+			Expect(c.MessageType()).To(Equal(websocket.BinaryMessage))
+		})
+		It("finds every subprotocol", func() {
+			for _, name := range codec.Subprotocols() {
+				Expect(codec.ForSubprotocol(name).Name()).To(Equal(name))
+			}
+			Expect(codec.ForSubprotocol(codec.JSONText).MessageType()).To(Equal(websocket.TextMessage))
+		})
+	})
+
+	Describe("calling Join", func() {
+		It("combines objects into an array in every encoding", func() {
+			for _, name := range codec.Subprotocols() {
+				c := codec.ForSubprotocol(name)
+				a, err := c.Marshal(obj)
+				Expect(err).To(BeNil())
+				b, err := c.Marshal(object{Action: "typing"})
+				Expect(err).To(BeNil())
+
+				var ret []object
+				Expect(c.Unmarshal(c.Join([][]byte{a, b}), &ret)).To(BeNil())
+				Expect(ret).To(HaveLen(2))
+				Expect(ret[0]).To(Equal(obj))
+				Expect(ret[1].Action).To(Equal("typing"))
+
+				Expect(c.Unmarshal(c.Join(nil), &ret)).To(BeNil())
+				Expect(ret).To(BeEmpty())
+			}
+		})
+	})
+
+	Describe("using JSON", func() {
+		c := codec.ForSubprotocol(codec.JSONText)
+
+		It("round trips objects", func() {
+			data, err := c.Marshal(obj)
+			Expect(err).To(BeNil())
+			var ret object
+			Expect(c.Unmarshal(data, &ret)).To(BeNil())
+			Expect(ret).To(Equal(obj))
+		})
+		It("refuses invalid UTF-8", func() {
+			var ret object
+			Expect(c.Unmarshal([]byte("{\"action\":\"\xff\"}"), &ret)).To(Equal(codec.ErrInvalidUTF8))
+		})
+	})
+
+	Describe("using MessagePack", func() {
+		c := codec.ForSubprotocol(codec.MsgPack)
+
+		It("round trips objects", func() {
+			data, err := c.Marshal(obj)
+			Expect(err).To(BeNil())
+			var ret object
+			Expect(c.Unmarshal(data, &ret)).To(BeNil())
+			Expect(ret).To(Equal(obj))
+		})
+		It("encodes compactly", func() {
+			data, err := c.Marshal(map[string]interface{}{"a": 1, "b": nil})
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0xc0}))
+		})
+		It("reads binary data and wide integers", func() {
+			// {"data": bin8 [1 2], "limit": int16 -300, "time": uint32}
+			data := []byte{0x83,
+				0xa4, 'd', 'a', 't', 'a', 0xc4, 0x02, 0x01, 0x02,
+				0xa5, 'l', 'i', 'm', 'i', 't', 0xd1, 0xfe, 0xd4,
+				0xa4, 't', 'i', 'm', 'e', 0xce, 0x58, 0xd0, 0x41, 0x80,
+			}
+			var ret object
+			Expect(c.Unmarshal(data, &ret)).To(BeNil())
+			Expect(ret.Data).To(Equal([]byte{1, 2}))
+			Expect(ret.Limit).To(Equal(-300))
+			Expect(ret.Time).To(Equal(int64(1490043264)))
+		})
+		/* The expected bytes were produced by github.com/vmihailenco/msgpack/v5
+		 * with compact integers and sorted map keys, headers only for the
+		 * long strings, arrays and maps (see filled). */
+		DescribeTable("matches a reference encoder",
+			func(value interface{}, expected string) {
+				want, err := hex.DecodeString(expected)
+				Expect(err).To(BeNil())
+				want = append(want, filled(value)...)
+
+				data, err := c.Marshal(value)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(want))
+
+				ret := reflect.New(reflect.TypeOf(value))
+				Expect(c.Unmarshal(want, ret.Interface())).To(BeNil())
+				Expect(ret.Elem().Interface()).To(Equal(value))
+			},
+			Entry("positive fixint", int64(127), "7f"),
+			Entry("uint8", int64(128), "cc80"),
+			Entry("uint8 max", int64(255), "ccff"),
+			Entry("uint16", int64(256), "cd0100"),
+			Entry("uint16 max", int64(65535), "cdffff"),
+			Entry("uint32", int64(65536), "ce00010000"),
+			Entry("uint32 max", int64(math.MaxUint32), "ceffffffff"),
+			Entry("uint64", int64(math.MaxUint32+1), "cf0000000100000000"),
+			Entry("int64 max", int64(math.MaxInt64), "cf7fffffffffffffff"),
+			Entry("uint64 max", uint64(math.MaxUint64), "cfffffffffffffffff"),
+			Entry("negative fixint", int64(-32), "e0"),
+			Entry("int8", int64(-33), "d0df"),
+			Entry("int8 min", int64(-128), "d080"),
+			Entry("int16", int64(-129), "d1ff7f"),
+			Entry("int16 min", int64(-32768), "d18000"),
+			Entry("int32", int64(-32769), "d2ffff7fff"),
+			Entry("int32 min", int64(math.MinInt32), "d280000000"),
+			Entry("int64", int64(math.MinInt32-1), "d3ffffffff7fffffff"),
+			Entry("int64 min", int64(math.MinInt64), "d38000000000000000"),
+			Entry("float64", 0.5, "cb3fe0000000000000"),
+			Entry("negative float64", -1.25, "cbbff4000000000000"),
+			Entry("large float64", 1e100, "cb54b249ad2594c37d"),
+			Entry("empty string", "", "a0"),
+			Entry("fixstr max", strings.Repeat("a", 31), "bf"),
+			Entry("str8", strings.Repeat("a", 32), "d920"),
+			Entry("str8 max", strings.Repeat("a", 255), "d9ff"),
+			Entry("str16", strings.Repeat("a", 256), "da0100"),
+			Entry("str16 max", strings.Repeat("a", 65535), "daffff"),
+			Entry("str32", strings.Repeat("a", 65536), "db00010000"),
+			Entry("empty array", []interface{}{}, "90"),
+			Entry("fixarray max", make([]interface{}, 15), "9f"),
+			Entry("array16", make([]interface{}, 16), "dc0010"),
+			Entry("array16 max", make([]interface{}, 65535), "dcffff"),
+			Entry("array32", make([]interface{}, 65536), "dd00010000"),
+			Entry("fixmap max", keys(15), "8f"),
+			Entry("map16", keys(16), "de0010"),
+			Entry("nested objects", map[string]interface{}{
+				"action": "msg",
+				"typing": false,
+				"ok":     true,
+				"to":     nil,
+				"list":   []interface{}{"ünïcode", -40.0, 0.5},
+				"meta":   map[string]interface{}{"key": "value"},
+			}, "86a6616374696f6ea36d7367a46c69737493a9c3bc6ec3af636f6465d0d8cb3fe0000000000000a46d65746181a36b6579a576616c7565a26f6bc3a2746fc0a6747970696e67c2"),
+		)
+		It("reads binary data from a reference encoder", func() {
+			// bin8 [0 1 2 255] by the same encoder.
+			data, err := hex.DecodeString("c404000102ff")
+			Expect(err).To(BeNil())
+			var ret []byte
+			Expect(c.Unmarshal(data, &ret)).To(BeNil())
+			Expect(ret).To(Equal([]byte{0, 1, 2, 255}))
+		})
+		It("refuses malformed data", func() {
+			var ret object
+			// Truncated, trailing, non-string keys, extension types.
+			Expect(c.Unmarshal([]byte{0x81, 0xa4, 't'}, &ret)).To(Equal(codec.ErrInvalidData))
+			Expect(c.Unmarshal([]byte{0x80, 0x00}, &ret)).To(Equal(codec.ErrInvalidData))
+			Expect(c.Unmarshal([]byte{0x81, 0x01, 0x01}, &ret)).To(Equal(codec.ErrInvalidData))
+			Expect(c.Unmarshal([]byte{0xd4, 0x01, 0x01}, &ret)).To(Equal(codec.ErrInvalidData))
+			// A length far beyond the data.
+			Expect(c.Unmarshal([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}, &ret)).To(Equal(codec.ErrInvalidData))
+		})
+		It("refuses deeply nested data", func() {
+			data := make([]byte, 100)
+			for i := range data {
+				data[i] = 0x91
+			}
+			var ret interface{}
+			Expect(c.Unmarshal(data, &ret)).To(Equal(codec.ErrInvalidData))
+		})
+		It("refuses invalid UTF-8", func() {
+			var ret object
+			Expect(c.Unmarshal([]byte{0x81, 0xa6, 'a', 'c', 't', 'i', 'o', 'n', 0xa1, 0xff}, &ret)).To(Equal(codec.ErrInvalidUTF8))
+		})
+	})
+})
+
+/* filled returns what follows the header of a string, array or map built for
+ * the reference table: the characters, nils or sorted keys with nil values. */
+func filled(value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return []byte(v)
+	case []interface{}:
+		return bytes.Repeat([]byte{0xc0}, len(v))
+	case map[string]interface{}:
+		if _, ok := v["k00"]; !ok {
+			break
+		}
+		var ret []byte
+		for i := 0; i < len(v); i++ {
+			ret = append(ret, 0xa3)
+			ret = append(ret, fmt.Sprintf("k%02d", i)...)
+			ret = append(ret, 0xc0)
+		}
+		return ret
+	}
+
+	return nil
+}
+
+// keys returns a map of n keys with nil values.
+func keys(n int) map[string]interface{} {
+	ret := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		ret[fmt.Sprintf("k%02d", i)] = nil
+	}
+	return ret
+}
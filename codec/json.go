@@ -0,0 +1,42 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// jsonCodec sends JSON in either text or binary frames.
+type jsonCodec struct {
+	name        string
+	messageType int
+}
+
+func (c jsonCodec) Name() string {
+	return c.name
+}
+
+func (c jsonCodec) MessageType() int {
+	return c.messageType
+}
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Join(objs [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	buf.Write(bytes.Join(objs, []byte{','}))
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// Unmarshal refuses invalid UTF-8, which would silently be replaced otherwise.
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	if !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -9,6 +9,7 @@ import (
 	"gopkg.in/redis.v5"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -17,6 +18,18 @@ var (
 	// no data can be written. This should never occur.
 	ErrInvalidConfig = errors.New("Invalid config: no data written")
 
+	// ErrNameTaken is returned when writing a user whose username or login
+	// name belongs to another user.
+	ErrNameTaken = errors.New("name belongs to another user")
+
+	// ErrQueueFull is returned when queueing a direct message for a user who
+	// already has OfflineQueueLimit messages waiting.
+	ErrQueueFull = errors.New("offline queue is full")
+
+	// ErrAttachmentUsed is returned when claiming an attachment that was
+	// already sent with another message.
+	ErrAttachmentUsed = errors.New("attachment belongs to another message")
+
 	// TestMode sets the db package to perform a few things differently then
 	// it would otherwise.
 	TestMode bool
@@ -36,7 +49,44 @@ type (
 		GetUserData(id string) (*types.User, error)
 		GetRoomData(gname, rname string) (*types.Room, error)
 		GetGroupData(gname string) (*types.Group, error)
+		GetUserByLoginName(name string) (*types.User, error)
+		GetUniqueID() (uuid.UUID, error)
 		DeleteUser(user *types.User) error
+		SetUserType(user *types.User, userType string) error
+		ListUsers() ([]*types.User, error)
+		ListGroups() ([]string, error)
+		DeleteRoom(gname, rname string) error
+		DeleteGroup(gname string) error
+		WriteBanData(ban *types.Ban) error
+		GetBanData(key string) (*types.Ban, error)
+		ReserveUsername(name, id string) (bool, error)
+		GetUsernameOwner(name string) (string, error)
+		ReleaseUsername(name, id string) error
+		GetLoginNameOwner(name string) (string, error)
+		NextGuestNumber() (int64, error)
+		WriteToken(kind, token, id string, expire time.Duration) error
+		GetToken(kind, token string) (string, error)
+		DeleteToken(kind, token string) error
+		QueueMessage(id string, msg *types.Message) error
+		PopQueuedMessages(id string) ([]*types.Message, error)
+		StoreMessage(msg *types.Message) error
+		GetMessage(id string) (*types.Message, error)
+		UpdateMessage(msg *types.Message) error
+		GetMessages(conv, before string, limit int) ([]*types.Message, bool, error)
+		GetThread(parent, before string, limit int) ([]*types.Message, bool, error)
+		GetMentions(user, before string, limit int) ([]*types.Message, bool, error)
+		SetReadMarker(user, conv, id string) (bool, error)
+		WriteAttachment(att *types.Attachment) error
+		GetAttachment(id string) (*types.Attachment, error)
+		DeleteAttachment(id string) error
+		ClaimAttachments(ids []string, msgID string) error
+		ReleaseAttachments(ids []string, msgID string) error
+		GetUnusedAttachments(before int64) ([]string, error)
+		ReadConversations(user string) ([]string, error)
+		GetUnread(user string, convs []string) ([]*types.Unread, error)
+		AddReaction(id, emoji, user string) (int, error)
+		RemoveReaction(id, emoji, user string) (int, error)
+		GetReactions(id string) (map[string]int, error)
 
 		RedisClient() *redis.Client
 	}
@@ -100,6 +150,10 @@ func (db *dbClient) GetKeySet(search string) ([]string, error) {
 
 // WriteUserData writes a given user object to the current database.
 func (db *dbClient) WriteUserData(user *types.User) error {
+	if user.Created == 0 {
+		user.Created = time.Now().Unix()
+	}
+
 	switch {
 	case db.config.UserDatabase == 0:
 		return db.rdis.writeUserData(user)
@@ -110,6 +164,10 @@ func (db *dbClient) WriteUserData(user *types.User) error {
 
 // WriteRoomData writes a given room object to the current database.
 func (db *dbClient) WriteRoomData(room *types.Room) error {
+	if room.Created == 0 {
+		room.Created = time.Now().Unix()
+	}
+
 	switch {
 	case db.config.UserDatabase == 0:
 		return db.rdis.writeRoomData(room)
@@ -206,6 +264,59 @@ func (db *dbClient) GetGroupData(gname string) (*types.Group, error) {
 	return nil, types.NotInDB
 }
 
+// GetUserByLoginName returns the user with the given login name or nil.
+func (db *dbClient) GetUserByLoginName(name string) (*types.User, error) {
+	// Don't let a login name match other users through the key search.
+	if name == "" || strings.ContainsAny(name, "*?[]\\") {
+		return nil, nil
+	}
+
+	keys, err := db.GetKeySet("user-*-" + name + "-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "GetKeySet")
+	}
+
+	for _, k := range keys {
+		slice := strings.Split(k, "-")
+		if len(slice) < 4 {
+			continue
+		}
+
+		user, err := db.GetUserData(strings.Join(slice[3:], "-"))
+		if err != nil {
+			if err == types.NotInDB {
+				continue
+			}
+			return nil, errors.Wrap(err, "GetUserData")
+		}
+		if user != nil && user.LoginName == name {
+			return user, nil
+		}
+	}
+
+	return nil, nil
+}
+
+/* GetUniqueID returns a new user ID that isn't in use yet.
+ * the probability of a UUID collision is somewhere around 1% in 100 million
+ * UUIDs but we'll be overly cautious and check anyway. */
+func (db *dbClient) GetUniqueID() (uuid.UUID, error) {
+	var id uuid.UUID
+	for {
+		id = uuid.NewRandom()
+		exists, err := db.UserExists(id.String())
+		if err != nil {
+			return nil, errors.Wrap(err, "UserExists")
+		}
+		if exists {
+			continue
+		}
+		break
+	}
+
+	return id, nil
+}
+
 // DeleteUser removes a user from all rooms and groups and deletes it from the
 // database (use sparingly). */
 func (db *dbClient) DeleteUser(user *types.User) error {
@@ -242,6 +353,539 @@ func (db *dbClient) DeleteUser(user *types.User) error {
 	}
 }
 
+// WriteBanData writes the given ban object to the current database.
+func (db *dbClient) WriteBanData(ban *types.Ban) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.writeBanData(ban)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// GetBanData gets the ban data for a given key from the database, if no data
+// exists for the key an empty ban is returned.
+func (db *dbClient) GetBanData(key string) (*types.Ban, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getBanData(key)
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+// ReserveUsername reserves a username (regardless of case) for the given user
+// ID, returning false if it already belongs to someone else.
+func (db *dbClient) ReserveUsername(name, id string) (bool, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.reserveUsername(name, id)
+	default:
+		return false, ErrInvalidConfig
+	}
+}
+
+// GetUsernameOwner returns the ID of the user a username is reserved for or
+// an empty string if it is free.
+func (db *dbClient) GetUsernameOwner(name string) (string, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getUsernameOwner(name)
+	default:
+		break
+	}
+
+	return "", types.NotInDB
+}
+
+// ReleaseUsername frees a username if it is reserved for the given user ID.
+func (db *dbClient) ReleaseUsername(name, id string) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.releaseUsername(name, id)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// GetLoginNameOwner returns the ID of the user with a login name (regardless of
+// case) or an empty string if there is none.
+func (db *dbClient) GetLoginNameOwner(name string) (string, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getLoginNameOwner(name)
+	default:
+		break
+	}
+
+	return "", types.NotInDB
+}
+
+// NextGuestNumber atomically allocates the next guest number, numbers are
+// never handed out twice.
+func (db *dbClient) NextGuestNumber() (int64, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.nextGuestNumber()
+	default:
+		return 0, ErrInvalidConfig
+	}
+}
+
+// WriteToken stores a token of the given kind (such as "verify" or "reset")
+// for a user ID, expiring after the given duration (0 means no expiration).
+// Earlier tokens of the same kind for the user stop working.
+func (db *dbClient) WriteToken(kind, token, id string, expire time.Duration) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.writeToken(kind, token, id, expire)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// GetToken returns the user ID a token belongs to or an empty string if the
+// token doesn't exist or has expired.
+func (db *dbClient) GetToken(kind, token string) (string, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getToken(kind, token)
+	default:
+		break
+	}
+
+	return "", types.NotInDB
+}
+
+// DeleteToken removes a token so it can't be used again.
+func (db *dbClient) DeleteToken(kind, token string) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.deleteToken(kind, token)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+/* QueueMessage queues a direct message for an offline user, messages expire
+ * after OfflineQueueExpire days. ErrQueueFull is returned rather than dropping
+ * anything once OfflineQueueLimit messages are waiting. */
+func (db *dbClient) QueueMessage(id string, msg *types.Message) error {
+	if db.config.OfflineQueueLimit <= 0 {
+		return nil
+	}
+
+	expire := time.Duration(db.config.OfflineQueueExpire) * 24 * time.Hour
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.queueMessage(id, msg, db.config.OfflineQueueLimit, expire)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+/* PopQueuedMessages returns and removes the messages queued for a user in the
+ * order they were sent, messages older than OfflineQueueExpire are dropped.
+ * With MessageStore the stored copies are returned so that edits and
+ * deletions made after queueing are honored. */
+func (db *dbClient) PopQueuedMessages(id string) ([]*types.Message, error) {
+	var (
+		msgs []*types.Message
+		err  error
+	)
+	switch {
+	case db.config.UserDatabase == 0:
+		msgs, err = db.rdis.popQueuedMessages(id)
+		if err != nil {
+			return nil, errors.Wrap(err, "rdis.popQueuedMessages")
+		}
+	default:
+		return nil, ErrInvalidConfig
+	}
+
+	if db.config.MessageStore {
+		if msgs, err = db.currentMessages(msgs); err != nil {
+			return nil, errors.Wrap(err, "currentMessages")
+		}
+	}
+
+	if db.config.OfflineQueueExpire <= 0 {
+		return msgs, nil
+	}
+
+	// The queue expires as a whole, drop any single messages that are too old.
+	cutoff := time.Now().Add(-time.Duration(db.config.OfflineQueueExpire) * 24 * time.Hour).Unix()
+	var ret []*types.Message
+	for _, m := range msgs {
+		if m.Time >= cutoff {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret, nil
+}
+
+/* currentMessages replaces messages by their stored copies, deleted ones are
+ * dropped. Messages no longer stored are kept as they are. */
+func (db *dbClient) currentMessages(msgs []*types.Message) ([]*types.Message, error) {
+	var ret []*types.Message
+	for _, m := range msgs {
+		stored, err := db.GetMessage(m.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetMessage")
+		}
+		switch {
+		case stored == nil:
+			ret = append(ret, m)
+		case !stored.Deleted:
+			ret = append(ret, stored)
+		}
+	}
+
+	return ret, nil
+}
+
+/* StoreMessage stores a message in its conversation (see types.Conversation)
+ * if MessageStore is enabled, honoring MessageExpire and MessageOverflow. */
+func (db *dbClient) StoreMessage(msg *types.Message) error {
+	if !db.config.MessageStore {
+		return nil
+	}
+
+	expire := time.Duration(db.config.MessageExpire) * 24 * time.Hour
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.storeMessage(msg, expire, db.config.MessageOverflow)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// GetMessage returns a stored message by ID or nil if it doesn't exist.
+func (db *dbClient) GetMessage(id string) (*types.Message, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getMessage(id)
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+// UpdateMessage writes the body, edit time and deleted flag of a stored
+// message.
+func (db *dbClient) UpdateMessage(msg *types.Message) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.updateMessage(msg)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+/* GetMessages returns up to limit messages of a conversation sent before the
+ * message with the given ID (or the newest if before is empty), oldest first,
+ * and whether older messages exist. */
+func (db *dbClient) GetMessages(conv, before string, limit int) ([]*types.Message, bool, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getMessages(conv, before, limit)
+	default:
+		break
+	}
+
+	return nil, false, types.NotInDB
+}
+
+// GetThread pages through the replies to a message like GetMessages.
+func (db *dbClient) GetThread(parent, before string, limit int) ([]*types.Message, bool, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getThread(parent, before, limit)
+	default:
+		break
+	}
+
+	return nil, false, types.NotInDB
+}
+
+// GetMentions pages through the messages mentioning a user like GetMessages.
+func (db *dbClient) GetMentions(user, before string, limit int) ([]*types.Message, bool, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getMentions(user, before, limit)
+	default:
+		break
+	}
+
+	return nil, false, types.NotInDB
+}
+
+// WriteAttachment stores the details of an uploaded file.
+func (db *dbClient) WriteAttachment(att *types.Attachment) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.writeAttachment(att)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// GetAttachment returns an attachment by ID or nil if it doesn't exist.
+func (db *dbClient) GetAttachment(id string) (*types.Attachment, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getAttachment(id)
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+// DeleteAttachment removes the details of an uploaded file.
+func (db *dbClient) DeleteAttachment(id string) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.deleteAttachment(id)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+/* ClaimAttachments marks attachments as sent with a message, returning
+ * ErrAttachmentUsed without claiming any if one was sent with another. */
+func (db *dbClient) ClaimAttachments(ids []string, msgID string) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.claimAttachments(ids, msgID)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// ReleaseAttachments undoes ClaimAttachments for a message that wasn't sent.
+func (db *dbClient) ReleaseAttachments(ids []string, msgID string) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.releaseAttachments(ids, msgID)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// GetUnusedAttachments returns the attachments started before the given time
+// (unix) that weren't sent with a message.
+func (db *dbClient) GetUnusedAttachments(before int64) ([]string, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getUnusedAttachments(before)
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+/* SetReadMarker advances a users read marker in a conversation to the message
+ * with the given ID (or everything sent so far if the ID is empty), returning
+ * false if the message isn't part of the conversation. Markers never move
+ * back. */
+func (db *dbClient) SetReadMarker(user, conv, id string) (bool, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.setReadMarker(user, conv, id)
+	default:
+		return false, ErrInvalidConfig
+	}
+}
+
+// ReadConversations returns the conversations a user has a read marker in.
+func (db *dbClient) ReadConversations(user string) ([]string, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.readConversations(user)
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+/* GetUnread counts the stored messages and mentions of a user after their read
+ * marker in each of the given conversations. */
+func (db *dbClient) GetUnread(user string, convs []string) ([]*types.Unread, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.getUnread(user, convs)
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+// AddReaction adds a users emoji reaction to a message, returning the number
+// of users with that reaction.
+func (db *dbClient) AddReaction(id, emoji, user string) (int, error) {
+	expire := time.Duration(db.config.MessageExpire) * 24 * time.Hour
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.addReaction(id, emoji, user, expire)
+	default:
+		return 0, ErrInvalidConfig
+	}
+}
+
+// RemoveReaction removes a users emoji reaction from a message, returning the
+// number of users left with that reaction.
+func (db *dbClient) RemoveReaction(id, emoji, user string) (int, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.removeReaction(id, emoji, user)
+	default:
+		return 0, ErrInvalidConfig
+	}
+}
+
+// GetReactions returns the number of users per emoji reaction on a message.
+func (db *dbClient) GetReactions(id string) (map[string]int, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		reactions, err := db.rdis.getReactions([]string{id})
+		if err != nil {
+			return nil, errors.Wrap(err, "rdis.getReactions")
+		}
+		return reactions[0], nil
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+// SetUserType changes the type of a user, moving any data stored under the
+// old type.
+func (db *dbClient) SetUserType(user *types.User, userType string) error {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.setUserType(user, userType)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// ListUsers returns every user in the database.
+func (db *dbClient) ListUsers() ([]*types.User, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.listUsers()
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+// ListGroups returns the names of every group in the database.
+func (db *dbClient) ListGroups() ([]string, error) {
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.listGroups()
+	default:
+		break
+	}
+
+	return nil, types.NotInDB
+}
+
+// DeleteRoom removes a room from its group and its users and deletes it from
+// the database.
+func (db *dbClient) DeleteRoom(gname, rname string) error {
+	room, err := db.GetRoomData(gname, rname)
+	if err != nil {
+		return errors.Wrap(err, "GetRoomData")
+	}
+
+	for _, u := range room.Users {
+		var rooms []string
+		for _, r := range u.Rooms {
+			if r != gname+"/"+rname {
+				rooms = append(rooms, r)
+			}
+		}
+		u.Rooms = rooms
+
+		if err := db.WriteUserData(u); err != nil {
+			return errors.Wrap(err, "WriteUserData")
+		}
+	}
+
+	switch {
+	case db.config.UserDatabase == 0:
+		return db.rdis.deleteRoom(gname, rname)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
+// DeleteGroup deletes a group and all of its rooms from the database,
+// removing them from any users.
+func (db *dbClient) DeleteGroup(gname string) error {
+	group, err := db.GetGroupData(gname)
+	if err != nil {
+		return errors.Wrap(err, "GetGroupData")
+	}
+
+	// Update every affected user once so their sets aren't written twice.
+	users := make(map[string]*types.User)
+	for k, u := range group.Users {
+		users[k] = u
+	}
+	for _, r := range group.Rooms {
+		for k, u := range r.Users {
+			if _, ok := users[k]; !ok {
+				users[k] = u
+			}
+		}
+	}
+
+	for _, u := range users {
+		var rooms, groups []string
+		for _, r := range u.Rooms {
+			if !strings.HasPrefix(r, gname+"/") {
+				rooms = append(rooms, r)
+			}
+		}
+		for _, g := range u.Groups {
+			if g != gname {
+				groups = append(groups, g)
+			}
+		}
+		u.Rooms = rooms
+		u.Groups = groups
+
+		if err := db.WriteUserData(u); err != nil {
+			return errors.Wrap(err, "WriteUserData")
+		}
+	}
+
+	switch {
+	case db.config.UserDatabase == 0:
+		for rname := range group.Rooms {
+			if err := db.rdis.deleteRoom(gname, rname); err != nil {
+				return errors.Wrap(err, "rdis.deleteRoom")
+			}
+		}
+		return db.rdis.deleteGroup(gname)
+	default:
+		return ErrInvalidConfig
+	}
+}
+
 // RedisClient returns the underlying *redis.Client for testing.
 func (db *dbClient) RedisClient() *redis.Client {
 	return db.rdis.Client()
@@ -1,6 +1,10 @@
 package db_test
 
 import (
+	"fmt"
+	"time"
+
+	"tiberious/db"
 	"tiberious/types"
 
 	"github.com/pborman/uuid"
@@ -29,6 +33,10 @@ var (
 		Connected: false,
 		Rooms:     []string{"#testing/#testing"},
 		Groups:    []string{"#testing"},
+
+		DisplayName: "DB Test",
+		TimeZone:    "UTC",
+		LastSeen:    1,
 	}
 )
 
@@ -38,6 +46,18 @@ var _ = Describe("db", func() {
 			err := f.client.WriteUserData(user)
 			Expect(err).To(BeNil())
 		})
+		It("refuses names owned by another user", func() {
+			other := &types.User{ID: uuid.NewRandom(), Type: "test", Username: "dbother", LoginName: "DBTest"}
+			Expect(f.client.WriteUserData(other)).To(Equal(db.ErrNameTaken))
+
+			// The username claimed before the login name was refused is released.
+			owner, err := f.client.GetUsernameOwner("dbother")
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal(""))
+			exists, err := f.client.UserExists(other.ID.String())
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeFalse())
+		})
 	})
 
 	Describe("Calling UserExists", func() {
@@ -60,6 +80,42 @@ var _ = Describe("db", func() {
 			Expect(u.Username).To(Equal(un))
 			Expect(u.Password).To(Equal(verySecret))
 		})
+		It("keeps profile fields", func() {
+			u, err := f.client.GetUserData(id.String())
+			Expect(err).To(BeNil())
+			Expect(u.DisplayName).To(Equal("DB Test"))
+			Expect(u.TimeZone).To(Equal("UTC"))
+			Expect(u.LastSeen).To(Equal(int64(1)))
+			Expect(u.Created).NotTo(BeZero())
+		})
+		It("keeps legacy passwords usable until they're hashed", func() {
+			legacy := &types.User{ID: uuid.NewRandom(), Type: "test", LoginName: "dblegacy", Password: verySecret}
+			Expect(f.client.WriteUserData(legacy)).To(BeNil())
+
+			u, err := f.client.GetUserData(legacy.ID.String())
+			Expect(err).To(BeNil())
+			Expect(u.HasLegacyPassword()).To(BeTrue())
+			Expect(u.IsPassword(verySecret)).To(BeTrue())
+
+			u.SetPassword(verySecret)
+			Expect(f.client.WriteUserData(u)).To(BeNil())
+			u, err = f.client.GetUserData(legacy.ID.String())
+			Expect(err).To(BeNil())
+			Expect(u.HasLegacyPassword()).To(BeFalse())
+			Expect(u.IsPassword(verySecret)).To(BeTrue())
+			Expect(u.IsPassword(u.Password)).To(BeFalse())
+		})
+		It("doesn't mistake plain text passwords that look hashed", func() {
+			plain := types.HashPassword("dbplain", verySecret)
+			legacy := &types.User{ID: uuid.NewRandom(), Type: "test", LoginName: "dblookalike", Password: plain, Salt: verySecret}
+			Expect(f.client.WriteUserData(legacy)).To(BeNil())
+
+			u, err := f.client.GetUserData(legacy.ID.String())
+			Expect(err).To(BeNil())
+			Expect(u.HasLegacyPassword()).To(BeTrue())
+			Expect(u.IsPassword(plain)).To(BeTrue())
+			Expect(u.IsPassword("dbplain")).To(BeFalse())
+		})
 	})
 
 	Describe("Calling WriteRoomData", func() {
@@ -68,6 +124,8 @@ var _ = Describe("db", func() {
 				Title:   "#testing",
 				Group:   "#testing",
 				Private: false,
+				Topic:   "Testing things",
+				Meta:    map[string]string{"language": "en"},
 			}
 			room.Users = make(map[string]*types.User)
 			room.Users[user.ID.String()] = user
@@ -98,6 +156,13 @@ var _ = Describe("db", func() {
 			Expect(room.Users).ToNot(BeEmpty())
 			Expect(room.Users[id.String()].Username).To(Equal(un))
 		})
+		It("keeps the topic and metadata", func() {
+			room, err := f.client.GetRoomData("#testing", "#testing")
+			Expect(err).To(BeNil())
+			Expect(room.Topic).To(Equal("Testing things"))
+			Expect(room.Meta).To(HaveKeyWithValue("language", "en"))
+			Expect(room.Created).NotTo(BeZero())
+		})
 	})
 
 	Describe("Calling WriteGroupData", func() {
@@ -146,4 +211,403 @@ var _ = Describe("db", func() {
 			Expect(group.Users[id.String()].Username).To(Equal(un))
 		})
 	})
+
+	Describe("Calling WriteBanData", func() {
+		It("works correctly", func() {
+			ban := &types.Ban{
+				Key:     "user-" + id.String(),
+				Score:   3,
+				Updated: 1000,
+				Expires: 2000,
+			}
+
+			err := f.client.WriteBanData(ban)
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("Calling GetBanData", func() {
+		It("works correctly", func() {
+			ban, err := f.client.GetBanData("user-" + id.String())
+			Expect(err).To(BeNil())
+			Expect(ban.Score).To(Equal(3))
+			Expect(ban.Updated).To(Equal(int64(1000)))
+			Expect(ban.Expires).To(Equal(int64(2000)))
+			Expect(ban.Permanent).To(BeFalse())
+		})
+		It("returns an empty ban for unknown keys", func() {
+			ban, err := f.client.GetBanData("ip-127.0.0.2")
+			Expect(err).To(BeNil())
+			Expect(ban.Key).To(Equal("ip-127.0.0.2"))
+			Expect(ban.Score).To(Equal(0))
+		})
+	})
+
+	Describe("Calling ReserveUsername", func() {
+		It("is reserved by WriteUserData", func() {
+			owner, err := f.client.GetUsernameOwner(un)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal(id.String()))
+		})
+		It("ignores case", func() {
+			ok, err := f.client.ReserveUsername("DBTest", uuid.NewRandom().String())
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeFalse())
+		})
+		It("succeeds for the owner", func() {
+			ok, err := f.client.ReserveUsername("DBTest", id.String())
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Describe("Calling ReleaseUsername", func() {
+		It("doesn't release names owned by someone else", func() {
+			err := f.client.ReleaseUsername(un, uuid.NewRandom().String())
+			Expect(err).To(BeNil())
+			owner, err := f.client.GetUsernameOwner(un)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal(id.String()))
+		})
+		It("works correctly", func() {
+			err := f.client.ReleaseUsername(un, id.String())
+			Expect(err).To(BeNil())
+			owner, err := f.client.GetUsernameOwner(un)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal(""))
+		})
+	})
+
+	Describe("Calling GetLoginNameOwner", func() {
+		It("is indexed by WriteUserData regardless of case", func() {
+			owner, err := f.client.GetLoginNameOwner("DBTEST")
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal(id.String()))
+		})
+		It("doesn't match patterns", func() {
+			owner, err := f.client.GetLoginNameOwner("dbt*")
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal(""))
+		})
+	})
+
+	Describe("Calling NextGuestNumber", func() {
+		It("never returns the same number twice", func() {
+			first, err := f.client.NextGuestNumber()
+			Expect(err).To(BeNil())
+			second, err := f.client.NextGuestNumber()
+			Expect(err).To(BeNil())
+			Expect(second).To(BeNumerically(">", first))
+		})
+	})
+
+	Describe("Calling WriteToken", func() {
+		It("replaces earlier tokens of the same kind", func() {
+			owner := uuid.NewRandom().String()
+			Expect(f.client.WriteToken("reset", "dbfirst", owner, time.Hour)).To(BeNil())
+			Expect(f.client.WriteToken("verify", "dbverify", owner, time.Hour)).To(BeNil())
+			Expect(f.client.WriteToken("reset", "dbsecond", owner, time.Hour)).To(BeNil())
+
+			id, err := f.client.GetToken("reset", "dbfirst")
+			Expect(err).To(BeNil())
+			Expect(id).To(Equal(""))
+			id, err = f.client.GetToken("reset", "dbsecond")
+			Expect(err).To(BeNil())
+			Expect(id).To(Equal(owner))
+			id, err = f.client.GetToken("verify", "dbverify")
+			Expect(err).To(BeNil())
+			Expect(id).To(Equal(owner))
+		})
+	})
+
+	Describe("Calling QueueMessage", func() {
+		It("delivers messages in order and only once", func() {
+			to := uuid.NewRandom().String()
+			first := types.NewMessage(to, id.String(), "first")
+			second := types.NewMessage(to, id.String(), "second")
+			Expect(f.client.QueueMessage(to, first)).To(BeNil())
+			Expect(f.client.QueueMessage(to, second)).To(BeNil())
+
+			msgs, err := f.client.PopQueuedMessages(to)
+			Expect(err).To(BeNil())
+			Expect(msgs).To(HaveLen(2))
+			Expect(msgs[0].ID).To(Equal(first.ID))
+			Expect(msgs[1].Body).To(Equal("second"))
+
+			msgs, err = f.client.PopQueuedMessages(to)
+			Expect(err).To(BeNil())
+			Expect(msgs).To(BeEmpty())
+		})
+		It("refuses messages once the queue is full", func() {
+			to := uuid.NewRandom().String()
+			first := types.NewMessage(to, id.String(), "first")
+			Expect(f.client.QueueMessage(to, first)).To(BeNil())
+
+			var (
+				queued = 1
+				err    error
+			)
+			for ; queued < 1000; queued++ {
+				if err = f.client.QueueMessage(to, types.NewMessage(to, id.String(), fmt.Sprint(queued))); err != nil {
+					break
+				}
+			}
+			Expect(err).To(Equal(db.ErrQueueFull))
+
+			msgs, err := f.client.PopQueuedMessages(to)
+			Expect(err).To(BeNil())
+			Expect(msgs).To(HaveLen(queued))
+			Expect(msgs[0].ID).To(Equal(first.ID))
+		})
+	})
+
+	Describe("Calling StoreMessage", func() {
+		var (
+			conv = "#testing/#history"
+			msgs []*types.Message
+		)
+
+		It("works correctly", func() {
+			for i := 0; i < 3; i++ {
+				msg := types.NewMessage(conv, id.String(), fmt.Sprintf("message %d", i))
+				msgs = append(msgs, msg)
+				Expect(f.client.StoreMessage(msg)).To(BeNil())
+			}
+		})
+		It("pages through history oldest first", func() {
+			page, more, err := f.client.GetMessages(conv, "", 2)
+			Expect(err).To(BeNil())
+			Expect(more).To(BeTrue())
+			Expect(page).To(HaveLen(2))
+			Expect(page[0].ID).To(Equal(msgs[1].ID))
+			Expect(page[1].ID).To(Equal(msgs[2].ID))
+
+			page, more, err = f.client.GetMessages(conv, msgs[1].ID, 2)
+			Expect(err).To(BeNil())
+			Expect(more).To(BeFalse())
+			Expect(page).To(HaveLen(1))
+			Expect(page[0].Body).To(Equal("message 0"))
+			Expect(page[0].ContentType).To(Equal(types.ContentPlain))
+		})
+		It("updates messages", func() {
+			msgs[0].Body = ""
+			msgs[0].Deleted = true
+			Expect(f.client.UpdateMessage(msgs[0])).To(BeNil())
+
+			msg, err := f.client.GetMessage(msgs[0].ID)
+			Expect(err).To(BeNil())
+			Expect(msg.Deleted).To(BeTrue())
+			Expect(msg.From).To(Equal(id.String()))
+		})
+		It("aggregates reactions", func() {
+			other := uuid.NewRandom().String()
+			count, err := f.client.AddReaction(msgs[2].ID, "+1", id.String())
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(1))
+			count, err = f.client.AddReaction(msgs[2].ID, "+1", other)
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(2))
+			count, err = f.client.AddReaction(msgs[2].ID, "+1", other)
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(2))
+
+			page, _, err := f.client.GetMessages(conv, "", 1)
+			Expect(err).To(BeNil())
+			Expect(page[0].Reactions).To(Equal(map[string]int{"+1": 2}))
+
+			count, err = f.client.RemoveReaction(msgs[2].ID, "+1", id.String())
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(1))
+			count, err = f.client.RemoveReaction(msgs[2].ID, "+1", other)
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(0))
+
+			reactions, err := f.client.GetReactions(msgs[2].ID)
+			Expect(err).To(BeNil())
+			Expect(reactions).To(BeEmpty())
+		})
+		It("keeps thread replies", func() {
+			reply := types.NewMessage(conv, id.String(), "reply")
+			reply.Parent = msgs[1].ID
+			Expect(f.client.StoreMessage(reply)).To(BeNil())
+
+			parent, err := f.client.GetMessage(msgs[1].ID)
+			Expect(err).To(BeNil())
+			Expect(parent.Replies).To(Equal(1))
+			Expect(parent.LastReply).To(Equal(reply.Time))
+
+			page, more, err := f.client.GetThread(msgs[1].ID, "", 10)
+			Expect(err).To(BeNil())
+			Expect(more).To(BeFalse())
+			Expect(page).To(HaveLen(1))
+			Expect(page[0].Parent).To(Equal(msgs[1].ID))
+		})
+		It("counts unread messages and mentions", func() {
+			reader := uuid.NewRandom().String()
+			ok, err := f.client.SetReadMarker(reader, conv, msgs[0].ID)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+
+			msg := types.NewMessage(conv, id.String(), "@reader hi")
+			msg.Mentions = []string{reader}
+			Expect(f.client.StoreMessage(msg)).To(BeNil())
+
+			unread, err := f.client.GetUnread(reader, []string{conv})
+			Expect(err).To(BeNil())
+			Expect(unread).To(HaveLen(1))
+			Expect(unread[0].Unread).To(Equal(4))
+			Expect(unread[0].Mentions).To(Equal(1))
+
+			mentions, more, err := f.client.GetMentions(reader, "", 10)
+			Expect(err).To(BeNil())
+			Expect(more).To(BeFalse())
+			Expect(mentions).To(HaveLen(1))
+			Expect(mentions[0].ID).To(Equal(msg.ID))
+			Expect(mentions[0].Mentions).To(ConsistOf(reader))
+
+			ok, err = f.client.SetReadMarker(reader, conv, "")
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+			ok, err = f.client.SetReadMarker(reader, conv, msgs[1].ID)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+
+			unread, err = f.client.GetUnread(reader, []string{conv})
+			Expect(err).To(BeNil())
+			Expect(unread[0].Unread).To(Equal(0))
+			Expect(unread[0].Mentions).To(Equal(0))
+
+			convs, err := f.client.ReadConversations(reader)
+			Expect(err).To(BeNil())
+			Expect(convs).To(ConsistOf(conv))
+
+			ok, err = f.client.SetReadMarker(reader, conv, uuid.NewRandom().String())
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeFalse())
+		})
+		It("clears the mentions and attachments of deleted messages", func() {
+			msg := types.NewMessage(conv, id.String(), "@reader see attached")
+			msg.Mentions = []string{uuid.NewRandom().String()}
+			msg.Attachments = []string{uuid.NewRandom().String()}
+			Expect(f.client.StoreMessage(msg)).To(BeNil())
+
+			msg.Body = ""
+			msg.Mentions = nil
+			msg.Attachments = nil
+			msg.Deleted = true
+			Expect(f.client.UpdateMessage(msg)).To(BeNil())
+
+			stored, err := f.client.GetMessage(msg.ID)
+			Expect(err).To(BeNil())
+			Expect(stored.Deleted).To(BeTrue())
+			Expect(stored.Body).To(BeEmpty())
+			Expect(stored.Mentions).To(BeEmpty())
+			Expect(stored.Attachments).To(BeEmpty())
+		})
+		It("drops deleted messages from the mentions", func() {
+			reader := uuid.NewRandom().String()
+			msg := types.NewMessage(conv, id.String(), "@reader hi")
+			msg.Mentions = []string{reader}
+			Expect(f.client.StoreMessage(msg)).To(BeNil())
+
+			msg.Body = ""
+			msg.Mentions = nil
+			msg.Deleted = true
+			Expect(f.client.UpdateMessage(msg)).To(BeNil())
+
+			mentions, _, err := f.client.GetMentions(reader, "", 10)
+			Expect(err).To(BeNil())
+			Expect(mentions).To(BeEmpty())
+			unread, err := f.client.GetUnread(reader, []string{conv})
+			Expect(err).To(BeNil())
+			Expect(unread[0].Mentions).To(Equal(0))
+		})
+		It("keeps read markers and mentions when changing the user type", func() {
+			u := &types.User{ID: uuid.NewRandom(), Type: "test", Username: "dbpromote", LoginName: "dbpromote"}
+			Expect(f.client.WriteUserData(u)).To(BeNil())
+			ok, err := f.client.SetReadMarker(u.ID.String(), conv, msgs[0].ID)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+			msg := types.NewMessage(conv, id.String(), "@dbpromote hi")
+			msg.Mentions = []string{u.ID.String()}
+			Expect(f.client.StoreMessage(msg)).To(BeNil())
+
+			Expect(f.client.SetUserType(u, "admin")).To(BeNil())
+
+			keys, err := f.client.GetKeySet("user-test-dbpromote-*")
+			Expect(err).To(BeNil())
+			Expect(keys).To(BeEmpty())
+			promoted, err := f.client.GetUserByLoginName("dbpromote")
+			Expect(err).To(BeNil())
+			Expect(promoted.Type).To(Equal("admin"))
+			owner, err := f.client.GetUsernameOwner("dbpromote")
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal(u.ID.String()))
+
+			convs, err := f.client.ReadConversations(u.ID.String())
+			Expect(err).To(BeNil())
+			Expect(convs).To(ConsistOf(conv))
+			unread, err := f.client.GetUnread(u.ID.String(), convs)
+			Expect(err).To(BeNil())
+			Expect(unread[0].Mentions).To(Equal(1))
+			mentions, _, err := f.client.GetMentions(u.ID.String(), "", 10)
+			Expect(err).To(BeNil())
+			Expect(mentions).To(HaveLen(1))
+		})
+	})
+
+	Describe("Calling ClaimAttachments", func() {
+		upload := func(uploaded int64) string {
+			att := types.NewAttachment("#default/#general", uuid.NewRandom().String(), "a.png", "image/png", 1)
+			att.Time = uploaded
+			att.Complete = true
+			Expect(f.client.WriteAttachment(att)).To(BeNil())
+			return att.ID
+		}
+
+		It("lets each attachment belong to a single message", func() {
+			a, b, c := upload(1), upload(2), upload(3)
+			Expect(f.client.ClaimAttachments([]string{a, b}, "first")).To(BeNil())
+			Expect(f.client.ClaimAttachments([]string{c, a}, "second")).To(Equal(db.ErrAttachmentUsed))
+
+			att, err := f.client.GetAttachment(a)
+			Expect(err).To(BeNil())
+			Expect(att.MessageID).To(Equal("first"))
+			// Nothing is claimed if one of them is taken.
+			att, err = f.client.GetAttachment(c)
+			Expect(err).To(BeNil())
+			Expect(att.MessageID).To(BeEmpty())
+
+			unused, err := f.client.GetUnusedAttachments(3)
+			Expect(err).To(BeNil())
+			Expect(unused).To(ContainElement(c))
+			Expect(unused).NotTo(ContainElement(a))
+			Expect(unused).NotTo(ContainElement(b))
+		})
+		It("only releases attachments of the same message", func() {
+			a := upload(1)
+			Expect(f.client.ClaimAttachments([]string{a}, "first")).To(BeNil())
+			Expect(f.client.ReleaseAttachments([]string{a}, "second")).To(BeNil())
+			Expect(f.client.ClaimAttachments([]string{a}, "second")).To(Equal(db.ErrAttachmentUsed))
+
+			Expect(f.client.ReleaseAttachments([]string{a}, "first")).To(BeNil())
+			unused, err := f.client.GetUnusedAttachments(1)
+			Expect(err).To(BeNil())
+			Expect(unused).To(ContainElement(a))
+			Expect(f.client.ClaimAttachments([]string{a}, "second")).To(BeNil())
+		})
+		It("lists unused attachments by upload time until deleted", func() {
+			early, late := upload(10), upload(20)
+
+			unused, err := f.client.GetUnusedAttachments(15)
+			Expect(err).To(BeNil())
+			Expect(unused).To(ContainElement(early))
+			Expect(unused).NotTo(ContainElement(late))
+
+			Expect(f.client.DeleteAttachment(early)).To(BeNil())
+			unused, err = f.client.GetUnusedAttachments(15)
+			Expect(err).To(BeNil())
+			Expect(unused).NotTo(ContainElement(early))
+		})
+	})
 })
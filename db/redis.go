@@ -2,8 +2,12 @@ package db
 
 import (
 	"bytes"
+	"encoding/json"
 	"strconv"
+	"strings"
+	"sync"
 	"tiberious/types"
+	"time"
 
 	"gopkg.in/redis.v5"
 
@@ -19,12 +23,40 @@ Data map:
 		Joined Rooms: "user-"+<user-type+"-"+<uuid>+"rooms" (set)
 		Joined Groups: "user-"+<user-type+"-"+<uuid>+"groups" (set)
 	Rooms:
-		Info: "room-"+<group name>+<room name>+"-info" (hash)
+		Info: "room-"+<group name>+<room name>+"-info" (hash, metadata is
+			stored as "meta-"+<key> fields)
 		User List: "room-"+<group name>+<room name>+"-list" (set)
 	Groups:
 		Info: "group-"+<group name>+"info" (hash)
 		User List: "group-"+<group name>+"-users" (set)
 		Room List: "group-"+<group name>+"-rooms" (set)
+	Usernames:
+		Owners: "usernames" (hash of lowercase username -> uuid)
+		Login Names: "loginnames" (hash of lowercase login name -> uuid)
+		Guest Counter: "guest-counter" (integer)
+	Bans:
+		Info: "ban-"+<"user-"+<uuid> or "ip-"+<address>> (hash)
+	Tokens:
+		Owner: "token-"+<kind>+"-"+<token> (string uuid, expiring)
+		Latest: "tokens-"+<kind>+"-"+<uuid> (string token, expiring)
+	Offline Queue:
+		Messages: "queue-"+<uuid> (list of json encoded messages)
+	Messages:
+		Info: "message-"+<message id> (hash)
+		Conversation: "messages-"+<"group/room" or "<uuid>:<uuid>"> (sorted
+			set of message IDs scored by microseconds)
+		Reactions: "reactions-"+<message id> (set of emoji)
+		Reaction Users: "reactions-"+<message id>+"-"+<emoji> (set of uuid)
+		Thread: "thread-"+<parent message id> (sorted set of reply IDs scored
+			by microseconds)
+		Mentions: "mentions-"+<uuid> (sorted set of message IDs scored by
+			microseconds)
+		Conversation Mentions: "mentions-"+<uuid>+"-"+<conversation> (sorted
+			set of message IDs scored by microseconds)
+	Read Markers: "reads-"+<uuid> (hash of conversation -> microseconds)
+	Attachments: "attachment-"+<attachment id> (hash)
+	Unused Attachments: "attachments-unused" (sorted set of attachment IDs
+		scored by upload time)
 */
 
 var (
@@ -43,12 +75,49 @@ type (
 		getRoomData(gname, rname string) (*types.Room, error)
 		getGroupData(gname string) (*types.Group, error)
 		deleteUser(user *types.User) error
+		setUserType(user *types.User, userType string) error
+		writeBanData(ban *types.Ban) error
+		getBanData(key string) (*types.Ban, error)
+		reserveUsername(name, id string) (bool, error)
+		getUsernameOwner(name string) (string, error)
+		releaseUsername(name, id string) error
+		getLoginNameOwner(name string) (string, error)
+		nextGuestNumber() (int64, error)
+		writeToken(kind, token, id string, expire time.Duration) error
+		getToken(kind, token string) (string, error)
+		deleteToken(kind, token string) error
+		queueMessage(id string, msg *types.Message, limit int, expire time.Duration) error
+		popQueuedMessages(id string) ([]*types.Message, error)
+		storeMessage(msg *types.Message, expire time.Duration, overflow int) error
+		getMessage(id string) (*types.Message, error)
+		updateMessage(msg *types.Message) error
+		getMessages(conv, before string, limit int) ([]*types.Message, bool, error)
+		getThread(parent, before string, limit int) ([]*types.Message, bool, error)
+		getMentions(user, before string, limit int) ([]*types.Message, bool, error)
+		setReadMarker(user, conv, id string) (bool, error)
+		writeAttachment(att *types.Attachment) error
+		getAttachment(id string) (*types.Attachment, error)
+		deleteAttachment(id string) error
+		claimAttachments(ids []string, msgID string) error
+		releaseAttachments(ids []string, msgID string) error
+		getUnusedAttachments(before int64) ([]string, error)
+		readConversations(user string) ([]string, error)
+		getUnread(user string, convs []string) ([]*types.Unread, error)
+		addReaction(id, emoji, user string, expire time.Duration) (int, error)
+		removeReaction(id, emoji, user string) (int, error)
+		getReactions(ids []string) ([]map[string]int, error)
+		listUsers() ([]*types.User, error)
+		listGroups() ([]string, error)
+		deleteRoom(gname, rname string) error
+		deleteGroup(gname string) error
 
 		Client() *redis.Client
 	}
 
 	rClient struct {
 		client *redis.Client
+		// Track set updates running in the background so shutdown can wait.
+		pending sync.WaitGroup
 
 		log *logrus.Logger
 	}
@@ -97,7 +166,19 @@ func boolstr(s string) bool {
 	return false
 }
 
+// Fields missing from older records read back as 0.
+func int64str(s string) int64 {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return i
+}
+
 func (r *rClient) shutdown() {
+	r.pending.Wait()
+
 	var (
 		save *redis.StatusCmd
 		//quit *redis.StatusCmd
@@ -181,6 +262,15 @@ func (r *rClient) updateSet(key string, new []string) {
 	}
 }
 
+// updateSetAsync runs updateSet in the background.
+func (r *rClient) updateSetAsync(key string, new []string) {
+	r.pending.Add(1)
+	go func() {
+		defer r.pending.Done()
+		r.updateSet(key, new)
+	}()
+}
+
 func (r *rClient) getKeySet(search string) ([]string, error) {
 	var cmd *redis.StringSliceCmd
 	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
@@ -200,30 +290,48 @@ func (r *rClient) getKeySet(search string) ([]string, error) {
 
 func (r *rClient) writeUserData(user *types.User) error {
 	m := map[string]string{
-		"id":        user.ID.String(),
-		"type":      user.Type,
-		"username":  user.Username,
-		"loginname": user.LoginName,
-		"email":     user.Email,
-		"password":  user.Password,
-		"salt":      user.Salt,
-		"connected": strbool(user.Connected),
+		"id":           user.ID.String(),
+		"type":         user.Type,
+		"username":     user.Username,
+		"loginname":    user.LoginName,
+		"email":        user.Email,
+		"password":     user.Password,
+		"salt":         user.Salt,
+		"passwordhash": user.PasswordHash,
+		"provider":     user.Provider,
+		"connected":    strbool(user.Connected),
+		"verified":     strbool(user.Verified),
+
+		"displayname": user.DisplayName,
+		"statustext":  user.StatusText,
+		"avatarurl":   user.AvatarURL,
+		"timezone":    user.TimeZone,
+		"created":     strconv.FormatInt(user.Created, 10),
+		"lastseen":    strconv.FormatInt(user.LastSeen, 10),
+	}
+
+	// Names belong to whoever wrote them first, see reserveUserNames.
+	release, err := r.reserveUserNames(user)
+	if err != nil {
+		return err
 	}
 
 	var cmd *redis.StatusCmd
-	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+	if _, err = r.client.Pipelined(func(pipe *redis.Pipeline) error {
 		cmd = pipe.HMSet("user-"+user.Type+"-"+user.LoginName+"-"+user.ID.String(), m)
 		return nil
 	}); err != nil {
+		release()
 		return errors.Wrap(err, "r.client.Pipelined HMSet")
 	}
 
-	if _, err := cmd.Result(); err != nil {
+	if _, err = cmd.Result(); err != nil {
+		release()
 		return errors.Wrap(err, "r.client.Pipelined HMSet")
 	}
 
-	go r.updateSet("user-"+user.Type+"-"+user.ID.String()+"-rooms", user.Rooms)
-	go r.updateSet("user-"+user.Type+"-"+user.ID.String()+"-groups", user.Groups)
+	r.updateSetAsync("user-"+user.Type+"-"+user.ID.String()+"-rooms", user.Rooms)
+	r.updateSetAsync("user-"+user.Type+"-"+user.ID.String()+"-groups", user.Groups)
 
 	return nil
 }
@@ -235,10 +343,38 @@ func (r *rClient) writeRoomData(room *types.Room) error {
 			"title":   room.Title,
 			"group":   room.Group,
 			"private": strbool(room.Private),
+
+			"topic":       room.Topic,
+			"topicby":     room.TopicBy,
+			"topictime":   strconv.FormatInt(room.TopicTime, 10),
+			"description": room.Description,
+			"creator":     room.Creator,
+			"created":     strconv.FormatInt(room.Created, 10),
 		}
+		key = "room-" + room.Group + "-" + room.Title + "-info"
 	)
+	for k, v := range room.Meta {
+		m["meta-"+k] = v
+	}
+
+	fields, err := r.client.HKeys(key).Result()
+	if err != nil {
+		return errors.Wrap(err, "r.client.HKeys")
+	}
+
+	// Metadata removed from the room has to be removed from the hash too.
+	var stale []string
+	for _, f := range fields {
+		if _, ok := m[f]; !ok && strings.HasPrefix(f, "meta-") {
+			stale = append(stale, f)
+		}
+	}
+
 	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
-		cmd = pipe.HMSet("room-"+room.Group+"-"+room.Title+"-info", m)
+		cmd = pipe.HMSet(key, m)
+		if len(stale) > 0 {
+			pipe.HDel(key, stale...)
+		}
 		return nil
 	}); err != nil {
 		return errors.Wrap(err, "r.client.Pipelined HMSet")
@@ -253,7 +389,7 @@ func (r *rClient) writeRoomData(room *types.Room) error {
 		slice = append(slice, u.ID.String())
 	}
 
-	go r.updateSet("room-"+room.Group+"-"+room.Title+"-list", slice)
+	r.updateSetAsync("room-"+room.Group+"-"+room.Title+"-list", slice)
 	return nil
 }
 
@@ -274,14 +410,14 @@ func (r *rClient) writeGroupData(group *types.Group) error {
 	for _, r := range group.Rooms {
 		slice = append(slice, r.Title)
 	}
-	go r.updateSet("group-"+group.Title+"-rooms", slice)
+	r.updateSetAsync("group-"+group.Title+"-rooms", slice)
 
 	slice = nil
 	for _, u := range group.Users {
 		slice = append(slice, u.ID.String())
 	}
 
-	go r.updateSet("group-"+group.Title+"-users", slice)
+	r.updateSetAsync("group-"+group.Title+"-users", slice)
 
 	return nil
 }
@@ -315,14 +451,24 @@ func (r *rClient) getUserData(id string) (*types.User, error) {
 	}
 
 	user := &types.User{
-		ID:        uuid.Parse(info["id"]),
-		Type:      info["type"],
-		Username:  info["username"],
-		LoginName: info["loginname"],
-		Email:     info["email"],
-		Password:  info["password"],
-		Salt:      info["salt"],
-		Connected: boolstr(info["connected"]),
+		ID:           uuid.Parse(info["id"]),
+		Type:         info["type"],
+		Username:     info["username"],
+		LoginName:    info["loginname"],
+		Email:        info["email"],
+		Password:     info["password"],
+		Salt:         info["salt"],
+		PasswordHash: info["passwordhash"],
+		Provider:     info["provider"],
+		Connected:    boolstr(info["connected"]),
+		Verified:     boolstr(info["verified"]),
+
+		DisplayName: info["displayname"],
+		StatusText:  info["statustext"],
+		AvatarURL:   info["avatarurl"],
+		TimeZone:    info["timezone"],
+		Created:     int64str(info["created"]),
+		LastSeen:    int64str(info["lastseen"]),
 	}
 
 	if _, err = r.client.Pipelined(func(pipe *redis.Pipeline) error {
@@ -382,6 +528,19 @@ func (r *rClient) getRoomData(gname, rname string) (*types.Room, error) {
 		Group:   info["group"],
 		Private: boolstr(info["private"]),
 		Users:   make(map[string]*types.User),
+
+		Topic:       info["topic"],
+		TopicBy:     info["topicby"],
+		TopicTime:   int64str(info["topictime"]),
+		Description: info["description"],
+		Creator:     info["creator"],
+		Created:     int64str(info["created"]),
+		Meta:        make(map[string]string),
+	}
+	for k, v := range info {
+		if strings.HasPrefix(k, "meta-") {
+			room.Meta[strings.TrimPrefix(k, "meta-")] = v
+		}
 	}
 
 	if len(users) > 0 {
@@ -463,7 +622,49 @@ func (r *rClient) getGroupData(gname string) (*types.Group, error) {
 	return group, nil
 }
 
+/* deleteUser deletes a user along with their name reservations, read markers
+ * and mentions. */
 func (r *rClient) deleteUser(user *types.User) error {
+	if err := r.deleteUserKeys(user); err != nil {
+		return errors.Wrap(err, "r.deleteUserKeys")
+	}
+
+	if err := r.releaseUsername(user.Username, user.ID.String()); err != nil {
+		return errors.Wrap(err, "r.releaseUsername")
+	}
+	if err := r.releaseName("loginnames", user.LoginName, user.ID.String()); err != nil {
+		return errors.Wrap(err, "r.releaseName")
+	}
+
+	if err := r.purgeUser(user.ID.String()); err != nil {
+		return errors.Wrap(err, "r.purgeUser")
+	}
+
+	return nil
+}
+
+/* setUserType moves a user to another type, only the keys named after the type
+ * move so the data keyed by ID alone is kept. */
+func (r *rClient) setUserType(user *types.User, userType string) error {
+	if user.Type == userType {
+		return nil
+	}
+
+	old := *user
+	user.Type = userType
+	if err := r.writeUserData(user); err != nil {
+		return errors.Wrap(err, "r.writeUserData")
+	}
+
+	if err := r.deleteUserKeys(&old); err != nil {
+		return errors.Wrap(err, "r.deleteUserKeys")
+	}
+
+	return nil
+}
+
+// deleteUserKeys deletes the keys named after the type of a user.
+func (r *rClient) deleteUserKeys(user *types.User) error {
 	var (
 		del0 *redis.IntCmd
 		del1 *redis.IntCmd
@@ -491,6 +692,356 @@ func (r *rClient) deleteUser(user *types.User) error {
 	return nil
 }
 
+// purgeUser deletes the read markers and mentions of a deleted user.
+func (r *rClient) purgeUser(id string) error {
+	// Find every conversation the user has read or been mentioned in.
+	convs, err := r.readConversations(id)
+	if err != nil {
+		return errors.Wrap(err, "r.readConversations")
+	}
+	ids, err := r.client.ZRange("mentions-"+id, 0, -1).Result()
+	if err != nil {
+		return errors.Wrap(err, "r.client.ZRange")
+	}
+	if len(ids) > 0 {
+		cmds := make([]*redis.StringCmd, len(ids))
+		if _, err = r.client.Pipelined(func(pipe *redis.Pipeline) error {
+			for i, msg := range ids {
+				cmds[i] = pipe.HGet("message-"+msg, "to")
+			}
+			return nil
+		}); err != nil && err != redis.Nil {
+			return errors.Wrap(err, "r.client.Pipelined HGet")
+		}
+		for _, cmd := range cmds {
+			if to := cmd.Val(); strings.HasPrefix(to, "#") {
+				convs = append(convs, to)
+			}
+		}
+	}
+
+	keys := []string{"reads-" + id, "mentions-" + id}
+	for _, conv := range convs {
+		keys = append(keys, "mentions-"+id+"-"+conv)
+	}
+	if err = r.client.Del(keys...).Err(); err != nil {
+		return errors.Wrap(err, "r.client.Del")
+	}
+
+	return nil
+}
+
+func (r *rClient) writeBanData(ban *types.Ban) error {
+	m := map[string]string{
+		"score":     strconv.Itoa(ban.Score),
+		"updated":   strconv.FormatInt(ban.Updated, 10),
+		"expires":   strconv.FormatInt(ban.Expires, 10),
+		"permanent": strbool(ban.Permanent),
+	}
+
+	var cmd *redis.StatusCmd
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		cmd = pipe.HMSet("ban-"+ban.Key, m)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.Pipelined HMSet")
+	}
+
+	if err := cmd.Err(); err != nil {
+		return errors.Wrap(err, "r.client.Pipelined HMSet")
+	}
+
+	return nil
+}
+
+func (r *rClient) getBanData(key string) (*types.Ban, error) {
+	var cmd *redis.StringStringMapCmd
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		cmd = pipe.HGetAll("ban-" + key)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "r.client.Pipelined HGetAll")
+	}
+
+	info, err := cmd.Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "r.client.Pipelined HGetAll")
+	}
+
+	ban := &types.Ban{Key: key}
+	if len(info) == 0 {
+		return ban, nil
+	}
+
+	if ban.Score, err = strconv.Atoi(info["score"]); err != nil {
+		return nil, errors.Wrap(err, "strconv.Atoi")
+	}
+	if ban.Updated, err = strconv.ParseInt(info["updated"], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "strconv.ParseInt")
+	}
+	if ban.Expires, err = strconv.ParseInt(info["expires"], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "strconv.ParseInt")
+	}
+	ban.Permanent = boolstr(info["permanent"])
+
+	return ban, nil
+}
+
+func (r *rClient) listUsers() ([]*types.User, error) {
+	keys, err := r.getKeySet("user-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "r.getKeySet")
+	}
+
+	var users []*types.User
+	for _, k := range keys {
+		// Only the main user keys end in a uuid.
+		if len(k) <= 36 || uuid.Parse(k[len(k)-36:]) == nil {
+			continue
+		}
+
+		u, err := r.getUserData(k[len(k)-36:])
+		if err != nil {
+			return nil, errors.Wrap(err, "r.getUserData")
+		}
+		if u != nil {
+			users = append(users, u)
+		}
+	}
+
+	return users, nil
+}
+
+func (r *rClient) listGroups() ([]string, error) {
+	keys, err := r.getKeySet("group-*-info")
+	if err != nil {
+		return nil, errors.Wrap(err, "r.getKeySet")
+	}
+
+	var groups []string
+	for _, k := range keys {
+		groups = append(groups, strings.TrimSuffix(strings.TrimPrefix(k, "group-"), "-info"))
+	}
+
+	return groups, nil
+}
+
+func (r *rClient) deleteRoom(gname, rname string) error {
+	var (
+		del *redis.IntCmd
+		rem *redis.IntCmd
+	)
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		del = pipe.Del("room-"+gname+"-"+rname+"-info", "room-"+gname+"-"+rname+"-list")
+		rem = pipe.SRem("group-"+gname+"-rooms", rname)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.Pipelined Multi")
+	}
+
+	if err := del.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.Del")
+	}
+	if err := rem.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.SRem")
+	}
+
+	return nil
+}
+
+func (r *rClient) deleteGroup(gname string) error {
+	var del *redis.IntCmd
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		del = pipe.Del("group-"+gname+"-info", "group-"+gname+"-users", "group-"+gname+"-rooms")
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.Pipelined Del")
+	}
+
+	if err := del.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.Del")
+	}
+
+	return nil
+}
+
+// Usernames and login names are unique regardless of case.
+func usernameKey(name string) string {
+	return strings.ToLower(name)
+}
+
+func (r *rClient) reserveUsername(name, id string) (bool, error) {
+	return r.reserveName("usernames", name, id)
+}
+
+func (r *rClient) getUsernameOwner(name string) (string, error) {
+	return r.getNameOwner("usernames", name)
+}
+
+func (r *rClient) releaseUsername(name, id string) error {
+	return r.releaseName("usernames", name, id)
+}
+
+func (r *rClient) getLoginNameOwner(name string) (string, error) {
+	return r.getNameOwner("loginnames", name)
+}
+
+/* reserveUserNames claims the username and login name of a user before it's
+ * written, ErrNameTaken is returned if either belongs to someone else. The
+ * returned function releases the names claimed by this call so a failed write
+ * doesn't keep them. */
+func (r *rClient) reserveUserNames(user *types.User) (func(), error) {
+	var (
+		id      = user.ID.String()
+		claimed [][2]string
+	)
+	release := func() {
+		for _, c := range claimed {
+			if err := r.releaseName(c[0], c[1], id); err != nil {
+				r.log.Error(errors.Wrap(err, "r.releaseName"))
+			}
+		}
+	}
+
+	for _, n := range [][2]string{{"usernames", user.Username}, {"loginnames", user.LoginName}} {
+		if n[1] == "" {
+			continue
+		}
+
+		owner, err := r.getNameOwner(n[0], n[1])
+		if err != nil {
+			release()
+			return nil, errors.Wrap(err, "r.getNameOwner")
+		}
+		if owner == id {
+			continue
+		}
+
+		ok, err := r.reserveName(n[0], n[1], id)
+		if err != nil {
+			release()
+			return nil, errors.Wrap(err, "r.reserveName")
+		}
+		if !ok {
+			release()
+			return nil, ErrNameTaken
+		}
+		claimed = append(claimed, n)
+	}
+
+	return release, nil
+}
+
+// reserveName claims a name in one of the name indexes (such as "usernames").
+func (r *rClient) reserveName(index, name, id string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+
+	ok, err := r.client.HSetNX(index, usernameKey(name), id).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "r.client.HSetNX")
+	}
+	if ok {
+		return true, nil
+	}
+
+	owner, err := r.getNameOwner(index, name)
+	if err != nil {
+		return false, errors.Wrap(err, "r.getNameOwner")
+	}
+
+	return owner == id, nil
+}
+
+func (r *rClient) getNameOwner(index, name string) (string, error) {
+	owner, err := r.client.HGet(index, usernameKey(name)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "r.client.HGet")
+	}
+
+	return owner, nil
+}
+
+func (r *rClient) releaseName(index, name, id string) error {
+	owner, err := r.getNameOwner(index, name)
+	if err != nil {
+		return errors.Wrap(err, "r.getNameOwner")
+	}
+
+	// Never release a name that was reserved by someone else.
+	if owner != id {
+		return nil
+	}
+
+	if err := r.client.HDel(index, usernameKey(name)).Err(); err != nil {
+		return errors.Wrap(err, "r.client.HDel")
+	}
+
+	return nil
+}
+
+func (r *rClient) nextGuestNumber() (int64, error) {
+	n, err := r.client.Incr("guest-counter").Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "r.client.Incr")
+	}
+
+	return n, nil
+}
+
+// writeToken stores a token, the previous token of its kind for the user is
+// deleted so only the latest one can be redeemed.
+func (r *rClient) writeToken(kind, token, id string, expire time.Duration) error {
+	prev, err := r.client.GetSet("tokens-"+kind+"-"+id, token).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "r.client.GetSet")
+	}
+
+	var set *redis.StatusCmd
+	if _, err = r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		set = pipe.Set("token-"+kind+"-"+token, id, expire)
+		if expire > 0 {
+			pipe.Expire("tokens-"+kind+"-"+id, expire)
+		}
+		if prev != "" {
+			pipe.Del("token-" + kind + "-" + prev)
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	if err = set.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.Set")
+	}
+
+	return nil
+}
+
+func (r *rClient) getToken(kind, token string) (string, error) {
+	id, err := r.client.Get("token-" + kind + "-" + token).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "r.client.Get")
+	}
+
+	return id, nil
+}
+
+func (r *rClient) deleteToken(kind, token string) error {
+	if err := r.client.Del("token-" + kind + "-" + token).Err(); err != nil {
+		return errors.Wrap(err, "r.client.Del")
+	}
+
+	return nil
+}
+
 // Client returns the underlyins *redis.Client for testing purposes.
 func (r *rClient) Client() *redis.Client {
 	return r.client
@@ -508,3 +1059,667 @@ func GenRedisProto(cmd []string) string {
 
 	return ret
 }
+
+func (r *rClient) queueMessage(id string, msg *types.Message, limit int, expire time.Duration) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+
+	var (
+		push *redis.IntCmd
+		trim *redis.StatusCmd
+	)
+	if _, err = r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		push = pipe.RPush("queue-"+id, string(data))
+		// Keep only the oldest messages, the new one is refused when full.
+		trim = pipe.LTrim("queue-"+id, 0, int64(limit-1))
+		if expire > 0 {
+			pipe.Expire("queue-"+id, expire)
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	if err = push.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.RPush")
+	}
+	if err = trim.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.LTrim")
+	}
+	if push.Val() > int64(limit) {
+		return ErrQueueFull
+	}
+
+	return nil
+}
+
+func (r *rClient) popQueuedMessages(id string) ([]*types.Message, error) {
+	var lrange *redis.StringSliceCmd
+	if _, err := r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		lrange = pipe.LRange("queue-"+id, 0, -1)
+		pipe.Del("queue-" + id)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	list, err := lrange.Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "r.pipe.LRange")
+	}
+
+	var msgs []*types.Message
+	for _, l := range list {
+		msg := new(types.Message)
+		if err = json.Unmarshal([]byte(l), msg); err != nil {
+			r.log.Error(errors.Wrap(err, "json.Unmarshal"))
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func messageMap(msg *types.Message) map[string]string {
+	return map[string]string{
+		"id":           msg.ID,
+		"to":           msg.To,
+		"from":         msg.From,
+		"body":         msg.Body,
+		"content_type": msg.ContentType,
+		"time":         strconv.FormatInt(msg.Time, 10),
+		"edited":       strconv.FormatInt(msg.Edited, 10),
+		"deleted":      strbool(msg.Deleted),
+		"parent":       msg.Parent,
+		"mentions":     strings.Join(msg.Mentions, " "),
+		"attachments":  strings.Join(msg.Attachments, " "),
+	}
+}
+
+func mapMessage(info map[string]string) *types.Message {
+	if len(info) == 0 {
+		return nil
+	}
+
+	// Messages stored before content types were added are plain.
+	contentType := info["content_type"]
+	if contentType == "" {
+		contentType = types.ContentPlain
+	}
+
+	return &types.Message{
+		Action:      "msg",
+		ID:          info["id"],
+		To:          info["to"],
+		From:        info["from"],
+		Body:        info["body"],
+		ContentType: contentType,
+		Time:        int64str(info["time"]),
+		Edited:      int64str(info["edited"]),
+		Deleted:     boolstr(info["deleted"]),
+		Parent:      info["parent"],
+		Mentions:    strings.Fields(info["mentions"]),
+		Attachments: strings.Fields(info["attachments"]),
+		Replies:     int(int64str(info["replies"])),
+		LastReply:   int64str(info["last_reply"]),
+	}
+}
+
+func (r *rClient) storeMessage(msg *types.Message, expire time.Duration, overflow int) error {
+	var (
+		conv  = types.Conversation(msg.To, msg.From)
+		key   = "messages-" + conv
+		now   = time.Now().UnixNano() / int64(time.Microsecond)
+		hmset *redis.StatusCmd
+		zadd  *redis.IntCmd
+	)
+	if _, err := r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		hmset = pipe.HMSet("message-"+msg.ID, messageMap(msg))
+		if expire > 0 {
+			pipe.Expire("message-"+msg.ID, expire)
+		}
+		zadd = pipe.ZAdd(key, redis.Z{Score: float64(now), Member: msg.ID})
+		if msg.Parent != "" {
+			// Replies are also kept in their thread and counted on the parent.
+			pipe.ZAdd("thread-"+msg.Parent, redis.Z{Score: float64(now), Member: msg.ID})
+			if expire > 0 {
+				pipe.Expire("thread-"+msg.Parent, expire)
+			}
+			pipe.HIncrBy("message-"+msg.Parent, "replies", 1)
+			pipe.HSet("message-"+msg.Parent, "last_reply", strconv.FormatInt(msg.Time, 10))
+		}
+		for _, id := range msg.Mentions {
+			pipe.ZAdd("mentions-"+id, redis.Z{Score: float64(now), Member: msg.ID})
+			pipe.ZAdd("mentions-"+id+"-"+conv, redis.Z{Score: float64(now), Member: msg.ID})
+			if expire > 0 {
+				pipe.Expire("mentions-"+id, expire)
+				pipe.Expire("mentions-"+id+"-"+conv, expire)
+			}
+		}
+		// Senders have read what they reply to, direct message recipients
+		// get a marker so the conversation shows up as unread.
+		pipe.HSet("reads-"+msg.From, conv, strconv.FormatInt(now, 10))
+		if !strings.HasPrefix(msg.To, "#") {
+			pipe.HSetNX("reads-"+msg.To, conv, "0")
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	if err := hmset.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.HMSet")
+	}
+	if err := zadd.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.ZAdd")
+	}
+
+	// Expired messages are gone already, drop them from the conversation.
+	if expire > 0 {
+		cutoff := now - int64(expire/time.Microsecond)
+		if err := r.client.ZRemRangeByScore(key, "-inf", "("+strconv.FormatInt(cutoff, 10)).Err(); err != nil {
+			return errors.Wrap(err, "r.client.ZRemRangeByScore")
+		}
+	}
+
+	if overflow <= 0 {
+		return nil
+	}
+
+	count, err := r.client.ZCard(key).Result()
+	if err != nil {
+		return errors.Wrap(err, "r.client.ZCard")
+	}
+	if count <= int64(overflow) {
+		return nil
+	}
+
+	// Delete the oldest messages over the limit.
+	old, err := r.client.ZRange(key, 0, count-int64(overflow)-1).Result()
+	if err != nil {
+		return errors.Wrap(err, "r.client.ZRange")
+	}
+
+	var keys []string
+	for _, id := range old {
+		keys = append(keys, "message-"+id, "reactions-"+id, "thread-"+id)
+	}
+
+	reactions, err := r.getReactions(old)
+	if err != nil {
+		return errors.Wrap(err, "r.getReactions")
+	}
+	for i, id := range old {
+		for emoji := range reactions[i] {
+			keys = append(keys, "reactions-"+id+"-"+emoji)
+		}
+	}
+
+	if _, err = r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.Del(keys...)
+		pipe.ZRemRangeByRank(key, 0, count-int64(overflow)-1)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	return nil
+}
+
+func (r *rClient) getMessage(id string) (*types.Message, error) {
+	info, err := r.client.HGetAll("message-" + id).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "r.client.HGetAll")
+	}
+
+	return mapMessage(info), nil
+}
+
+/* updateMessage writes the body of an edited message, deleted messages are
+ * also taken out of the mentions of everyone they mentioned. */
+func (r *rClient) updateMessage(msg *types.Message) error {
+	var mentioned []string
+	if msg.Deleted {
+		old, err := r.client.HGet("message-"+msg.ID, "mentions").Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrap(err, "r.client.HGet")
+		}
+		mentioned = strings.Fields(old)
+	}
+
+	var (
+		conv  = types.Conversation(msg.To, msg.From)
+		hmset *redis.StatusCmd
+	)
+	if _, err := r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		hmset = pipe.HMSet("message-"+msg.ID, map[string]string{
+			"body":        msg.Body,
+			"edited":      strconv.FormatInt(msg.Edited, 10),
+			"deleted":     strbool(msg.Deleted),
+			"mentions":    strings.Join(msg.Mentions, " "),
+			"attachments": strings.Join(msg.Attachments, " "),
+		})
+		for _, id := range mentioned {
+			pipe.ZRem("mentions-"+id, msg.ID)
+			pipe.ZRem("mentions-"+id+"-"+conv, msg.ID)
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	if err := hmset.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.HMSet")
+	}
+
+	return nil
+}
+
+func (r *rClient) getMessages(conv, before string, limit int) ([]*types.Message, bool, error) {
+	return r.pageMessages("messages-"+conv, before, limit)
+}
+
+func (r *rClient) getThread(parent, before string, limit int) ([]*types.Message, bool, error) {
+	return r.pageMessages("thread-"+parent, before, limit)
+}
+
+func (r *rClient) getMentions(user, before string, limit int) ([]*types.Message, bool, error) {
+	return r.pageMessages("mentions-"+user, before, limit)
+}
+
+// pageMessages returns a page of messages from a sorted set of message IDs.
+func (r *rClient) pageMessages(key, before string, limit int) ([]*types.Message, bool, error) {
+	max := "+inf"
+	if before != "" {
+		score, err := r.client.ZScore(key, before).Result()
+		if err == redis.Nil {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, errors.Wrap(err, "r.client.ZScore")
+		}
+		max = "(" + strconv.FormatFloat(score, 'f', 0, 64)
+	}
+
+	// Ask for one extra to know if there are more.
+	ids, err := r.client.ZRevRangeByScore(key, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   max,
+		Count: int64(limit + 1),
+	}).Result()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "r.client.ZRevRangeByScore")
+	}
+
+	more := len(ids) > limit
+	if more {
+		ids = ids[:limit]
+	}
+	// Empty pipelines are an error.
+	if len(ids) == 0 {
+		return nil, false, nil
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	if _, err = r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll("message-" + id)
+		}
+		return nil
+	}); err != nil {
+		return nil, false, errors.Wrap(err, "r.client.Pipelined HGetAll")
+	}
+
+	reactions, err := r.getReactions(ids)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "r.getReactions")
+	}
+
+	// Return the oldest message first.
+	var msgs []*types.Message
+	for i := len(cmds) - 1; i >= 0; i-- {
+		info, err := cmds[i].Result()
+		if err != nil {
+			return nil, false, errors.Wrap(err, "r.pipe.HGetAll")
+		}
+		if msg := mapMessage(info); msg != nil {
+			if len(reactions[i]) > 0 {
+				msg.Reactions = reactions[i]
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs, more, nil
+}
+
+func (r *rClient) addReaction(id, emoji, user string, expire time.Duration) (int, error) {
+	var (
+		key  = "reactions-" + id + "-" + emoji
+		card *redis.IntCmd
+	)
+	if _, err := r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.SAdd("reactions-"+id, emoji)
+		pipe.SAdd(key, user)
+		card = pipe.SCard(key)
+		if expire > 0 {
+			pipe.Expire("reactions-"+id, expire)
+			pipe.Expire(key, expire)
+		}
+		return nil
+	}); err != nil {
+		return 0, errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	count, err := card.Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "r.pipe.SCard")
+	}
+
+	return int(count), nil
+}
+
+func (r *rClient) removeReaction(id, emoji, user string) (int, error) {
+	key := "reactions-" + id + "-" + emoji
+	if err := r.client.SRem(key, user).Err(); err != nil {
+		return 0, errors.Wrap(err, "r.client.SRem")
+	}
+
+	count, err := r.client.SCard(key).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "r.client.SCard")
+	}
+
+	// Drop emoji nobody uses anymore from the message.
+	if count == 0 {
+		if err = r.client.SRem("reactions-"+id, emoji).Err(); err != nil {
+			return 0, errors.Wrap(err, "r.client.SRem")
+		}
+	}
+
+	return int(count), nil
+}
+
+func (r *rClient) getReactions(ids []string) ([]map[string]int, error) {
+	ret := make([]map[string]int, len(ids))
+	for i := range ids {
+		ret[i] = make(map[string]int)
+	}
+	if len(ids) == 0 {
+		return ret, nil
+	}
+
+	emojiCmds := make([]*redis.StringSliceCmd, len(ids))
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, id := range ids {
+			emojiCmds[i] = pipe.SMembers("reactions-" + id)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "r.client.Pipelined SMembers")
+	}
+
+	var (
+		emoji = make([][]string, len(ids))
+		total = 0
+	)
+	for i, cmd := range emojiCmds {
+		list, err := cmd.Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "r.pipe.SMembers")
+		}
+		emoji[i] = list
+		total += len(list)
+	}
+	if total == 0 {
+		return ret, nil
+	}
+
+	countCmds := make([][]*redis.IntCmd, len(ids))
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, id := range ids {
+			for _, e := range emoji[i] {
+				countCmds[i] = append(countCmds[i], pipe.SCard("reactions-"+id+"-"+e))
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "r.client.Pipelined SCard")
+	}
+
+	for i := range ids {
+		for j, cmd := range countCmds[i] {
+			count, err := cmd.Result()
+			if err != nil {
+				return nil, errors.Wrap(err, "r.pipe.SCard")
+			}
+			if count > 0 {
+				ret[i][emoji[i][j]] = int(count)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func (r *rClient) setReadMarker(user, conv, id string) (bool, error) {
+	score := time.Now().UnixNano() / int64(time.Microsecond)
+	if id != "" {
+		f, err := r.client.ZScore("messages-"+conv, id).Result()
+		if err == redis.Nil {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "r.client.ZScore")
+		}
+		score = int64(f)
+	}
+
+	current, err := r.client.HGet("reads-"+user, conv).Result()
+	if err != nil && err != redis.Nil {
+		return false, errors.Wrap(err, "r.client.HGet")
+	}
+	if int64str(current) >= score {
+		return true, nil
+	}
+
+	if err = r.client.HSet("reads-"+user, conv, strconv.FormatInt(score, 10)).Err(); err != nil {
+		return false, errors.Wrap(err, "r.client.HSet")
+	}
+
+	return true, nil
+}
+
+func (r *rClient) readConversations(user string) ([]string, error) {
+	convs, err := r.client.HKeys("reads-" + user).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "r.client.HKeys")
+	}
+
+	return convs, nil
+}
+
+func (r *rClient) getUnread(user string, convs []string) ([]*types.Unread, error) {
+	if len(convs) == 0 {
+		return nil, nil
+	}
+
+	markers := make([]*redis.StringCmd, len(convs))
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, conv := range convs {
+			markers[i] = pipe.HGet("reads-"+user, conv)
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "r.client.Pipelined HGet")
+	}
+
+	var (
+		unread   = make([]*redis.IntCmd, len(convs))
+		mentions = make([]*redis.IntCmd, len(convs))
+	)
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, conv := range convs {
+			// Without a marker every stored message is unread.
+			min := "(" + strconv.FormatInt(int64str(markers[i].Val()), 10)
+			unread[i] = pipe.ZCount("messages-"+conv, min, "+inf")
+			mentions[i] = pipe.ZCount("mentions-"+user+"-"+conv, min, "+inf")
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "r.client.Pipelined ZCount")
+	}
+
+	ret := make([]*types.Unread, len(convs))
+	for i, conv := range convs {
+		u, err := unread[i].Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "r.pipe.ZCount")
+		}
+		m, err := mentions[i].Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "r.pipe.ZCount")
+		}
+		ret[i] = &types.Unread{To: conv, Unread: int(u), Mentions: int(m)}
+	}
+
+	return ret, nil
+}
+
+/* writeAttachment stores an attachment, the message it was sent with is only
+ * written by claimAttachments. */
+func (r *rClient) writeAttachment(att *types.Attachment) error {
+	var hmset *redis.StatusCmd
+	if _, err := r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		hmset = pipe.HMSet("attachment-"+att.ID, map[string]string{
+			"id":           att.ID,
+			"name":         att.Name,
+			"size":         strconv.FormatInt(att.Size, 10),
+			"content_type": att.ContentType,
+			"to":           att.To,
+			"from":         att.From,
+			"time":         strconv.FormatInt(att.Time, 10),
+			"complete":     strbool(att.Complete),
+		})
+		if att.MessageID == "" {
+			pipe.ZAdd("attachments-unused", redis.Z{Score: float64(att.Time), Member: att.ID})
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	if err := hmset.Err(); err != nil {
+		return errors.Wrap(err, "r.pipe.HMSet")
+	}
+
+	return nil
+}
+
+func (r *rClient) getAttachment(id string) (*types.Attachment, error) {
+	info, err := r.client.HGetAll("attachment-" + id).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "r.client.HGetAll")
+	}
+	if len(info) == 0 {
+		return nil, nil
+	}
+
+	return &types.Attachment{
+		ID:          info["id"],
+		Name:        info["name"],
+		Size:        int64str(info["size"]),
+		ContentType: info["content_type"],
+		To:          info["to"],
+		From:        info["from"],
+		Time:        int64str(info["time"]),
+		Complete:    boolstr(info["complete"]),
+		MessageID:   info["message"],
+	}, nil
+}
+
+func (r *rClient) deleteAttachment(id string) error {
+	if _, err := r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.Del("attachment-" + id)
+		pipe.ZRem("attachments-unused", id)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "r.client.TxPipelined")
+	}
+
+	return nil
+}
+
+func (r *rClient) claimAttachments(ids []string, msgID string) error {
+	var claimed []string
+	release := func() {
+		if err := r.releaseAttachments(claimed, msgID); err != nil {
+			r.log.Error(errors.Wrap(err, "r.releaseAttachments"))
+		}
+	}
+
+	for _, id := range ids {
+		ok, err := r.client.HSetNX("attachment-"+id, "message", msgID).Result()
+		if err != nil {
+			release()
+			return errors.Wrap(err, "r.client.HSetNX")
+		}
+		if !ok {
+			release()
+			return ErrAttachmentUsed
+		}
+		claimed = append(claimed, id)
+	}
+
+	if len(claimed) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(claimed))
+	for i, id := range claimed {
+		members[i] = id
+	}
+	if err := r.client.ZRem("attachments-unused", members...).Err(); err != nil {
+		return errors.Wrap(err, "r.client.ZRem")
+	}
+
+	return nil
+}
+
+func (r *rClient) releaseAttachments(ids []string, msgID string) error {
+	for _, id := range ids {
+		info, err := r.client.HMGet("attachment-"+id, "message", "time").Result()
+		if err != nil {
+			return errors.Wrap(err, "r.client.HMGet")
+		}
+		// Leave attachments claimed by another message alone.
+		if owner, _ := info[0].(string); owner != msgID {
+			continue
+		}
+		uploaded, _ := info[1].(string)
+
+		if _, err = r.client.TxPipelined(func(pipe *redis.Pipeline) error {
+			pipe.HDel("attachment-"+id, "message")
+			pipe.ZAdd("attachments-unused", redis.Z{Score: float64(int64str(uploaded)), Member: id})
+			return nil
+		}); err != nil {
+			return errors.Wrap(err, "r.client.TxPipelined")
+		}
+	}
+
+	return nil
+}
+
+func (r *rClient) getUnusedAttachments(before int64) ([]string, error) {
+	ids, err := r.client.ZRangeByScore("attachments-unused", redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(before, 10),
+	}).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "r.client.ZRangeByScore")
+	}
+
+	return ids, nil
+}
@@ -39,6 +39,7 @@ var _ = BeforeSuite(func() {
 		panic(err)
 	}
 	config := settings.GetConfig()
+	config.MessageStore = true
 
 	reconnect := false
 	f.client, err = db.NewDB(config, log)
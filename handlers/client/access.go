@@ -0,0 +1,89 @@
+package client
+
+import (
+	"strings"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+/* roomAccess looks up a room (formatted as "group/room") the client wants to
+ * send to, checking group membership, guest restrictions and private rooms.
+ * If the room can't be used an error is sent to the client and a nil room is
+ * returned along with any ban-score for the attempt. */
+func (h *handler) roomAccess(client *request, name string) (room *types.Room, banScore int, err error) {
+	if !strings.Contains(name, "/") {
+		if err = client.Error(types.BadRequestOrObject, "room names should be type of 'group/room'"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+	slice := strings.Split(name, "/")
+	group, err := h.groupHandler.GetGroup(slice[0])
+	if err != nil {
+		err = errors.Wrap(err, "GetGroup")
+		return
+	}
+
+	if group == nil {
+		if err = client.Error(types.NotFound, "group does not exist"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	// Block guest connections from messaging outside of group #default.
+	if client.User.Type == "guest" && group.Title != "#default" {
+		if err = client.Error(types.Forbidden, "guest account, please authenticate"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	// Block messages from outside a group.
+	var member = false
+	for _, g := range client.User.Groups {
+		if group.Title == g {
+			member = true
+		}
+	}
+
+	if !member {
+		banScore = 1
+		if err = client.Error(types.Forbidden, ""); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	found, err := h.groupHandler.GetRoom(slice[0], slice[1])
+	if err != nil {
+		err = errors.Wrap(err, "GetRoom")
+		return
+	}
+	if found == nil {
+		if err = client.Error(types.NotFound, ""); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	// Block external messages on private rooms.
+	member = false
+	for k := range found.Users {
+		if client.User.ID.String() == k {
+			member = true
+		}
+	}
+
+	if found.Private && !member {
+		banScore = 1
+		if err = client.Error(types.Forbidden, ""); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	return found, banScore, nil
+}
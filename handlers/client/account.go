@@ -0,0 +1,282 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	verifyToken = "verify"
+	resetToken  = "reset"
+
+	minPasswordLength = 8
+
+	// Reset mails are sent at most once per resetAccountInterval per account.
+	resetAccountInterval = 5 * time.Minute
+	// Addresses may request a reset mail once per resetAddressInterval.
+	resetAddressInterval = time.Minute
+)
+
+var (
+	// ErrShortPassword is returned when a new password is under minPasswordLength.
+	ErrShortPassword = errors.Errorf("passwords must be at least %d characters", minPasswordLength)
+
+	// ErrTooManyAttempts is returned when an address is banned for guessing tokens.
+	ErrTooManyAttempts = errors.New("too many failed attempts")
+)
+
+/* loadUser returns a user by ID, preferring the copy held by a connected
+ * client so changes aren't overwritten when that client writes its user. */
+func (h *handler) loadUser(id string) (*types.User, error) {
+	if c, ok := h.clients[id]; ok && c.User != nil {
+		return c.User, nil
+	}
+
+	user, err := h.dbClient.GetUserData(id)
+	if err != nil && err != types.NotInDB {
+		return nil, errors.Wrap(err, "dbClient.GetUserData")
+	}
+
+	return user, nil
+}
+
+func (h *handler) tokenExpire() time.Duration {
+	return time.Duration(h.config.TokenExpire) * time.Hour
+}
+
+// sendVerification mails a verification token to the clients email address.
+func (h *handler) sendVerification(client *request) (banScore int, err error) {
+	switch {
+	case !client.Authorized || client.User.Type == guest:
+		if err = client.Error(types.NotAuthorized, ""); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case client.User.Email == "":
+		if err = client.Error(types.BadRequestOrObject, "no email address set"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case client.User.Verified:
+		if err = client.Error(types.Conflict, "email address already verified"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case h.config.Mailer == "":
+		if err = client.Error(types.ServerError, "mail is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	token := types.NewToken()
+	if err = h.dbClient.WriteToken(verifyToken, token, client.User.ID.String(), h.tokenExpire()); err != nil {
+		err = errors.Wrap(err, "dbClient.WriteToken")
+		return
+	}
+
+	body := fmt.Sprintf("Hello %s,\r\n\r\nUse the following token to verify your email address:\r\n\r\n%s\r\n\r\nor visit %s/verify/%s\r\n",
+		client.User.Username, token, h.config.PublicURL, token)
+	if err = h.mailer.Send(client.User.Email, "Verify your email address", body); err != nil {
+		err = errors.Wrap(err, "mailer.Send")
+		if err2 := client.Error(types.ServerError, "unable to send mail"); err2 != nil {
+			h.clientLog(client).Error(errors.Wrap(err2, "client.Error"))
+		}
+		return
+	}
+
+	if err = client.Alert(types.Accepted, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
+
+// VerifyEmail redeems a verification token, returning false if the token is
+// invalid or expired.
+func (h *handler) VerifyEmail(token string) (bool, error) {
+	id, err := h.dbClient.GetToken(verifyToken, token)
+	if err != nil {
+		return false, errors.Wrap(err, "dbClient.GetToken")
+	}
+	if id == "" {
+		return false, nil
+	}
+
+	user, err := h.loadUser(id)
+	if err != nil {
+		return false, errors.Wrap(err, "loadUser")
+	}
+	if user == nil {
+		return false, nil
+	}
+
+	user.Verified = true
+	if err = h.dbClient.WriteUserData(user); err != nil {
+		return false, errors.Wrap(err, "dbClient.WriteUserData")
+	}
+
+	if err = h.dbClient.DeleteToken(verifyToken, token); err != nil {
+		return false, errors.Wrap(err, "dbClient.DeleteToken")
+	}
+
+	h.log.Infof("%s %s verified their email address", user.Type, user.ID.String())
+	return true, nil
+}
+
+/* sendPasswordReset mails a reset token to the owner of an account. The same
+ * response is sent whether or not the account exists so it can't be used to
+ * look up accounts, the mail is sent in the background so the timing doesn't
+ * tell either. Addresses requesting resets too often are refused with a
+ * ban-score and accounts get at most one mail per resetAccountInterval. */
+func (h *handler) sendPasswordReset(client *request, accountName string) (banScore int, err error) {
+	switch {
+	case h.config.Mailer == "":
+		if err = client.Error(types.ServerError, "mail is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case !h.resetAddresses.allow(client.IP):
+		banScore = 1
+		if err = client.Error(types.TooManyRequests, "password resets are limited to one a minute"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if h.resetAccounts.allow(strings.ToLower(accountName)) {
+		go h.mailPasswordReset(accountName)
+	}
+
+	if err = client.Alert(types.Accepted, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
+
+// mailPasswordReset mails a reset token to the owner of an account, if any.
+func (h *handler) mailPasswordReset(accountName string) {
+	user, err := h.dbClient.GetUserByLoginName(accountName)
+	if err != nil {
+		h.log.Error(errors.Wrap(err, "dbClient.GetUserByLoginName"))
+		return
+	}
+	if user == nil || user.Type == guest || user.Email == "" {
+		return
+	}
+
+	token := types.NewToken()
+	if err = h.dbClient.WriteToken(resetToken, token, user.ID.String(), h.tokenExpire()); err != nil {
+		h.log.Error(errors.Wrap(err, "dbClient.WriteToken"))
+		return
+	}
+
+	body := fmt.Sprintf("Hello %s,\r\n\r\nA password reset was requested for your account, use the following token to set a new password:\r\n\r\n%s\r\n\r\nIf you didn't request this you can ignore this message.\r\n",
+		user.Username, token)
+	if err = h.mailer.Send(user.Email, "Reset your password", body); err != nil {
+		h.log.Error(errors.Wrap(err, "mailer.Send"))
+	}
+}
+
+/* ResetPassword redeems a reset token sent from an IP address. Failed attempts
+ * add to the ban-score of the address, banned addresses are refused with
+ * ErrTooManyAttempts. */
+func (h *handler) ResetPassword(ip, token, password string) (bool, error) {
+	keys := []string{"ip-" + ip}
+	ban, err := h.checkBan(keys...)
+	if err != nil {
+		return false, errors.Wrap(err, "checkBan")
+	}
+	if ban != nil {
+		return false, ErrTooManyAttempts
+	}
+
+	ok, err := h.resetPassword(token, password)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	if _, _, _, err = h.applyBanScore(keys, 1); err != nil {
+		return false, errors.Wrap(err, "applyBanScore")
+	}
+
+	return false, nil
+}
+
+// resetPassword redeems a reset token setting a new password, returning false
+// if the token is invalid or expired.
+func (h *handler) resetPassword(token, password string) (bool, error) {
+	if len(password) < minPasswordLength {
+		return false, ErrShortPassword
+	}
+
+	id, err := h.dbClient.GetToken(resetToken, token)
+	if err != nil {
+		return false, errors.Wrap(err, "dbClient.GetToken")
+	}
+	if id == "" {
+		return false, nil
+	}
+
+	user, err := h.loadUser(id)
+	if err != nil {
+		return false, errors.Wrap(err, "loadUser")
+	}
+	if user == nil {
+		return false, nil
+	}
+
+	user.SetPassword(password)
+	if err = h.dbClient.WriteUserData(user); err != nil {
+		return false, errors.Wrap(err, "dbClient.WriteUserData")
+	}
+
+	if err = h.dbClient.DeleteToken(resetToken, token); err != nil {
+		return false, errors.Wrap(err, "dbClient.DeleteToken")
+	}
+
+	h.log.Infof("%s %s reset their password", user.Type, user.ID.String())
+	return true, nil
+}
+
+// redeemToken handles the "verify" (with a token) and "reset" actions.
+func (h *handler) redeemToken(client *request, kind, token, password string) (banScore int, err error) {
+	var ok bool
+	switch kind {
+	case verifyToken:
+		ok, err = h.VerifyEmail(token)
+	case resetToken:
+		ok, err = h.resetPassword(token, password)
+	}
+
+	if err == ErrShortPassword {
+		if err = client.Error(types.BadRequestOrObject, ErrShortPassword.Error()); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if !ok {
+		// Guessing tokens counts against the client.
+		banScore = 1
+		if err = client.Error(types.NotFound, "invalid or expired token"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Ban-scores applied when a client closes the connection uncleanly.
+	protocolBanScore = 1
+	policyBanScore   = 5
+)
+
+// remoteIP returns the IP address (without port) of a remote address.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// banKeys returns the keys that ban-scores are tracked under for a client;
+// the IP address always applies and registered users also have their own.
+func (*handler) banKeys(client *types.Client) []string {
+	var keys []string
+	if client.IP != "" {
+		keys = append(keys, "ip-"+client.IP)
+	}
+	if client.User != nil && client.User.Type != guest {
+		keys = append(keys, "user-"+client.User.ID.String())
+	}
+
+	return keys
+}
+
+// getBan loads the ban data for a given key and applies any decay due since
+// it was last updated.
+func (h *handler) getBan(key string, now int64) (*types.Ban, error) {
+	ban, err := h.dbClient.GetBanData(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "dbClient.GetBanData")
+	}
+
+	if h.config.BanDecay > 0 && ban.Score > 0 {
+		/* Only whole hours are consumed so frequent offenses can't keep
+		 * resetting the decay period. */
+		hours := (now - ban.Updated) / int64(time.Hour/time.Second)
+		if hours > 0 {
+			ban.Score -= int(hours) * h.config.BanDecay
+			ban.Updated += hours * int64(time.Hour/time.Second)
+			if ban.Score < 0 {
+				ban.Score = 0
+			}
+		}
+	}
+
+	return ban, nil
+}
+
+// checkBan returns the first ban in effect for the given keys or nil.
+func (h *handler) checkBan(keys ...string) (*types.Ban, error) {
+	now := time.Now().Unix()
+	for _, k := range keys {
+		ban, err := h.getBan(k, now)
+		if err != nil {
+			return nil, errors.Wrap(err, "getBan")
+		}
+
+		if ban.Banned(now) {
+			return ban, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// refuseBanned sends a client the Banned error along with when the ban ends.
+func (*handler) refuseBanned(client *types.Client, ban *types.Ban) error {
+	msg := "permanently banned"
+	if !ban.Permanent {
+		msg = fmt.Sprintf("banned until %s", time.Unix(ban.Expires, 0).UTC().Format(time.RFC3339))
+	}
+
+	if err := client.Error(types.Banned, msg); err != nil {
+		return errors.Wrap(err, "client.Error")
+	}
+
+	return nil
+}
+
+/* addBanScore applies a ban-score to the client's IP address and user, warns
+ * or bans the client as thresholds are crossed and returns whether the client
+ * should be disconnected. */
+func (h *handler) addBanScore(client *request, score int) (bool, error) {
+	if score <= 0 {
+		return false, nil
+	}
+
+	banned, warn, top, err := h.applyBanScore(h.banKeys(client.Client), score)
+	if err != nil {
+		return false, errors.Wrap(err, "applyBanScore")
+	}
+	if top > client.BanScore {
+		client.BanScore = top
+	}
+
+	if banned != nil {
+		h.clientLog(client).Infof("%s %s banned with a ban-score of %d", client.User.Type, client.User.ID.String(), banned.Score)
+		return true, h.refuseBanned(client.Client, banned)
+	}
+
+	if warn {
+		if err := client.Alert(types.ImportantNotice, "ban-score warning: further violations will result in a ban"); err != nil {
+			return false, errors.Wrap(err, "client.Alert")
+		}
+	}
+
+	return false, nil
+}
+
+/* applyBanScore adds a ban-score to each of the given keys, returning the first
+ * ban now in effect, whether a warning threshold was crossed and the highest
+ * score reached. */
+func (h *handler) applyBanScore(keys []string, score int) (banned *types.Ban, warn bool, top int, err error) {
+	now := time.Now().Unix()
+	for _, k := range keys {
+		var ban *types.Ban
+		if ban, err = h.getBan(k, now); err != nil {
+			err = errors.Wrap(err, "getBan")
+			return
+		}
+
+		if ban.Score == 0 {
+			ban.Updated = now
+		}
+		prev := ban.Score
+		ban.Score += score
+
+		switch {
+		case h.config.BanPermScore > 0 && ban.Score >= h.config.BanPermScore:
+			ban.Permanent = true
+		case h.config.BanTempScore > 0 && ban.Score >= h.config.BanTempScore:
+			expires := now + int64(h.config.BanTempDuration)*int64(time.Minute/time.Second)
+			if expires > ban.Expires {
+				ban.Expires = expires
+			}
+		case h.config.BanWarnScore > 0 && ban.Score >= h.config.BanWarnScore && prev < h.config.BanWarnScore:
+			warn = true
+		}
+
+		if err = h.dbClient.WriteBanData(ban); err != nil {
+			err = errors.Wrap(err, "dbClient.WriteBanData")
+			return
+		}
+
+		if ban.Score > top {
+			top = ban.Score
+		}
+
+		if banned == nil && ban.Banned(now) {
+			banned = ban
+		}
+	}
+
+	return
+}
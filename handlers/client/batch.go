@@ -0,0 +1,124 @@
+package client
+
+import (
+	"time"
+
+	"tiberious/codec"
+	"tiberious/types"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// maxBatchSize limits the objects a client may batch in a single frame.
+const maxBatchSize = 32
+
+/* decodeFrame reads the objects of a frame, the frame is nil if an error was
+ * sent to the client instead. */
+func (h *handler) decodeFrame(client *types.Client, rawmsg []byte) (frame *types.Frame, banScore int, err error) {
+	frame = new(types.Frame)
+	if err = client.Codec.Unmarshal(rawmsg, frame); err != nil {
+		msg := types.ErrInvalidObject.Error()
+		// Invalid UTF-8 would silently be replaced while decoding.
+		if err == codec.ErrInvalidUTF8 {
+			banScore = 1
+			msg = "messages should be valid UTF-8"
+		}
+		if err = client.Error(types.BadRequestOrObject, msg); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return nil, banScore, err
+	}
+
+	switch {
+	case frame.Batch && len(frame.Envelopes) == 0:
+		if err = client.Error(types.BadRequestOrObject, "empty batch"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return nil, banScore, err
+	case len(frame.Envelopes) > maxBatchSize:
+		banScore = 1
+		if err = client.Error(types.BadRequestOrObject, "batches are limited to 32 objects"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return nil, banScore, err
+	}
+	for _, env := range frame.Envelopes {
+		if env == nil {
+			if err = client.Error(types.BadRequestOrObject, types.ErrInvalidObject.Error()); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return nil, banScore, err
+		}
+	}
+
+	return frame, banScore, nil
+}
+
+/* handleFrame handles every object of a frame in order and returns a quit
+ * reason once the client should be disconnected. The replies to the objects of
+ * a batch are returned in a single array. */
+func (h *handler) handleFrame(client *types.Client, rawmsg []byte) (quitReason string) {
+	// Errors about the frame itself don't belong to any of its objects.
+	req := &request{Client: client}
+	frame, score, err := h.decodeFrame(client, rawmsg)
+	if err != nil {
+		h.clientLog(req).Error(errors.Wrap(err, "decodeFrame"))
+	}
+	if frame == nil {
+		return h.penalize(req, score)
+	}
+
+	if frame.Batch {
+		client.StartBatch()
+	}
+
+	var refused = false
+	for _, env := range frame.Envelopes {
+		req = &request{Client: client}
+		score, err = h.parseMessage(req, env)
+		if errors.Cause(err) == errUnsupportedProtocol {
+			h.clientLog(req).Info(err)
+			refused = true
+			quitReason = "unsupported protocol version"
+			break
+		}
+		if err != nil {
+			h.clientLog(req).Error(errors.Wrap(err, "h.parseMessage"))
+		}
+
+		if quitReason = h.penalize(req, score); quitReason != "" {
+			break
+		}
+	}
+
+	if frame.Batch {
+		if err = client.EndBatch(); err != nil {
+			h.log.Error(errors.Wrap(err, "client.EndBatch"))
+		}
+	}
+
+	// The close frame has to follow the error telling why.
+	if refused {
+		msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported protocol version")
+		if err = client.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+			h.log.Error(errors.Wrap(err, "client.Conn.WriteControl"))
+		}
+	}
+
+	return
+}
+
+/* penalize adds to the ban-score of a client, returning "banned" as the quit
+ * reason if that disconnects it. */
+func (h *handler) penalize(client *request, score int) string {
+	disconnect, err := h.addBanScore(client, score)
+	if err != nil {
+		h.clientLog(client).Error(errors.Wrap(err, "addBanScore"))
+	}
+	if disconnect {
+		return "banned"
+	}
+
+	return ""
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"strings"
+
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// batchOf returns a JSON array of n copies of obj.
+func batchOf(obj string, n int) string {
+	objs := make([]string, n)
+	for i := range objs {
+		objs[i] = obj
+	}
+
+	return "[" + strings.Join(objs, ",") + "]"
+}
+
+var _ = Describe("calling decodeFrame", func() {
+	const join = `{"action":"join","room":"#default/#general"}`
+	var f *fixture
+
+	BeforeEach(func() {
+		f = newFixture()
+	})
+	AfterEach(func() {
+		f.close()
+	})
+
+	DescribeTable("decodes frames",
+		func(raw string, batch bool, count int) {
+			frame, score, err := f.h.decodeFrame(f.client, []byte(raw))
+			Expect(err).To(BeNil())
+			Expect(score).To(Equal(0))
+			Expect(frame).NotTo(BeNil())
+			Expect(frame.Batch).To(Equal(batch))
+			Expect(frame.Envelopes).To(HaveLen(count))
+		},
+		Entry("a single object", join, false, 1),
+		Entry("a single object in an array", batchOf(join, 1), true, 1),
+		Entry("a batch", " \n"+batchOf(join, 2), true, 2),
+		Entry("the largest batch", batchOf(join, maxBatchSize), true, maxBatchSize),
+	)
+
+	DescribeTable("refuses invalid frames",
+		func(raw string, banScore int, reason string) {
+			frame, score, err := f.h.decodeFrame(f.client, []byte(raw))
+			Expect(err).To(BeNil())
+			Expect(frame).To(BeNil())
+			Expect(score).To(Equal(banScore))
+
+			e := f.readError()
+			Expect(e.Response).To(Equal(types.BadRequestOrObject))
+			Expect(e.Error).To(ContainSubstring(reason))
+		},
+		Entry("malformed JSON", `{"action":`, 0, "invalid object"),
+		Entry("a string", `"join"`, 0, "invalid object"),
+		Entry("nested arrays", `[[`+join+`]]`, 0, "invalid object"),
+		Entry("invalid UTF-8", "{\"action\":\"\xff\"}", 1, "UTF-8"),
+		Entry("an empty batch", `[]`, 0, "empty batch"),
+		Entry("null objects", `[`+join+`,null]`, 0, "invalid object"),
+		Entry("oversized batches", batchOf(join, maxBatchSize+1), 1, "limited to 32"),
+	)
+
+	It("leaves payload validation to each object", func() {
+		frame, _, err := f.h.decodeFrame(f.client, []byte(`[`+join+`,{"action":"join"},{"action":"bogus"}]`))
+		Expect(err).To(BeNil())
+		Expect(frame.Envelopes).To(HaveLen(3))
+
+		payload, err := frame.Envelopes[0].Decode()
+		Expect(err).To(BeNil())
+		Expect(payload).To(Equal(&types.JoinPayload{Room: "#default/#general"}))
+		_, err = frame.Envelopes[1].Decode()
+		Expect(err).To(MatchError("missing room"))
+		_, err = frame.Envelopes[2].Decode()
+		Expect(err).To(Equal(types.ErrUnknownAction))
+	})
+})
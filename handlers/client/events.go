@@ -0,0 +1,94 @@
+package client
+
+import (
+	"strings"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+const maxReasonLength = 140
+
+// sendRoomEvent relays a join, part or quit event to every member of a room
+// other than the user it's about.
+func (h *handler) sendRoomEvent(room *types.Room, action string, user *types.User, reason string) {
+	if !validText(reason, maxReasonLength) {
+		reason = ""
+	}
+
+	event := types.NewRoomEvent(action, room.Group+"/"+room.Title, user, reason)
+
+	for k := range room.Users {
+		if k == user.ID.String() {
+			continue
+		}
+		for _, c := range h.sessionsFor(k) {
+			if err := c.Send(event); err != nil {
+				h.log.Error(err)
+			}
+		}
+	}
+}
+
+// quitRooms sends quit events to every room a user was in.
+func (h *handler) quitRooms(user *types.User, reason string) {
+	for _, name := range user.Rooms {
+		slice := strings.Split(name, "/")
+		if len(slice) != 2 {
+			continue
+		}
+
+		room, err := h.groupHandler.GetRoom(slice[0], slice[1])
+		if err != nil {
+			h.log.Error(errors.Wrap(err, "GetRoom"))
+			continue
+		}
+		if room == nil {
+			continue
+		}
+
+		h.sendRoomEvent(room, "quit", user, reason)
+	}
+}
+
+/* removeGuest takes a guest out of all of their rooms and groups, guests are
+ * deleted once they leave so they mustn't be left behind as members. */
+func (h *handler) removeGuest(user *types.User) {
+	for _, name := range user.Rooms {
+		slice := strings.Split(name, "/")
+		if len(slice) != 2 {
+			continue
+		}
+
+		room, err := h.groupHandler.GetRoom(slice[0], slice[1])
+		if err != nil {
+			h.log.Error(errors.Wrap(err, "GetRoom"))
+			continue
+		}
+		if room == nil {
+			continue
+		}
+
+		delete(room.Users, user.ID.String())
+		if err = h.groupHandler.WriteRoomData(room); err != nil {
+			h.log.Error(errors.Wrap(err, "WriteRoomData"))
+		}
+	}
+
+	for _, g := range user.Groups {
+		group, err := h.groupHandler.GetGroup(g)
+		if err != nil {
+			h.log.Error(errors.Wrap(err, "GetGroup"))
+			continue
+		}
+		if group == nil {
+			continue
+		}
+
+		delete(group.Users, user.ID.String())
+		if err = h.groupHandler.WriteGroupData(group); err != nil {
+			h.log.Error(errors.Wrap(err, "WriteGroupData"))
+		}
+	}
+}
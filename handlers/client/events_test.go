@@ -0,0 +1,68 @@
+package client
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("room events", func() {
+	var ts *testServer
+
+	BeforeEach(func() {
+		ts = newTestServer(nil)
+	})
+	AfterEach(func() {
+		ts.close()
+	})
+
+	// event matches an event of the given action in #default/#events.
+	event := func(action string) func(obj map[string]interface{}) bool {
+		return func(obj map[string]interface{}) bool {
+			return obj["action"] == action && obj["room"] == "#default/#events"
+		}
+	}
+
+	It("tells the other members who joins and parts", func() {
+		kirk, spock := ts.user("eventkirk"), ts.user("eventspock")
+		member, other := ts.login(spock), ts.login(kirk)
+		defer member.close()
+		defer other.close()
+		ts.join(member, "#default/#events")
+
+		ts.join(other, "#default/#events")
+		join := member.expect(event("join"))
+		Expect(join["user"]).To(Equal(kirk.ID.String()))
+		Expect(join["username"]).To(Equal("eventkirk"))
+
+		other.send(map[string]interface{}{"action": "part", "room": "#default/#events", "reason": "shore leave"})
+		part := member.expect(event("part"))
+		Expect(part["user"]).To(Equal(kirk.ID.String()))
+		Expect(part["reason"]).To(Equal("shore leave"))
+	})
+
+	It("sends a single quit once the last session leaves", func() {
+		kirk, spock := ts.user("quitkirk"), ts.user("quitspock")
+		member, first, second := ts.login(spock), ts.login(kirk), ts.login(kirk)
+		defer member.close()
+		ts.join(member, "#default/#events")
+		ts.join(first, "#default/#events")
+
+		first.close()
+		Eventually(func() int {
+			return len(ts.h.sessionsFor(kirk.ID.String()))
+		}).Should(Equal(1))
+
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "warp speed")
+		Expect(second.conn.WriteMessage(websocket.CloseMessage, msg)).To(BeNil())
+		second.close()
+
+		quit := member.expect(event("quit"))
+		Expect(quit["user"]).To(Equal(kirk.ID.String()))
+		Expect(quit["reason"]).To(Equal("warp speed"))
+		member.expectNone(event("quit"), 200*time.Millisecond)
+	})
+})
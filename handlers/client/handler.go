@@ -2,17 +2,20 @@ package client
 
 import (
 	"fmt"
-	"strconv"
-	"strings"
+	"io"
+	"time"
 
+	"tiberious/auth"
+	"tiberious/blob"
+	"tiberious/codec"
 	"tiberious/db"
 	"tiberious/handlers/group"
+	"tiberious/mailer"
 	"tiberious/settings"
 	"tiberious/types"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
-	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -25,58 +28,74 @@ type (
 	Handler interface {
 		HandleConnection(conn *websocket.Conn)
 		GetClients() map[string]*types.Client
+		VerifyEmail(token string) (bool, error)
+		ResetPassword(ip, token, password string) (bool, error)
+		OpenAttachment(token string) (*types.Attachment, io.ReadCloser, error)
 	}
 
 	handler struct {
-		config       *settings.Config
-		log          *logrus.Logger
-		dbClient     db.Client
-		groupHandler group.Handler
+		config        *settings.Config
+		log           *logrus.Logger
+		dbClient      db.Client
+		groupHandler  group.Handler
+		mailer        mailer.Mailer
+		authenticator auth.Authenticator
+		blobs         blob.Store
+		presence      *presence
+		typing        *typingState
+		uploads       *uploadState
+
+		resetAccounts  *throttle
+		resetAddresses *throttle
 
 		clients map[string]*types.Client
 	}
 )
 
 // NewHandler returns a new Handler using the provided config and clients map.
-func NewHandler(config *settings.Config, dbClient db.Client, groupHandler group.Handler, clients map[string]*types.Client, log *logrus.Logger) (Handler, error) {
-	return &handler{
-		config:       config,
-		log:          log,
-		dbClient:     dbClient,
-		groupHandler: groupHandler,
-		clients:      clients,
-	}, nil
+func NewHandler(config *settings.Config, dbClient db.Client, groupHandler group.Handler, mailer mailer.Mailer, authenticator auth.Authenticator, blobs blob.Store, clients map[string]*types.Client, log *logrus.Logger) (Handler, error) {
+	h := &handler{
+		config:        config,
+		log:           log,
+		dbClient:      dbClient,
+		groupHandler:  groupHandler,
+		mailer:        mailer,
+		authenticator: authenticator,
+		blobs:         blobs,
+		presence:      newPresence(),
+		typing:        newTypingState(),
+		uploads:       newUploadState(),
+		clients:       clients,
+
+		resetAccounts:  newThrottle(resetAccountInterval),
+		resetAddresses: newThrottle(resetAddressInterval),
+	}
+
+	if config.AutoAway > 0 {
+		go h.autoAway()
+	}
+	if config.BlobStore != "" && config.UploadExpire > 0 {
+		go h.expireUploads()
+	}
+
+	return h, nil
 }
 
-func (h *handler) authenticate(client *types.Client, token types.AuthToken) (int, error) {
+func (h *handler) authenticate(client *request, token types.AuthToken) (int, error) {
 	banScore := 0
-	keys, err := h.dbClient.GetKeySet("user-*-" + token.AccountName + "-*")
-	if err != nil {
-		return banScore, errors.Wrap(err, "dbClient.GetKeySet")
+	user, err := h.authenticator.Authenticate(token)
+	if err != nil && err != auth.ErrInvalidCredentials && err != auth.ErrAccountConflict {
+		return banScore, errors.Wrap(err, "authenticator.Authenticate")
 	}
 
-	if len(keys) == 0 {
-		banScore = 1
-		if err = client.Error(types.IncorrectCredentials, ""); err != nil {
+	if err == auth.ErrAccountConflict {
+		if err = client.Error(types.Conflict, "account belongs to another user"); err != nil {
 			err = errors.Wrap(err, "client.Error")
 		}
 		return banScore, err
 	}
 
-	slice := strings.Split(keys[0], "-")
-	user, err := h.dbClient.GetUserData(strings.Join(slice[3:], "-"))
-	if err != nil {
-		if err == types.NotInDB {
-			if err = client.Error(types.IncorrectCredentials, ""); err != nil {
-				err = errors.Wrap(err, "client.Error")
-			}
-		} else {
-			err = errors.Wrap(err, "dbClient.GetUserData")
-		}
-		return banScore, err
-	}
-
-	if token.Password != user.Password {
+	if err == auth.ErrInvalidCredentials {
 		banScore = 1
 		if err = client.Error(types.IncorrectCredentials, ""); err != nil {
 			err = errors.Wrap(err, "client.Error")
@@ -84,75 +103,138 @@ func (h *handler) authenticate(client *types.Client, token types.AuthToken) (int
 		return banScore, err
 	}
 
+	ban, err := h.checkBan("user-" + user.ID.String())
+	if err != nil {
+		return banScore, errors.Wrap(err, "checkBan")
+	}
+	if ban != nil {
+		return banScore, h.refuseBanned(client.Client, ban)
+	}
+
 	if client.User.Type == guest {
+		h.quitRooms(client.User, "")
+		h.removeGuest(client.User)
 		if err = h.dbClient.DeleteUser(client.User); err != nil {
 			err = errors.Wrap(err, "dbClient.DeleteUser")
 		}
 	}
 
-	delete(h.clients, client.User.ID.String())
+	if h.clients[client.User.ID.String()] == client.Client {
+		delete(h.clients, client.User.ID.String())
+	}
+
+	// Sessions of the same user share a single user object.
+	if c, ok := h.clients[user.ID.String()]; ok && c.User != nil {
+		user = c.User
+	}
 
 	/* TODO add any rooms that exist in the current user to the new user
 	 * before discarding it. */
+	old := client.User
+	// Other sessions read the user of this one, see presenceAudience.
+	h.presence.Lock()
 	client.User = user
+	h.presence.Unlock()
 	client.Authorized = true
 	client.User.Connected = true
+	client.User.LastSeen = time.Now().Unix()
 	if err = h.dbClient.WriteUserData(client.User); err != nil {
 		err = errors.Wrap(err, "dbClient.WriteUserData")
 	}
 
-	h.clients[client.User.ID.String()] = client
+	h.clients[client.User.ID.String()] = client.Client
+
+	// The previous (guest) user is gone now that the session moved.
+	h.broadcastPresence(old)
+	h.broadcastPresence(client.User)
 
 	if err = client.Alert(types.OK, ""); err != nil {
-		err = errors.Wrap(err, "client.Alert")
+		return banScore, errors.Wrap(err, "client.Alert")
+	}
+
+	if err = h.deliverQueued(client.Client); err != nil {
+		return banScore, errors.Wrap(err, "deliverQueued")
+	}
+
+	if h.config.MessageStore {
+		if err = h.sendReadState(client); err != nil {
+			err = errors.Wrap(err, "sendReadState")
+		}
 	}
 
 	return banScore, err
 }
 
-/* Always make sure a new ID is unique...
- * the probability of a UUID collision is somewhere around 1% in 100 million
- * UUIDs but we'll be overly cautious and check anyway. */
-func (h *handler) getUniqueID() (uuid.UUID, error) {
-	var id uuid.UUID
-	for {
-		id = uuid.NewRandom()
-		exists, err := h.dbClient.UserExists(id.String())
-		if err != nil {
-			return nil, errors.Wrap(err, "dbClient.UserExists")
-		}
-		if exists {
-			continue
+// deliverQueued sends any direct messages queued while a user was offline.
+func (h *handler) deliverQueued(client *types.Client) error {
+	msgs, err := h.dbClient.PopQueuedMessages(client.User.ID.String())
+	if err != nil {
+		return errors.Wrap(err, "dbClient.PopQueuedMessages")
+	}
+
+	for i, m := range msgs {
+		if err = client.Deliver(m); err != nil {
+			// Put back what wasn't delivered for the next login.
+			for _, r := range msgs[i:] {
+				if err2 := h.dbClient.QueueMessage(client.User.ID.String(), r); err2 != nil {
+					h.log.Error(errors.Wrap(err2, "dbClient.QueueMessage"))
+				}
+			}
+			return errors.Wrap(err, "client.Deliver")
 		}
-		break
 	}
 
-	return id, nil
+	return nil
 }
 
 // HandleConnection is the core function of clientHandler
 func (h *handler) HandleConnection(conn *websocket.Conn) {
-	var err error
-
 	client := types.NewClient()
 	client.Conn = conn
-	client.User = new(types.User)
-	// Set the UUID and initialize a username of "guest"
-	client.User.ID, err = h.getUniqueID()
+	client.IP = remoteIP(conn.RemoteAddr())
+	client.Codec = codec.ForSubprotocol(conn.Subprotocol())
+	if h.config.MaxMessageSize > 0 {
+		client.Conn.SetReadLimit(int64(h.config.MaxMessageSize))
+	}
+
+	// Refuse banned addresses before anything is written for the client.
+	ban, err := h.checkBan(h.banKeys(client)...)
 	if err != nil {
 		h.log.Error(err)
 	}
+	if ban != nil {
+		h.log.Infof("refused banned client %s", client.IP)
+		if err = h.refuseBanned(client, ban); err != nil {
+			h.log.Error(err)
+		}
+		if err = client.Conn.Close(); err != nil {
+			h.log.Error(err)
+		}
+		return
+	}
 
-	guests, err := h.dbClient.GetKeySet("user-guest-*-*")
+	client.User = new(types.User)
+	// Set the UUID and initialize a unique guest username
+	client.User.ID, err = h.dbClient.GetUniqueID()
+	if err == nil {
+		client.User.Username, err = h.guestName(client.User.ID.String())
+	}
 	if err != nil {
+		// Without the database there's no identity to give the client.
 		h.log.Error(err)
+		if err = client.Error(types.ServerError, "unable to start a session"); err != nil {
+			h.log.Error(err)
+		}
+		if err = client.Conn.Close(); err != nil {
+			h.log.Error(err)
+		}
+		return
 	}
 
-	// TODO give guests a numeric suffix, allow disabling guest connections.
-	client.User.Username = guest + strconv.Itoa(len(guests)+1)
 	client.User.LoginName = client.User.Username
 	client.User.Type = guest
 	client.User.Connected = true
+	client.User.LastSeen = time.Now().Unix()
 	h.clients[client.User.ID.String()] = client
 
 	if h.config.AllowGuests {
@@ -165,12 +247,12 @@ func (h *handler) HandleConnection(conn *websocket.Conn) {
 			h.log.Error(err)
 		}
 		defgroup.Users[client.User.ID.String()] = client.User
-		client.User.Groups = append(client.User.Groups, "#default")
+		h.addGroup(client.User, "#default")
 		room, err = h.groupHandler.GetRoom("#default", "#general")
 		if err != nil {
 			h.log.Error(err)
 		}
-		client.User.Rooms = append(client.User.Rooms, "#default/#general")
+		h.addRoom(client.User, "#default/#general")
 		room.Users[client.User.ID.String()] = client.User
 
 		if err = h.dbClient.WriteUserData(client.User); err != nil {
@@ -188,6 +270,8 @@ func (h *handler) HandleConnection(conn *websocket.Conn) {
 		h.log.Info("new client connected")
 	}
 
+	h.addSession(client)
+
 	if err = client.Alert(types.OK, ""); err != nil {
 		h.log.Error(err)
 	}
@@ -207,11 +291,19 @@ func (h *handler) HandleConnection(conn *websocket.Conn) {
 
 	/* Never return from this loop!
 	 * Never break from this loop unless intending to disconnect the client. */
+	var quitReason string
 	for {
 		var rawmsg []byte
 		_, rawmsg, err = client.Conn.ReadMessage()
 
 		if err != nil {
+			// Clients may give a quit reason in their close frame.
+			if ce, ok := err.(*websocket.CloseError); ok {
+				quitReason = ce.Text
+			} else {
+				quitReason = "connection lost"
+			}
+
 			switch {
 			case websocket.IsCloseError(err, websocket.CloseNormalClosure):
 				if client.User != nil {
@@ -220,28 +312,32 @@ func (h *handler) HandleConnection(conn *websocket.Conn) {
 					h.log.Info("client disconnected")
 				}
 				break
-			// TODO handle these different cases appropriately.
-			case websocket.IsCloseError(err, websocket.CloseGoingAway):
-				fallthrough
+			// Misbehaving clients are penalized so repeat offenders get banned.
 			case websocket.IsCloseError(err, websocket.CloseProtocolError, websocket.CloseUnsupportedData):
-				fallthrough
-				// This should utilize the ban-score to combat possible spammers
+				h.log.Info(err)
+				if _, err = h.addBanScore(&request{Client: client}, protocolBanScore); err != nil {
+					h.log.Error(errors.Wrap(err, "addBanScore"))
+				}
+			case err == websocket.ErrReadLimit:
+				quitReason = "message too big"
+				h.log.Info(err)
+				if _, err = h.addBanScore(&request{Client: client}, policyBanScore); err != nil {
+					h.log.Error(errors.Wrap(err, "addBanScore"))
+				}
 			case websocket.IsCloseError(err, websocket.ClosePolicyViolation, websocket.CloseMessageTooBig):
-				// These should also utilize the ban-score but with a higher ban
-				fallthrough
+				h.log.Info(err)
+				if _, err = h.addBanScore(&request{Client: client}, policyBanScore); err != nil {
+					h.log.Error(errors.Wrap(err, "addBanScore"))
+				}
 			default:
 				h.log.Info(err)
 			}
 			break
 		}
 
-		var ban int
-		ban, err = h.parseMessage(client, rawmsg)
-		if err != nil {
-			h.log.Error(errors.Wrap(err, "h.parseMessage"))
-		}
-		if ban > 0 {
-			// TODO handle ban-score
+		h.touchSession(client)
+
+		if quitReason = h.handleFrame(client, rawmsg); quitReason != "" {
 			break
 		}
 	}
@@ -250,20 +346,46 @@ func (h *handler) HandleConnection(conn *websocket.Conn) {
 	if err = client.Conn.Close(); err != nil {
 		h.log.Error(err)
 	}
+	h.abortUploads(client)
+
+	// Users stay connected until their last session is gone.
+	last := h.removeSession(client)
+	if client.User != nil && last {
+		h.quitRooms(client.User, quitReason)
+	}
 	if client.User != nil {
 		if client.User.Type == guest {
+			h.removeGuest(client.User)
 			if err = h.dbClient.DeleteUser(client.User); err != nil {
 				h.log.Error(err)
 			}
 		} else {
-			client.User.Connected = false
+			client.User.Connected = !last
+			client.User.LastSeen = time.Now().Unix()
 			if err = h.dbClient.WriteUserData(client.User); err != nil {
 				h.log.Error(err)
 			}
 		}
 	}
 
-	delete(h.clients, client.User.ID.String())
+	id := client.User.ID.String()
+	if last {
+		delete(h.clients, id)
+	} else if h.clients[id] == client {
+		if sessions := h.sessionsFor(id); len(sessions) > 0 {
+			h.clients[id] = sessions[0]
+		}
+	}
+}
+
+// clientLog returns a log entry carrying the ID of the request being handled,
+// if there is one.
+func (h *handler) clientLog(client *request) *logrus.Entry {
+	if client.RequestID == "" {
+		return logrus.NewEntry(h.log)
+	}
+
+	return h.log.WithField("request", client.RequestID)
 }
 
 // GetClientForUser returns a client object that houses a given user
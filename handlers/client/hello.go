@@ -0,0 +1,137 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxClientNameLength = 64
+	// maxFeatures limits the features a client may announce.
+	maxFeatures      = 32
+	maxFeatureLength = 32
+)
+
+/* errUnsupportedProtocol is returned by parseMessage once a client was refused
+ * for speaking a protocol version the server doesn't, handleFrame closes the
+ * connection after it. */
+var errUnsupportedProtocol = errors.New("unsupported protocol version")
+
+// serverFeatures lists the optional features enabled in the config.
+func (h *handler) serverFeatures() []string {
+	features := []string{}
+	if h.config.AllowGuests {
+		features = append(features, "guests")
+	}
+	if h.config.MessageStore {
+		features = append(features, "history")
+	}
+	// External providers create accounts on the first login.
+	if h.config.AuthProvider != "" && h.config.AuthProvider != "db" {
+		features = append(features, "registration")
+	}
+	if h.config.Mailer != "" {
+		features = append(features, "password_reset")
+	}
+	if h.config.BlobStore != "" {
+		features = append(features, "uploads")
+	}
+	if h.config.ReadReceipts {
+		features = append(features, "read_receipts")
+	}
+	features = append(features, types.FeatureBatch)
+
+	return features
+}
+
+// serverLimits returns the limits enforced for every client.
+func (h *handler) serverLimits() *types.Limits {
+	limits := &types.Limits{
+		MaxMessageSize: h.config.MaxMessageSize,
+		MaxBodySize:    h.config.MaxBodySize,
+		MaxAttachments: maxAttachments,
+		MaxHistory:     maxHistoryLimit,
+		TypingInterval: int(typingThrottle / time.Second),
+	}
+	if h.config.BlobStore != "" {
+		limits.MaxUploadSize = int64(h.config.MaxUploadSize) * 1024
+		limits.MaxChunkSize = maxChunkSize
+	}
+
+	return limits
+}
+
+/* hello answers a client introducing itself with the server version, limits,
+ * features and the identity of the session. Clients speaking a protocol
+ * version the server doesn't are refused and disconnected. */
+func (h *handler) hello(client *request, payload *types.HelloPayload) (banScore int, err error) {
+	switch {
+	case client.Protocol != 0:
+		if err = client.Error(types.Conflict, "hello was already sent"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	// Client names, versions and features are logged so they must be printable.
+	case !validText(payload.ClientName, maxClientNameLength) || !validText(payload.ClientVersion, maxClientNameLength):
+		banScore = 1
+		if err = client.Error(types.BadRequestOrObject, "client names and versions are limited to 64 printable characters"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case len(payload.Features) > maxFeatures:
+		banScore = 1
+		if err = client.Error(types.BadRequestOrObject, "too many features"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+	for _, f := range payload.Features {
+		if f == "" || !validText(f, maxFeatureLength) {
+			banScore = 1
+			if err = client.Error(types.BadRequestOrObject, "invalid feature name"); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return
+		}
+	}
+
+	if payload.Protocol < types.MinProtocolVersion || payload.Protocol > types.ProtocolVersion {
+		return banScore, h.refuseProtocol(client, payload.Protocol)
+	}
+
+	client.Protocol = payload.Protocol
+	client.ClientName = payload.ClientName
+	client.ClientVersion = payload.ClientVersion
+	client.Features = payload.Features
+	h.clientLog(client).Infof("%s %s is using %s %s (protocol %d)", client.User.Type, client.User.ID.String(), client.ClientName, client.ClientVersion, client.Protocol)
+
+	session := &types.Session{
+		ID:         client.User.ID.String(),
+		Username:   client.User.Username,
+		Type:       client.User.Type,
+		Authorized: client.Authorized,
+	}
+	res := types.NewHello(client.Protocol, client.Codec.Name(), h.serverLimits(), h.serverFeatures(), session)
+	res.ID = client.RequestID
+
+	if err = client.Reply(res); err != nil {
+		err = errors.Wrap(err, "client.Reply")
+	}
+
+	return
+}
+
+/* refuseProtocol tells a client which protocol versions are supported,
+ * errUnsupportedProtocol is returned so the connection gets closed. */
+func (h *handler) refuseProtocol(client *request, protocol int) error {
+	msg := fmt.Sprintf("unsupported protocol version %d, supported versions are %d to %d", protocol, types.MinProtocolVersion, types.ProtocolVersion)
+	if err := client.Error(types.UpgradeRequired, msg); err != nil {
+		return errors.Wrap(err, "client.Error")
+	}
+
+	return errUnsupportedProtocol
+}
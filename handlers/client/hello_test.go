@@ -0,0 +1,45 @@
+package client
+
+import (
+	"strings"
+
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("calling hello", func() {
+	var f *fixture
+
+	BeforeEach(func() {
+		f = newFixture()
+	})
+	AfterEach(func() {
+		f.close()
+	})
+
+	DescribeTable("refuses invalid client descriptions",
+		func(payload *types.HelloPayload, reason string) {
+			payload.Protocol = types.ProtocolVersion
+			score, err := f.h.hello(f.request(""), payload)
+			Expect(err).To(BeNil())
+			Expect(score).To(Equal(1))
+			Expect(f.client.Protocol).To(Equal(0))
+
+			e := f.readError()
+			Expect(e.Response).To(Equal(types.BadRequestOrObject))
+			Expect(e.Error).To(ContainSubstring(reason))
+		},
+		Entry("long names", &types.HelloPayload{ClientName: strings.Repeat("n", maxClientNameLength+1)}, "limited to 64"),
+		Entry("long versions", &types.HelloPayload{ClientVersion: strings.Repeat("1", maxClientNameLength+1)}, "limited to 64"),
+		Entry("names with newlines", &types.HelloPayload{ClientName: "client\nlevel=error msg=forged"}, "printable"),
+		Entry("versions with escape sequences", &types.HelloPayload{ClientVersion: "1.0\x1b[2K"}, "printable"),
+		Entry("names with invalid UTF-8", &types.HelloPayload{ClientName: "client\xff"}, "printable"),
+		Entry("too many features", &types.HelloPayload{Features: make([]string, maxFeatures+1)}, "too many features"),
+		Entry("empty features", &types.HelloPayload{Features: []string{""}}, "invalid feature"),
+		Entry("long features", &types.HelloPayload{Features: []string{strings.Repeat("f", maxFeatureLength+1)}}, "invalid feature"),
+		Entry("features with newlines", &types.HelloPayload{Features: []string{"batch\nforged"}}, "invalid feature"),
+	)
+})
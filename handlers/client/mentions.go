@@ -0,0 +1,144 @@
+package client
+
+import (
+	"strings"
+	"unicode"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+// mentionRoom mentions every member of the room a message is sent to.
+const mentionRoom = "room"
+
+// mentionNames returns the names mentioned by "@name" in a message body.
+func mentionNames(body string) []string {
+	var (
+		ret  []string
+		seen = make(map[string]bool)
+	)
+	for _, word := range strings.Fields(body) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		word = strings.TrimRightFunc(word[1:], func(r rune) bool {
+			return unicode.IsPunct(r) && r != '_' && r != '-'
+		})
+		if word != "" && !seen[strings.ToLower(word)] {
+			seen[strings.ToLower(word)] = true
+			ret = append(ret, word)
+		}
+	}
+
+	return ret
+}
+
+/* resolveMentions returns the IDs of the users mentioned in a room message,
+ * "@room" mentions every member. Members of the rooms group that aren't in
+ * the room are mentioned too unless the room is private, their names are
+ * returned as missing either way. The sender is never mentioned. */
+func (h *handler) resolveMentions(room *types.Room, from, body string) (ids, missing []string, err error) {
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id != from && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	for _, name := range mentionNames(body) {
+		if strings.ToLower(name) == mentionRoom {
+			for k := range room.Users {
+				add(k)
+			}
+			continue
+		}
+
+		var found = false
+		for k, u := range room.Users {
+			if strings.EqualFold(u.Username, name) {
+				add(k)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		// Anything else that isn't a username is just text.
+		var owner string
+		owner, err = h.dbClient.GetUsernameOwner(name)
+		if err != nil {
+			err = errors.Wrap(err, "dbClient.GetUsernameOwner")
+			return
+		}
+		if owner == "" {
+			continue
+		}
+		missing = append(missing, name)
+		if room.Private {
+			continue
+		}
+
+		var user *types.User
+		if user, err = h.loadUser(owner); err != nil {
+			err = errors.Wrap(err, "loadUser")
+			return
+		}
+		if user == nil {
+			continue
+		}
+		for _, g := range user.Groups {
+			if g == room.Group {
+				add(owner)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// sendHighlights notifies every session of the users mentioned in a message.
+func (h *handler) sendHighlights(msg *types.Message) {
+	highlight := types.NewHighlight(msg)
+
+	for _, id := range msg.Mentions {
+		for _, c := range h.sessionsFor(id) {
+			if err := c.Send(highlight); err != nil {
+				h.log.Error(err)
+			}
+		}
+	}
+}
+
+// listMentions sends a page of the stored messages that mentioned the client.
+func (h *handler) listMentions(client *request, before string, limit int) (banScore int, err error) {
+	if !h.config.MessageStore {
+		if err = client.Error(types.NotFound, "message storage is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	switch {
+	case limit <= 0:
+		limit = defaultHistoryLimit
+	case limit > maxHistoryLimit:
+		limit = maxHistoryLimit
+	}
+
+	msgs, more, err := h.dbClient.GetMentions(client.User.ID.String(), before, limit)
+	if err != nil {
+		err = errors.Wrap(err, "dbClient.GetMentions")
+		return
+	}
+
+	if err = client.Reply(types.NewMentions(msgs, more)); err != nil {
+		err = errors.Wrap(err, "client.Reply")
+	}
+
+	return
+}
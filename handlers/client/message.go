@@ -1,58 +1,124 @@
 package client
 
 import (
-	"encoding/json"
 	"strings"
+	"time"
+
+	"tiberious/db"
 	"tiberious/types"
 
-	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 )
 
-func (h *handler) relayToRoom(room *types.Room, rawmsg []byte) {
+func (h *handler) relayToRoom(room *types.Room, v interface{}) {
 	for _, u := range room.Users {
-		c := h.GetClientForUser(u)
-		if c != nil {
-			if err := c.Conn.WriteMessage(websocket.BinaryMessage, rawmsg); err != nil {
+		for _, c := range h.sessionsFor(u.ID.String()) {
+			if err := c.Send(v); err != nil {
 				h.log.Error(err)
 			}
 		}
 	}
 }
 
-func (h *handler) relayToGroup(group *types.Group, rawmsg []byte) {
+// relayToRooms relays a message once to every member of the given rooms
+// (formatted as "group/room").
+func (h *handler) relayToRooms(rooms []string, v interface{}) {
+	users := make(map[string]*types.User)
+	for _, name := range rooms {
+		slice := strings.Split(name, "/")
+		if len(slice) != 2 {
+			continue
+		}
+
+		room, err := h.groupHandler.GetRoom(slice[0], slice[1])
+		if err != nil {
+			h.log.Error(err)
+			continue
+		}
+		if room == nil {
+			continue
+		}
+
+		for k, u := range room.Users {
+			users[k] = u
+		}
+	}
+
+	for _, u := range users {
+		for _, c := range h.sessionsFor(u.ID.String()) {
+			if err := c.Send(v); err != nil {
+				h.log.Error(err)
+			}
+		}
+	}
+}
+
+func (h *handler) relayToGroup(group *types.Group, v interface{}) {
 	for _, u := range group.Users {
-		c := h.GetClientForUser(u)
-		if c != nil {
-			if err := c.Conn.WriteMessage(websocket.BinaryMessage, rawmsg); err != nil {
+		for _, c := range h.sessionsFor(u.ID.String()) {
+			if err := c.Send(v); err != nil {
 				h.log.Error(err)
 			}
 		}
 	}
 }
 
+/* relayToOtherSessions sends a direct message to the other devices the sender
+ * is connected from, unless they're the recipient's sessions anyway. */
+func (h *handler) relayToOtherSessions(client *request, msg *types.Message) {
+	if msg.To == client.User.ID.String() {
+		return
+	}
+
+	for _, c := range h.sessionsFor(client.User.ID.String()) {
+		if c == client.Client {
+			continue
+		}
+		if err := c.Send(msg); err != nil {
+			h.clientLog(client).Error(err)
+		}
+	}
+}
+
+const (
+	maxRequestIDLength = 64
+	// maxClockSkew is how far in the future a message time may be.
+	maxClockSkew = 24 * time.Hour
+)
+
 // parseMessage parses a message object and returns an int back, with a ban-score
 // if this is greater than 0 it is applied to the clients ban-score. */
-func (h *handler) parseMessage(client *types.Client, rawmsg []byte) (banScore int, err error) {
+func (h *handler) parseMessage(client *request, env *types.Envelope) (banScore int, err error) {
 	banScore = 0
 
-	var message types.MasterObj
-	if err = json.Unmarshal(rawmsg, &message); err != nil {
-		if err2 := client.Error(types.BadRequestOrObject, "invalid object"); err2 != nil {
-			err = errors.Wrap(err2, "client.Error")
+	if len(env.ID) > maxRequestIDLength {
+		if err = client.Error(types.BadRequestOrObject, "request IDs are limited to 64 characters"); err != nil {
+			err = errors.Wrap(err, "client.Error")
 		}
 		return
 	}
+	client.RequestID = env.ID
 
-	if message.Time <= 0 {
+	if env.Time <= 0 {
 		if err = client.Error(types.BadRequestOrObject, "missing or invalid time"); err != nil {
 			err = errors.Wrap(err, "client.Error")
 		}
 		return
 	}
+	if env.Time > time.Now().Add(maxClockSkew).Unix() {
+		banScore = 1
+		if err = client.Error(types.BadRequestOrObject, "time is too far in the future, times are in unix seconds"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
 
 	if !h.config.AllowGuests && !client.Authorized {
-		if message.Action != "authenticate" {
+		// Only allow the actions needed to log in.
+		switch env.Action {
+		case "hello", "authenticate", "forgot", "reset", "verify":
+		default:
 			banScore = 1
 			if err = client.Error(types.NotAuthorized, ""); err != nil {
 				err = errors.Wrap(err, "client.Error")
@@ -61,154 +127,348 @@ func (h *handler) parseMessage(client *types.Client, rawmsg []byte) (banScore in
 		}
 	}
 
-	switch {
-	case message.Action == "authenticate":
-		banScore, err = h.authenticate(client, message.User)
+	payload, err := env.Decode()
+	if err != nil {
+		if err = client.Error(types.BadRequestOrObject, err.Error()); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	switch p := payload.(type) {
+	case *types.AuthenticatePayload:
+		banScore, err = h.authenticate(client, p.User)
 		if err != nil {
 			err = errors.Wrap(err, "authenticate")
 		}
 		return
-	case message.Action == "msg":
-		/* TODO Fixup message parsing (should work for 1to1 even if the user is
-		 * not currently online (with databasing enabled, otherwise should
-		 * return an error)); if destination doesn't exist return an error. */
+	case *types.VerifyPayload:
+		if p.Token == "" {
+			banScore, err = h.sendVerification(client)
+			if err != nil {
+				err = errors.Wrap(err, "sendVerification")
+			}
+			return
+		}
+		banScore, err = h.redeemToken(client, verifyToken, p.Token, "")
+		if err != nil {
+			err = errors.Wrap(err, "redeemToken")
+		}
+		return
+	case *types.ForgotPayload:
+		banScore, err = h.sendPasswordReset(client, p.User.AccountName)
+		if err != nil {
+			err = errors.Wrap(err, "sendPasswordReset")
+		}
+		return
+	case *types.ResetPayload:
+		banScore, err = h.redeemToken(client, resetToken, p.Token, p.User.Password)
+		if err != nil {
+			err = errors.Wrap(err, "redeemToken")
+		}
+		return
+	case *types.NickPayload:
+		banScore, err = h.changeNick(client, p.Nick)
+		if err != nil {
+			err = errors.Wrap(err, "changeNick")
+		}
+		return
+	case *types.WhoisPayload:
+		banScore, err = h.whois(client, p.Target)
+		if err != nil {
+			err = errors.Wrap(err, "whois")
+		}
+		return
+	case *types.ProfilePayload:
+		banScore, err = h.updateProfile(client, p.Profile)
+		if err != nil {
+			err = errors.Wrap(err, "updateProfile")
+		}
+		return
+	case *types.PresencePayload:
+		banScore, err = h.handlePresence(client, p.Status, p.StatusText, p.Target)
+		if err != nil {
+			err = errors.Wrap(err, "handlePresence")
+		}
+		return
+	case *types.TypingPayload:
+		banScore, err = h.handleTyping(client, p.To, p.Typing)
+		if err != nil {
+			err = errors.Wrap(err, "handleTyping")
+		}
+		return
+	case *types.TopicPayload:
+		banScore, err = h.handleTopic(client, p.Room, p.Topic)
+		if err != nil {
+			err = errors.Wrap(err, "handleTopic")
+		}
+		return
+	case *types.RoomInfoPayload:
+		banScore, err = h.roomInfo(client, p.Room)
+		if err != nil {
+			err = errors.Wrap(err, "roomInfo")
+		}
+		return
+	case *types.RoomEditPayload:
+		banScore, err = h.editRoom(client, p.Room, p.Description, p.Meta)
+		if err != nil {
+			err = errors.Wrap(err, "editRoom")
+		}
+		return
+	case *types.HistoryPayload:
+		banScore, err = h.history(client, p.To, p.Before, p.Limit)
+		if err != nil {
+			err = errors.Wrap(err, "history")
+		}
+		return
+	case *types.EditPayload:
+		banScore, err = h.editMessage(client, p.MessageID, p.Body)
+		if err != nil {
+			err = errors.Wrap(err, "editMessage")
+		}
+		return
+	case *types.DeletePayload:
+		banScore, err = h.editMessage(client, p.MessageID, nil)
+		if err != nil {
+			err = errors.Wrap(err, "editMessage")
+		}
+		return
+	case *types.UploadPayload:
+		banScore, err = h.startUpload(client, p.To, p.Name, p.ContentType, p.Size)
+		if err != nil {
+			err = errors.Wrap(err, "startUpload")
+		}
+		return
+	case *types.ChunkPayload:
+		banScore, err = h.uploadChunk(client, p.AttachmentID, p.Data)
+		if err != nil {
+			err = errors.Wrap(err, "uploadChunk")
+		}
+		return
+	case *types.DownloadPayload:
+		banScore, err = h.download(client, p.AttachmentID)
+		if err != nil {
+			err = errors.Wrap(err, "download")
+		}
+		return
+	case *types.HelloPayload:
+		banScore, err = h.hello(client, p)
+		if err != nil {
+			err = errors.Wrap(err, "hello")
+		}
+		return
+	case *types.MentionsPayload:
+		banScore, err = h.listMentions(client, p.Before, p.Limit)
+		if err != nil {
+			err = errors.Wrap(err, "listMentions")
+		}
+		return
+	case *types.ReadPayload:
+		banScore, err = h.markRead(client, p.To, p.MessageID)
+		if err != nil {
+			err = errors.Wrap(err, "markRead")
+		}
+		return
+	case *types.StatePayload:
+		banScore, err = h.readState(client)
+		if err != nil {
+			err = errors.Wrap(err, "readState")
+		}
+		return
+	case *types.ThreadPayload:
+		banScore, err = h.thread(client, p.MessageID, p.Before, p.Limit)
+		if err != nil {
+			err = errors.Wrap(err, "thread")
+		}
+		return
+	case *types.ReactPayload:
+		banScore, err = h.react(client, env.Action, p.MessageID, p.Emoji)
+		if err != nil {
+			err = errors.Wrap(err, "react")
+		}
+		return
+	case *types.MsgPayload:
+		if p.ContentType == "" {
+			p.ContentType = types.ContentPlain
+		}
+		var ok bool
+		if ok, err = h.checkBody(client, p.ContentType, p.Body, len(p.Attachments) > 0); err != nil || !ok {
+			banScore = 1
+			return
+		}
 
+		// The sender is told the ID of their message for later edits.
+		var out *types.Message
 		switch {
 		// All room's start with "#"
-		case h.groupHandler.IsRoomName(message.To):
-			var (
-				group *types.Group
-				room  *types.Room
-			)
-
-			if !strings.Contains(message.To, "/") {
-				if err = client.Error(types.BadRequestOrObject, "room names should be type of 'group/room'"); err != nil {
-					err = errors.Wrap(err, "client.Error")
-				}
+		case h.groupHandler.IsRoomName(p.To):
+			var room *types.Room
+			room, banScore, err = h.roomAccess(client, p.To)
+			if err != nil || room == nil {
 				return
 			}
-			slice := strings.Split(message.To, "/")
-			group, err = h.groupHandler.GetGroup(slice[0])
+
+			if p.Parent != "" {
+				var ok bool
+				if ok, err = h.threadParent(client, room, p.Parent); err != nil || !ok {
+					return
+				}
+			}
+			if len(p.Attachments) > 0 {
+				var ok bool
+				if ok, err = h.checkAttachments(client, room.Group+"/"+room.Title, p.Attachments); err != nil || !ok {
+					return
+				}
+			}
+
+			// Never relay what the client sent, only what we build from it.
+			h.clearTyping(client.User.ID.String(), room.Group+"/"+room.Title)
+			out = types.NewMessage(room.Group+"/"+room.Title, client.User.ID.String(), p.Body)
+			out.ContentType = p.ContentType
+			out.Parent = p.Parent
+			out.Attachments = p.Attachments
+			var missing []string
+			out.Mentions, missing, err = h.resolveMentions(room, client.User.ID.String(), p.Body)
 			if err != nil {
-				err = errors.Wrap(err, "GetGroup")
+				err = errors.Wrap(err, "resolveMentions")
 				return
 			}
-
-			if group == nil {
-				if err = client.Error(types.NotFound, "group does not exist"); err != nil {
-					err = errors.Wrap(err, "client.Error")
-				}
+			if ok, err = h.claimAttachments(client, out); err != nil || !ok {
 				return
 			}
-
-			// Block guest connections from messaging outside of group #default.
-			if client.User.Type == "guest" && group.Title != "#default" {
-				if err = client.Error(types.Forbidden, "guest account, please authenticate"); err != nil {
-					err = errors.Wrap(err, "client.Error")
-				}
+			if err = h.dbClient.StoreMessage(out); err != nil {
+				err = errors.Wrap(err, "dbClient.StoreMessage")
 				return
 			}
+			go h.relayToRoom(room, out)
+			go h.sendHighlights(out)
 
-			// Block messages from outside a group.
-			var member = false
-			for _, g := range client.User.Groups {
-				if group.Title == g {
-					member = true
+			if len(missing) > 0 && h.config.MentionWarnings {
+				if err = client.Alert(types.GeneralNotice, "not in this room: "+strings.Join(missing, ", ")); err != nil {
+					err = errors.Wrap(err, "client.Alert")
+					return
 				}
 			}
-
-			if !member {
-				banScore = 1
-				if err = client.Error(types.Forbidden, ""); err != nil {
+			break
+		default:
+			/* Handle 1to1 messaging, messages to registered users that
+			 * aren't logged on are queued. */
+			if p.Parent != "" {
+				if err = client.Error(types.BadRequestOrObject, "threads are only supported in rooms"); err != nil {
 					err = errors.Wrap(err, "client.Error")
 				}
 				return
 			}
 
-			room, err = h.groupHandler.GetRoom(slice[0], slice[1])
-			if err != nil {
-				err = errors.Wrap(err, "GetRoom")
-				return
-			}
-			if room == nil {
+			to := uuid.Parse(p.To)
+			if to == nil {
 				if err = client.Error(types.NotFound, ""); err != nil {
 					err = errors.Wrap(err, "client.Error")
 				}
 				return
 			}
 
-			// Block external messages on private rooms.
-			member = false
-			for k := range room.Users {
-				if client.User.ID.String() == k {
-					member = true
+			if len(p.Attachments) > 0 {
+				var ok bool
+				if ok, err = h.checkAttachments(client, to.String(), p.Attachments); err != nil || !ok {
+					return
 				}
 			}
 
-			if room.Private && !member {
-				banScore = 1
-				if err = client.Error(types.Forbidden, ""); err != nil {
-					err = errors.Wrap(err, "client.Error")
-				}
+			h.clearTyping(client.User.ID.String(), to.String())
+			out = types.NewMessage(to.String(), client.User.ID.String(), p.Body)
+			out.ContentType = p.ContentType
+			out.Attachments = p.Attachments
+			if ok, err = h.claimAttachments(client, out); err != nil || !ok {
 				return
 			}
-			go h.relayToRoom(room, rawmsg)
-			break
-		default:
-			// Handle 1to1 messaging.
-
-			/* TODO handle server side message logging. handle an error
-			 * message for non-existing users (requires user database)
-			 * and a separate one for users not being logged on. */
 
+			// Deliver to every device the recipient is connected from.
 			var relayed = false
-			for k, c := range h.clients {
-				if message.To == k {
-					if err = c.Conn.WriteMessage(websocket.BinaryMessage, rawmsg); err != nil {
-						h.log.Error(err)
-					}
-					relayed = true
+			for _, c := range h.sessionsFor(to.String()) {
+				if err = c.Send(out); err != nil {
+					h.clientLog(client).Error(err)
 				}
+				relayed = true
 			}
 
 			if relayed {
+				if err = h.dbClient.StoreMessage(out); err != nil {
+					err = errors.Wrap(err, "dbClient.StoreMessage")
+					return
+				}
+				h.relayToOtherSessions(client, out)
 				break
 			}
 
-			if err = client.Error(types.NotFound, ""); err != nil {
-				err = errors.Wrap(err, "client.Error")
+			// Queue messages for registered users that are offline.
+			var recipient *types.User
+			recipient, err = h.dbClient.GetUserData(to.String())
+			if err != nil && err != types.NotInDB {
+				err = errors.Wrap(err, "dbClient.GetUserData")
+				return
+			}
+			if recipient == nil || recipient.Type == guest || h.config.OfflineQueueLimit <= 0 {
+				h.releaseAttachments(out)
+				if err = client.Error(types.NotFound, ""); err != nil {
+					err = errors.Wrap(err, "client.Error")
+				}
+				return
+			}
+
+			err = h.dbClient.QueueMessage(to.String(), out)
+			if err == db.ErrQueueFull {
+				h.releaseAttachments(out)
+				if err = client.Error(types.TooManyRequests, "recipient offline, their message queue is full"); err != nil {
+					err = errors.Wrap(err, "client.Error")
+				}
+				return
+			}
+			if err != nil {
+				err = errors.Wrap(err, "dbClient.QueueMessage")
+				return
+			}
+			if err = h.dbClient.StoreMessage(out); err != nil {
+				err = errors.Wrap(err, "dbClient.StoreMessage")
+				return
+			}
+			h.relayToOtherSessions(client, out)
+
+			// Accepted rather than OK tells the sender it was queued.
+			if err = h.sendMessageAlert(client, types.Accepted, "recipient offline, message queued", out.ID); err != nil {
+				err = errors.Wrap(err, "sendMessageAlert")
 			}
 
 			return
 		}
 
 		// Send a response back saying the message was sent.
-		if err = client.Alert(types.OK, ""); err != nil {
-			err = errors.Wrap(err, "client.Alert")
+		if err = h.sendMessageAlert(client, types.OK, "", out.ID); err != nil {
+			err = errors.Wrap(err, "sendMessageAlert")
 		}
 
 		break
 	// Join messages should include both a group and a room name.
-	case message.Action == "join":
+	case *types.JoinPayload:
 		var (
 			group *types.Group
 			room  *types.Room
 		)
 
-		if !h.groupHandler.IsRoomName(message.Room) {
+		if !h.groupHandler.IsRoomName(p.Room) {
 			if err = client.Error(types.BadRequestOrObject, "room names should start with '#'"); err != nil {
 				err = errors.Wrap(err, "client.Error")
 			}
 			return
 		}
 
-		if !strings.Contains(message.Room, "/") {
+		if !strings.Contains(p.Room, "/") {
 			if err = client.Error(types.BadRequestOrObject, "room names should be type of 'group/room'"); err != nil {
 				err = errors.Wrap(err, "client.Error")
 			}
 			return
 		}
-		slice := strings.Split(message.Room, "/")
+		slice := strings.Split(p.Room, "/")
 		if len(slice) != 2 {
 			if err = client.Error(types.BadRequestOrObject, "room names should be type of 'group/room'"); err != nil {
 				err = errors.Wrap(err, "client.Error")
@@ -265,42 +525,66 @@ func (h *handler) parseMessage(client *types.Client, rawmsg []byte) (banScore in
 				return
 			}
 			room.Users = make(map[string]*types.User)
+			room.Creator = client.User.ID.String()
+		}
+
+		// Joining a room twice is harmless but isn't announced again.
+		if _, ok := room.Users[client.User.ID.String()]; ok {
+			if err = h.sendJoinAlert(client, room); err != nil {
+				err = errors.Wrap(err, "sendJoinAlert")
+			}
+			return
 		}
 
 		room.Users[client.User.ID.String()] = client.User
+		h.addRoom(client.User, room.Group+"/"+room.Title)
 
-		// Update the room data for the database.
+		// Update the room and user data for the database.
 		if err = h.groupHandler.WriteRoomData(room); err != nil {
 			err = errors.Wrap(err, "WriteRoomData")
+			return
+		}
+		if err = h.dbClient.WriteUserData(client.User); err != nil {
+			err = errors.Wrap(err, "dbClient.WriteUserData")
+			return
 		}
 
-		// Send a response back confirming we joined the room..
-		if err = client.Alert(types.OK, ""); err != nil {
-			err = errors.Wrap(err, "client.Alert")
+		// Nothing sent before joining counts as unread.
+		if h.config.MessageStore {
+			if _, err = h.dbClient.SetReadMarker(client.User.ID.String(), room.Group+"/"+room.Title, ""); err != nil {
+				err = errors.Wrap(err, "dbClient.SetReadMarker")
+				return
+			}
+		}
+
+		h.sendRoomEvent(room, "join", client.User, "")
+
+		// Send a response back confirming we joined the room with its topic.
+		if err = h.sendJoinAlert(client, room); err != nil {
+			err = errors.Wrap(err, "sendJoinAlert")
 		}
 
 		break
-	case message.Action == "leave":
-	case message.Action == "part":
+	case *types.PartPayload:
 		var (
 			group *types.Group
 			room  *types.Room
 		)
 
-		if !h.groupHandler.IsRoomName(message.Room) {
+		if !h.groupHandler.IsRoomName(p.Room) {
 			if err = client.Error(types.BadRequestOrObject, "room names should start with '#'"); err != nil {
 				err = errors.Wrap(err, "client.Error")
 			}
 			return
 		}
 
-		if !strings.Contains(message.Room, "/") {
+		if !strings.Contains(p.Room, "/") {
 			if err = client.Error(types.BadRequestOrObject, "room names should be type of 'group/room'"); err != nil {
 				err = errors.Wrap(err, "client.Error")
 			}
 			return
 		}
-		slice := strings.Split(message.Room, "/")
+		slice := strings.Split(p.Room, "/")
 		group, err = h.groupHandler.GetGroup(slice[0])
 		if err != nil {
 			err = errors.Wrap(err, "GetGroup")
@@ -342,11 +626,19 @@ func (h *handler) parseMessage(client *types.Client, rawmsg []byte) (banScore in
 		}
 
 		delete(room.Users, client.User.ID.String())
+		h.removeRoom(client.User, room.Group+"/"+room.Title)
 
-		// Update the room data for the database.
+		// Update the room and user data for the database.
 		if err = h.groupHandler.WriteRoomData(room); err != nil {
 			err = errors.Wrap(err, "WriteRoomData")
+			return
 		}
+		if err = h.dbClient.WriteUserData(client.User); err != nil {
+			err = errors.Wrap(err, "dbClient.WriteUserData")
+			return
+		}
+
+		h.sendRoomEvent(room, "part", client.User, p.Reason)
 
 		// Send a response back confirming we left the room..
 		if err = client.Alert(types.OK, ""); err != nil {
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"time"
+
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("relaying messages", func() {
+	var ts *testServer
+
+	BeforeEach(func() {
+		ts = newTestServer(nil)
+	})
+	AfterEach(func() {
+		ts.close()
+	})
+
+	// sent waits for the alert telling the ID of a message.
+	sent := func(p *peer, id string) string {
+		alert := p.reply(id)
+		Expect(alert["message_id"]).ToNot(BeEmpty())
+		return alert["message_id"].(string)
+	}
+
+	It("relays what the server built instead of what the client sent", func() {
+		kirk, spock := ts.user("relaykirk"), ts.user("relayspock")
+		sender, recipient := ts.login(kirk), ts.login(spock)
+		defer sender.close()
+		defer recipient.close()
+
+		sender.send(map[string]interface{}{
+			"action":     "msg",
+			"id":         "1",
+			"to":         spock.ID.String(),
+			"message":    "fascinating",
+			"from":       spock.ID.String(),
+			"message_id": "forged",
+		})
+		id := sent(sender, "1")
+
+		msg := recipient.expectAction("msg")
+		Expect(msg["from"]).To(Equal(kirk.ID.String()))
+		Expect(msg["message_id"]).To(Equal(id))
+		Expect(msg["message"]).To(Equal("fascinating"))
+	})
+
+	It("relays room messages the same way", func() {
+		kirk, spock := ts.user("roomkirk"), ts.user("roomspock")
+		sender, recipient := ts.login(kirk), ts.login(spock)
+		defer sender.close()
+		defer recipient.close()
+		ts.join(sender, "#default/#relay")
+		ts.join(recipient, "#default/#relay")
+
+		sender.send(map[string]interface{}{
+			"action":     "msg",
+			"id":         "1",
+			"to":         "#default/#relay",
+			"message":    "engage",
+			"from":       spock.ID.String(),
+			"message_id": "forged",
+		})
+		id := sent(sender, "1")
+
+		msg := recipient.expectAction("msg")
+		Expect(msg["from"]).To(Equal(kirk.ID.String()))
+		Expect(msg["message_id"]).To(Equal(id))
+	})
+
+	It("copies direct messages to the sender's other sessions", func() {
+		kirk, spock := ts.user("copykirk"), ts.user("copyspock")
+		sender, other, recipient := ts.login(kirk), ts.login(kirk), ts.login(spock)
+		defer sender.close()
+		defer other.close()
+		defer recipient.close()
+
+		sender.send(map[string]interface{}{"action": "msg", "id": "1", "to": spock.ID.String(), "message": "hailing"})
+		id := sent(sender, "1")
+
+		msg := other.expectAction("msg")
+		Expect(msg["message_id"]).To(Equal(id))
+		Expect(msg["to"]).To(Equal(spock.ID.String()))
+
+		// The sending session only gets the alert.
+		sender.expectNone(func(obj map[string]interface{}) bool {
+			return obj["action"] == "msg"
+		}, 200*time.Millisecond)
+	})
+})
+
+var _ = Describe("queueing direct messages", func() {
+	var ts *testServer
+
+	BeforeEach(func() {
+		ts = newTestServer(nil)
+	})
+	AfterEach(func() {
+		ts.close()
+	})
+
+	It("tells the sender once the recipient's queue is full", func() {
+		kirk, spock := ts.user("fullkirk"), ts.user("fullspock")
+		sender := ts.login(kirk)
+		defer sender.close()
+
+		sender.send(map[string]interface{}{"action": "msg", "id": "1", "to": spock.ID.String(), "message": "queued"})
+		Expect(sender.reply("1")["response"]).To(Equal(float64(types.Accepted)))
+
+		// Fill the rest of the queue.
+		for dbClient.QueueMessage(spock.ID.String(), types.NewMessage(spock.ID.String(), kirk.ID.String(), "filler")) == nil {
+		}
+
+		sender.send(map[string]interface{}{"action": "msg", "id": "2", "to": spock.ID.String(), "message": "refused"})
+		Expect(sender.reply("2")["response"]).To(Equal(float64(types.TooManyRequests)))
+	})
+
+	It("delivers queued messages as they are at login", func() {
+		kirk, spock := ts.user("queuekirk"), ts.user("queuespock")
+		sender := ts.login(kirk)
+		defer sender.close()
+
+		sender.send(map[string]interface{}{"action": "msg", "id": "1", "to": spock.ID.String(), "message": "classified"})
+		deleted := sender.reply("1")["message_id"]
+		sender.send(map[string]interface{}{"action": "msg", "id": "2", "to": spock.ID.String(), "message": "typo"})
+		edited := sender.reply("2")["message_id"]
+
+		sender.send(map[string]interface{}{"action": "delete", "id": "3", "message_id": deleted})
+		Expect(sender.reply("3")["response"]).To(Equal(float64(types.OK)))
+		sender.send(map[string]interface{}{"action": "edit", "id": "4", "message_id": edited, "message": "fixed"})
+		Expect(sender.reply("4")["response"]).To(Equal(float64(types.OK)))
+
+		recipient := ts.login(spock)
+		defer recipient.close()
+		msg := recipient.expectAction("msg")
+		Expect(msg["message_id"]).To(Equal(edited))
+		Expect(msg["message"]).To(Equal("fixed"))
+		recipient.expectNone(func(obj map[string]interface{}) bool {
+			return obj["action"] == "msg"
+		}, 200*time.Millisecond)
+	})
+})
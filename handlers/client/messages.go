@@ -0,0 +1,340 @@
+package client
+
+import (
+	"time"
+
+	"tiberious/types"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+)
+
+// sendMessageAlert responds to a "msg" with the ID given to the message.
+func (h *handler) sendMessageAlert(client *request, code int, text, id string) error {
+	alert := types.NewMessageAlert(code, text, id)
+	alert.ID = client.RequestID
+
+	if err := client.Reply(alert); err != nil {
+		return errors.Wrap(err, "client.Reply")
+	}
+
+	return nil
+}
+
+/* conversationAccess checks the client may read a conversation, "to" being a
+ * room name or the ID of a direct message peer, returning the room (nil for
+ * direct messages) and the name the conversation is stored under. If ok is
+ * false an error was already sent to the client. */
+func (h *handler) conversationAccess(client *request, to string) (room *types.Room, conv string, ok bool, banScore int, err error) {
+	if h.groupHandler.IsRoomName(to) {
+		room, banScore, err = h.roomAccess(client, to)
+		if err != nil || room == nil {
+			return
+		}
+		return room, types.Conversation(room.Group+"/"+room.Title, ""), true, 0, nil
+	}
+
+	peer := uuid.Parse(to)
+	if peer == nil {
+		if err = client.Error(types.NotFound, ""); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	return nil, types.Conversation(peer.String(), client.User.ID.String()), true, 0, nil
+}
+
+// history sends a page of stored messages of a room or direct conversation.
+func (h *handler) history(client *request, to, before string, limit int) (banScore int, err error) {
+	if !h.config.MessageStore {
+		if err = client.Error(types.NotFound, "message storage is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	room, conv, ok, banScore, err := h.conversationAccess(client, to)
+	if err != nil || !ok {
+		return
+	}
+
+	switch {
+	case limit <= 0:
+		limit = defaultHistoryLimit
+	case limit > maxHistoryLimit:
+		limit = maxHistoryLimit
+	}
+
+	msgs, more, err := h.dbClient.GetMessages(conv, before, limit)
+	if err != nil {
+		err = errors.Wrap(err, "dbClient.GetMessages")
+		return
+	}
+
+	if room != nil {
+		to = room.Group + "/" + room.Title
+	}
+
+	if err = client.Reply(types.NewHistory(to, msgs, more)); err != nil {
+		err = errors.Wrap(err, "client.Reply")
+	}
+
+	return
+}
+
+/* threadParent checks a reply can be threaded under the message with the given
+ * ID, which must be a top level message of the same room. If ok is false an
+ * error was already sent to the client. */
+func (h *handler) threadParent(client *request, room *types.Room, id string) (ok bool, err error) {
+	if !h.config.MessageStore {
+		if err = client.Error(types.NotFound, "message storage is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	parent, err := h.dbClient.GetMessage(id)
+	if err != nil && err != types.NotInDB {
+		err = errors.Wrap(err, "dbClient.GetMessage")
+		return
+	}
+	if parent == nil || parent.To != room.Group+"/"+room.Title {
+		if err = client.Error(types.NotFound, "no such message in this room"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	switch {
+	case parent.Parent != "":
+		if err = client.Error(types.BadRequestOrObject, "replies can't start a thread"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case parent.Deleted:
+		if err = client.Error(types.Gone, "message was deleted"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	return true, nil
+}
+
+// thread sends a page of the replies to a room message.
+func (h *handler) thread(client *request, id, before string, limit int) (banScore int, err error) {
+	if !h.config.MessageStore {
+		if err = client.Error(types.NotFound, "message storage is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	msg, _, banScore, err := h.messageAccess(client, id)
+	if err != nil || msg == nil {
+		return
+	}
+
+	switch {
+	case limit <= 0:
+		limit = defaultHistoryLimit
+	case limit > maxHistoryLimit:
+		limit = maxHistoryLimit
+	}
+
+	msgs, more, err := h.dbClient.GetThread(msg.ID, before, limit)
+	if err != nil {
+		err = errors.Wrap(err, "dbClient.GetThread")
+		return
+	}
+
+	if err = client.Reply(types.NewThread(msg.To, msg.ID, msgs, more)); err != nil {
+		err = errors.Wrap(err, "client.Reply")
+	}
+
+	return
+}
+
+/* messageAccess looks up a stored message checking the client can still see
+ * its conversation, returning the message and its room (nil for direct
+ * messages). If the message is nil an error was already sent to the client. */
+func (h *handler) messageAccess(client *request, id string) (msg *types.Message, room *types.Room, banScore int, err error) {
+	found, err := h.dbClient.GetMessage(id)
+	if err != nil && err != types.NotInDB {
+		err = errors.Wrap(err, "dbClient.GetMessage")
+		return
+	}
+	if found == nil {
+		if err = client.Error(types.NotFound, "no such message"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	to := found.To
+	if !h.groupHandler.IsRoomName(found.To) {
+		switch client.User.ID.String() {
+		case found.From:
+		case found.To:
+			to = found.From
+		default:
+			if err = client.Error(types.NotFound, "no such message"); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return
+		}
+	}
+
+	room, _, ok, banScore, err := h.conversationAccess(client, to)
+	if err != nil || !ok {
+		return
+	}
+
+	return found, room, banScore, nil
+}
+
+// relayToConversation relays to everyone in the conversation of a message.
+func (h *handler) relayToConversation(msg *types.Message, room *types.Room, v interface{}) {
+	if room != nil {
+		h.relayToRoom(room, v)
+		return
+	}
+
+	for _, u := range []string{msg.To, msg.From} {
+		for _, c := range h.sessionsFor(u) {
+			if err := c.Send(v); err != nil {
+				h.log.Error(err)
+			}
+		}
+	}
+}
+
+/* editMessage replaces the body of a stored message, or tombstones it if body
+ * is nil, and tells everyone in the conversation. Only the author or an admin
+ * or moderator may change a message. */
+func (h *handler) editMessage(client *request, id string, body *string) (banScore int, err error) {
+	msg, room, banScore, err := h.messageAccess(client, id)
+	if err != nil || msg == nil {
+		return
+	}
+
+	if msg.From != client.User.ID.String() && !isOperator(client.User) {
+		banScore = 1
+		if err = client.Error(types.Forbidden, "only the author or a moderator may change a message"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if msg.Deleted {
+		if err = client.Error(types.Gone, "message was deleted"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	var (
+		action      = "edit"
+		attachments []string
+	)
+	if body == nil {
+		// Tombstones keep only the ID, sender and time.
+		action = "delete"
+		attachments = msg.Attachments
+		msg.Body = ""
+		msg.Attachments = nil
+		msg.Mentions = nil
+		msg.Deleted = true
+	} else {
+		if *body == "" {
+			if err = client.Error(types.BadRequestOrObject, "empty message, use delete instead"); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return
+		}
+		var ok bool
+		if ok, err = h.checkBody(client, msg.ContentType, *body, false); err != nil || !ok {
+			banScore = 1
+			return
+		}
+		msg.Body = *body
+		msg.Edited = time.Now().Unix()
+	}
+
+	if err = h.dbClient.UpdateMessage(msg); err != nil {
+		err = errors.Wrap(err, "dbClient.UpdateMessage")
+		return
+	}
+	h.deleteAttachments(attachments)
+
+	msg.Action = action
+	go h.relayToConversation(msg, room, msg)
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
+
+// maxEmojiLength limits the bytes in a reaction, enough for joined sequences.
+const maxEmojiLength = 32
+
+/* react adds or removes the clients emoji reaction on a stored message and
+ * tells everyone in the conversation the new count for that emoji. */
+func (h *handler) react(client *request, action, id, emoji string) (banScore int, err error) {
+	if !h.config.MessageStore {
+		if err = client.Error(types.NotFound, "message storage is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if !validEmoji(emoji) {
+		if err = client.Error(types.BadRequestOrObject, "invalid emoji"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	msg, room, banScore, err := h.messageAccess(client, id)
+	if err != nil || msg == nil {
+		return
+	}
+
+	if msg.Deleted {
+		if err = client.Error(types.Gone, "message was deleted"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	var count int
+	if action == "react" {
+		count, err = h.dbClient.AddReaction(msg.ID, emoji, client.User.ID.String())
+		if err != nil {
+			err = errors.Wrap(err, "dbClient.AddReaction")
+			return
+		}
+	} else {
+		count, err = h.dbClient.RemoveReaction(msg.ID, emoji, client.User.ID.String())
+		if err != nil {
+			err = errors.Wrap(err, "dbClient.RemoveReaction")
+			return
+		}
+	}
+
+	go h.relayToConversation(msg, room, types.NewReaction(action, msg, client.User.ID.String(), emoji, count))
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+const maxNickLength = 32
+
+// validNick returns whether a nick only uses letters, digits, '_', '-' and '.'
+// and doesn't exceed maxNickLength.
+func validNick(nick string) bool {
+	if nick == "" || len(nick) > maxNickLength {
+		return false
+	}
+
+	for _, c := range nick {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9':
+		case c == '_' || c == '-' || c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// isReservedNick returns whether a nick is in the configured reserved list.
+func (h *handler) isReservedNick(nick string) bool {
+	for _, r := range h.config.ReservedNames {
+		if strings.EqualFold(nick, r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* guestName allocates a username for a new guest by reserving the prefix with
+ * the next guest number, numbers come from an atomic counter so they're never
+ * reused even when guests disconnect. */
+func (h *handler) guestName(id string) (string, error) {
+	for {
+		n, err := h.dbClient.NextGuestNumber()
+		if err != nil {
+			return "", errors.Wrap(err, "dbClient.NextGuestNumber")
+		}
+
+		name := h.config.GuestPrefix + strconv.FormatInt(n, 10)
+		ok, err := h.dbClient.ReserveUsername(name, id)
+		if err != nil {
+			return "", errors.Wrap(err, "dbClient.ReserveUsername")
+		}
+		if ok {
+			return name, nil
+		}
+	}
+}
+
+// changeNick changes the username of a client and notifies their rooms.
+func (h *handler) changeNick(client *request, nick string) (banScore int, err error) {
+	if !validNick(nick) {
+		if err = client.Error(types.BadRequestOrObject, "nicks may only contain letters, digits, '_', '-' and '.'"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if nick == client.User.Username {
+		if err = client.Alert(types.OK, ""); err != nil {
+			err = errors.Wrap(err, "client.Alert")
+		}
+		return
+	}
+
+	if h.isReservedNick(nick) {
+		if err = client.Error(types.Forbidden, "reserved nick"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	// Guests are kept recognizable by always carrying the guest prefix.
+	isGuestNick := strings.HasPrefix(strings.ToLower(nick), strings.ToLower(h.config.GuestPrefix))
+	if client.User.Type == guest && !isGuestNick {
+		if err = client.Error(types.Forbidden, "guest nicks must start with '"+h.config.GuestPrefix+"'"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+	if client.User.Type != guest && isGuestNick {
+		if err = client.Error(types.Forbidden, "nicks starting with '"+h.config.GuestPrefix+"' are reserved for guests"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	// Don't allow taking the login name of another user either.
+	owner, err := h.dbClient.GetLoginNameOwner(nick)
+	if err != nil {
+		err = errors.Wrap(err, "dbClient.GetLoginNameOwner")
+		return
+	}
+	if owner != "" && owner != client.User.ID.String() {
+		if err = client.Error(types.Conflict, "nick in use"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	ok, err := h.dbClient.ReserveUsername(nick, client.User.ID.String())
+	if err != nil {
+		err = errors.Wrap(err, "dbClient.ReserveUsername")
+		return
+	}
+	if !ok {
+		if err = client.Error(types.Conflict, "nick in use"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	old := client.User.Username
+	client.User.Username = nick
+	if err = h.dbClient.WriteUserData(client.User); err != nil {
+		err = errors.Wrap(err, "dbClient.WriteUserData")
+		return
+	}
+
+	// A change of case keeps the same reservation.
+	if !strings.EqualFold(old, nick) {
+		if err = h.dbClient.ReleaseUsername(old, client.User.ID.String()); err != nil {
+			err = errors.Wrap(err, "dbClient.ReleaseUsername")
+			return
+		}
+	}
+
+	h.clientLog(client).Infof("%s %s changed nick from %s to %s", client.User.Type, client.User.ID.String(), old, nick)
+
+	go h.relayToRooms(client.User.Rooms, types.NewNickChange(client.User.ID.String(), old, nick))
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
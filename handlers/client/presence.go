@@ -0,0 +1,330 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	/* presence tracks every session (connected client) so users connected
+	 * from several devices are only shown offline once the last one leaves
+	 * and only away once every one of them is idle. */
+	presence struct {
+		sync.Mutex
+		sessions map[*types.Client]*session
+		// Status chosen by the user with a "presence" action, by user ID.
+		chosen map[string]string
+		// Last status broadcast for a user, so unchanged states aren't resent.
+		sent map[string]string
+	}
+
+	session struct {
+		active time.Time
+		idle   bool
+	}
+)
+
+func newPresence() *presence {
+	return &presence{
+		sessions: make(map[*types.Client]*session),
+		chosen:   make(map[string]string),
+		sent:     make(map[string]string),
+	}
+}
+
+// status returns the presence of a user across all of their sessions, the
+// caller must hold the lock.
+func (p *presence) status(id string) string {
+	var found, active bool
+	for c, s := range p.sessions {
+		if c.User == nil || c.User.ID.String() != id {
+			continue
+		}
+		found = true
+		if !s.idle {
+			active = true
+		}
+	}
+
+	switch {
+	case !found:
+		return types.PresenceOffline
+	case p.chosen[id] != "":
+		return p.chosen[id]
+	case !active:
+		return types.PresenceAway
+	default:
+		return types.PresenceOnline
+	}
+}
+
+// changed records the current status of a user returning it and whether it
+// differs from what was last broadcast.
+func (p *presence) changed(id string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	status := p.status(id)
+	if p.sent[id] == status {
+		return status, false
+	}
+
+	if status == types.PresenceOffline {
+		delete(p.sent, id)
+		delete(p.chosen, id)
+	} else {
+		p.sent[id] = status
+	}
+
+	return status, true
+}
+
+// sessionsFor returns every connected client of a user.
+func (h *handler) sessionsFor(id string) []*types.Client {
+	h.presence.Lock()
+	defer h.presence.Unlock()
+
+	var ret []*types.Client
+	for c := range h.presence.sessions {
+		if c.User != nil && c.User.ID.String() == id {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret
+}
+
+// addSession starts tracking a client and announces the user if needed.
+func (h *handler) addSession(client *types.Client) {
+	h.presence.Lock()
+	h.presence.sessions[client] = &session{active: time.Now()}
+	h.presence.Unlock()
+
+	h.broadcastPresence(client.User)
+}
+
+// removeSession stops tracking a client, returning true if it was the last
+// session of its user.
+func (h *handler) removeSession(client *types.Client) bool {
+	h.presence.Lock()
+	delete(h.presence.sessions, client)
+	last := client.User == nil || h.presence.status(client.User.ID.String()) == types.PresenceOffline
+	h.presence.Unlock()
+
+	if client.User != nil {
+		h.broadcastPresence(client.User)
+	}
+
+	return last
+}
+
+// touchSession marks a client as active, bringing it back from auto-away.
+func (h *handler) touchSession(client *types.Client) {
+	h.presence.Lock()
+	s, ok := h.presence.sessions[client]
+	if !ok {
+		h.presence.Unlock()
+		return
+	}
+	s.active = time.Now()
+	wasIdle := s.idle
+	s.idle = false
+	h.presence.Unlock()
+
+	if wasIdle {
+		h.broadcastPresence(client.User)
+	}
+}
+
+// autoAway marks sessions idle for longer than config.AutoAway minutes.
+func (h *handler) autoAway() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-time.Duration(h.config.AutoAway) * time.Minute)
+
+		var idle []*types.User
+		h.presence.Lock()
+		for c, s := range h.presence.sessions {
+			if !s.idle && s.active.Before(cutoff) {
+				s.idle = true
+				idle = append(idle, c.User)
+			}
+		}
+		h.presence.Unlock()
+
+		for _, u := range idle {
+			h.broadcastPresence(u)
+		}
+	}
+}
+
+/* presenceAudience returns the sessions of every user sharing a group or room
+ * with the given user, including the users own sessions for their other
+ * devices. Only connected users are told so they're found among the sessions
+ * in memory, instead of loading every group and room they're in. */
+func (h *handler) presenceAudience(user *types.User) []*types.Client {
+	h.presence.Lock()
+	defer h.presence.Unlock()
+
+	id := user.ID.String()
+	joined := make(map[string]bool)
+	for _, g := range user.Groups {
+		joined[g] = true
+	}
+	for _, r := range user.Rooms {
+		joined[r] = true
+	}
+
+	var ret []*types.Client
+	for c := range h.presence.sessions {
+		if c.User == nil {
+			continue
+		}
+		if c.User.ID.String() == id || anyJoined(joined, c.User.Groups) || anyJoined(joined, c.User.Rooms) {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret
+}
+
+/* The groups and rooms of connected users are read by presenceAudience from
+ * other sessions, so they're only changed holding the presence lock. The
+ * slices are replaced rather than changed in place, anyone still holding the
+ * previous one keeps a consistent copy. */
+
+// addGroup adds a group to those of a user.
+func (h *handler) addGroup(user *types.User, name string) {
+	h.presence.Lock()
+	defer h.presence.Unlock()
+
+	user.Groups = append(user.Groups[:len(user.Groups):len(user.Groups)], name)
+}
+
+// addRoom adds a room, named as "group/room", to those of a user.
+func (h *handler) addRoom(user *types.User, name string) {
+	h.presence.Lock()
+	defer h.presence.Unlock()
+
+	user.Rooms = append(user.Rooms[:len(user.Rooms):len(user.Rooms)], name)
+}
+
+// removeRoom removes a room, named as "group/room", from those of a user.
+func (h *handler) removeRoom(user *types.User, name string) {
+	h.presence.Lock()
+	defer h.presence.Unlock()
+
+	rooms := make([]string, 0, len(user.Rooms))
+	for _, r := range user.Rooms {
+		if r != name {
+			rooms = append(rooms, r)
+		}
+	}
+	user.Rooms = rooms
+}
+
+// anyJoined returns whether any of names is in joined.
+func anyJoined(joined map[string]bool, names []string) bool {
+	for _, n := range names {
+		if joined[n] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// broadcastPresence sends the presence of a user to their audience if it
+// changed since it was last sent.
+func (h *handler) broadcastPresence(user *types.User) {
+	if user == nil {
+		return
+	}
+
+	status, changed := h.presence.changed(user.ID.String())
+	if !changed {
+		return
+	}
+
+	presence := types.NewPresence(user.ID.String(), status, user.StatusText)
+
+	for _, c := range h.presenceAudience(user) {
+		if err := c.Send(presence); err != nil {
+			h.log.Error(err)
+		}
+	}
+}
+
+/* handlePresence handles the "presence" action, either setting the clients
+ * own status (online, away or dnd with optional status text) or querying the
+ * presence of another user by ID or username. */
+func (h *handler) handlePresence(client *request, status string, statusText *string, target string) (banScore int, err error) {
+	switch {
+	case target != "":
+		var user *types.User
+		if user, err = h.findUser(target); err != nil {
+			err = errors.Wrap(err, "findUser")
+			return
+		}
+		if user == nil {
+			if err = client.Error(types.NotFound, "no such user"); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return
+		}
+
+		h.presence.Lock()
+		current := h.presence.status(user.ID.String())
+		h.presence.Unlock()
+
+		if err = client.Reply(types.NewPresence(user.ID.String(), current, user.StatusText)); err != nil {
+			err = errors.Wrap(err, "client.Reply")
+		}
+		return
+	case status != types.PresenceOnline && status != types.PresenceAway && status != types.PresenceDND:
+		if err = client.Error(types.BadRequestOrObject, "status should be one of 'online', 'away' or 'dnd'"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case statusText != nil && !validText(*statusText, maxStatusTextLength):
+		if err = client.Error(types.BadRequestOrObject, "invalid status text"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	id := client.User.ID.String()
+	h.presence.Lock()
+	if status == types.PresenceOnline {
+		// Online is the default, auto-away still applies.
+		delete(h.presence.chosen, id)
+	} else {
+		h.presence.chosen[id] = status
+	}
+	h.presence.Unlock()
+
+	if statusText != nil && *statusText != client.User.StatusText {
+		client.User.StatusText = *statusText
+		if client.User.Type != guest {
+			if err = h.dbClient.WriteUserData(client.User); err != nil {
+				err = errors.Wrap(err, "dbClient.WriteUserData")
+				return
+			}
+		}
+		// Force a broadcast so the new text is seen.
+		h.presence.Lock()
+		delete(h.presence.sent, id)
+		h.presence.Unlock()
+	}
+
+	h.broadcastPresence(client.User)
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"fmt"
+
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("presence", func() {
+	var ts *testServer
+
+	BeforeEach(func() {
+		ts = newTestServer(nil)
+	})
+	AfterEach(func() {
+		ts.close()
+	})
+
+	// presenceOf matches presence notifications about a user.
+	presenceOf := func(user *types.User, status string) func(obj map[string]interface{}) bool {
+		return func(obj map[string]interface{}) bool {
+			return obj["action"] == "presence" && obj["user"] == user.ID.String() && obj["status"] == status
+		}
+	}
+
+	It("shows users offline once their last session leaves", func() {
+		kirk, spock := ts.user("presencekirk"), ts.user("presencespock")
+		watcher := ts.login(spock)
+		defer watcher.close()
+
+		first := ts.login(kirk)
+		watcher.expect(presenceOf(kirk, types.PresenceOnline))
+		second := ts.login(kirk)
+		defer second.close()
+
+		first.close()
+		second.send(map[string]interface{}{"action": "presence", "id": "1", "target": kirk.ID.String()})
+		Expect(second.expect(presenceOf(kirk, types.PresenceOnline))).ToNot(BeNil())
+
+		second.close()
+		watcher.expect(presenceOf(kirk, types.PresenceOffline))
+	})
+
+	It("reaches every session while others join and part rooms", func() {
+		kirk, spock := ts.user("roamingkirk"), ts.user("roamingspock")
+		watcher := ts.login(spock)
+		defer watcher.close()
+
+		var sessions []*peer
+		for i := 0; i < 3; i++ {
+			sessions = append(sessions, ts.login(kirk))
+		}
+		defer func() {
+			for _, p := range sessions {
+				p.close()
+			}
+		}()
+		watcher.expect(presenceOf(kirk, types.PresenceOnline))
+
+		// Every session handles its objects in its own goroutine.
+		for i, p := range sessions {
+			room := fmt.Sprintf("#default/#roaming%d", i)
+			for j := 0; j < 10; j++ {
+				p.send(map[string]interface{}{"action": "join", "room": room})
+				p.send(map[string]interface{}{"action": "part", "room": room})
+			}
+		}
+
+		for _, status := range []string{types.PresenceAway, types.PresenceOnline, types.PresenceAway, types.PresenceDND} {
+			watcher.send(map[string]interface{}{"action": "presence", "id": status, "status": status})
+			watcher.reply(status)
+		}
+
+		for _, p := range sessions {
+			p.expect(presenceOf(spock, types.PresenceDND))
+		}
+	})
+})
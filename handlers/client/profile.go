@@ -0,0 +1,151 @@
+package client
+
+import (
+	"net/url"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"tiberious/types"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxStatusTextLength  = 140
+	maxAvatarURLLength   = 2048
+)
+
+/* findUser returns a user by either ID or username, or nil if there's none.
+ * Login names are credentials so they're never looked up for other users. */
+func (h *handler) findUser(target string) (*types.User, error) {
+	id := target
+	if uuid.Parse(target) == nil {
+		owner, err := h.dbClient.GetUsernameOwner(target)
+		if err != nil {
+			return nil, errors.Wrap(err, "dbClient.GetUsernameOwner")
+		}
+		if owner == "" {
+			return nil, nil
+		}
+		id = owner
+	}
+
+	// Prefer the connected copy which may have unsaved changes.
+	user, err := h.loadUser(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "loadUser")
+	}
+
+	return user, nil
+}
+
+// whois sends the public view of a user found by either ID or username.
+func (h *handler) whois(client *request, target string) (banScore int, err error) {
+	user, err := h.findUser(target)
+	if err != nil {
+		err = errors.Wrap(err, "findUser")
+		return
+	}
+
+	if user == nil {
+		if err = client.Error(types.NotFound, "no such user"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if err = client.Reply(types.NewWhois(user)); err != nil {
+		err = errors.Wrap(err, "client.Reply")
+	}
+
+	return
+}
+
+// validText returns whether s is valid UTF-8 of at most max characters without
+// any control characters.
+func validText(s string, max int) bool {
+	if !utf8.ValidString(s) || utf8.RuneCountInString(s) > max {
+		return false
+	}
+
+	for _, c := range s {
+		if unicode.IsControl(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validAvatarURL returns whether s is an absolute http(s) URL.
+func validAvatarURL(s string) bool {
+	if len(s) > maxAvatarURLLength {
+		return false
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// updateProfile changes the profile fields given in a "profile" action, an
+// empty value clears a field.
+func (h *handler) updateProfile(client *request, profile types.Profile) (banScore int, err error) {
+	if !client.Authorized || client.User.Type == guest {
+		if err = client.Error(types.Forbidden, "guest account, please authenticate"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	var reason string
+	switch {
+	case profile.DisplayName != nil && !validText(*profile.DisplayName, maxDisplayNameLength):
+		reason = "invalid display name"
+	case profile.StatusText != nil && !validText(*profile.StatusText, maxStatusTextLength):
+		reason = "invalid status text"
+	case profile.AvatarURL != nil && *profile.AvatarURL != "" && !validAvatarURL(*profile.AvatarURL):
+		reason = "avatar URLs should be absolute http or https URLs"
+	case profile.TimeZone != nil && *profile.TimeZone != "":
+		if _, err2 := time.LoadLocation(*profile.TimeZone); err2 != nil {
+			reason = "unknown time zone"
+		}
+	}
+
+	if reason != "" {
+		if err = client.Error(types.BadRequestOrObject, reason); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if profile.DisplayName != nil {
+		client.User.DisplayName = *profile.DisplayName
+	}
+	if profile.StatusText != nil {
+		client.User.StatusText = *profile.StatusText
+	}
+	if profile.AvatarURL != nil {
+		client.User.AvatarURL = *profile.AvatarURL
+	}
+	if profile.TimeZone != nil {
+		client.User.TimeZone = *profile.TimeZone
+	}
+
+	if err = h.dbClient.WriteUserData(client.User); err != nil {
+		err = errors.Wrap(err, "dbClient.WriteUserData")
+		return
+	}
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
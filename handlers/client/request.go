@@ -0,0 +1,26 @@
+package client
+
+import "tiberious/types"
+
+/* request is a client object being handled, alerts and errors sent in reply
+ * echo its ID. It's only used by the goroutine reading from the client so the
+ * ID never ends up in anything sent meanwhile. */
+type request struct {
+	*types.Client
+	// RequestID is the client supplied ID of the object, if any.
+	RequestID string
+}
+
+// Alert sends an alert with the current timestamp and the request ID.
+func (r *request) Alert(code int, message string) error {
+	alert := types.NewAlert(code, message)
+	alert.ID = r.RequestID
+	return r.Reply(alert)
+}
+
+// Error sends an error with the current timestamp and the request ID.
+func (r *request) Error(code int, message string) error {
+	e := types.NewError(code, message)
+	e.ID = r.RequestID
+	return r.Reply(e)
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("request", func() {
+	var f *fixture
+
+	BeforeEach(func() {
+		f = newFixture()
+	})
+	AfterEach(func() {
+		f.close()
+	})
+
+	It("echoes its ID in errors", func() {
+		Expect(f.request("42").Error(types.NotFound, "no such user")).To(BeNil())
+		Expect(f.readError().ID).To(Equal("42"))
+	})
+
+	It("keeps its ID out of what's sent to the client meanwhile", func() {
+		req := f.request("42")
+		Expect(f.client.Error(types.NotFound, "from elsewhere")).To(BeNil())
+		Expect(f.readError().ID).To(BeEmpty())
+
+		Expect(req.Error(types.NotFound, "reply")).To(BeNil())
+		Expect(f.readError().ID).To(Equal("42"))
+	})
+})
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"time"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxTopicLength       = 256
+	maxDescriptionLength = 1024
+	maxMetaKeyLength     = 32
+	maxMetaValueLength   = 256
+	maxMetaKeys          = 32
+
+	// topicLock is the metadata key that restricts topic changes to operators.
+	topicLock = "topiclock"
+)
+
+// isOperator returns whether a user is an admin or moderator.
+func isOperator(user *types.User) bool {
+	return user.Type == "admin" || user.Type == "moderator"
+}
+
+// canManageRoom returns whether a user may change a rooms settings, that's the
+// rooms creator and any admin or moderator.
+func canManageRoom(user *types.User, room *types.Room) bool {
+	if isOperator(user) {
+		return true
+	}
+
+	return user.Type != guest && room.Creator != "" && room.Creator == user.ID.String()
+}
+
+// sendJoinAlert confirms a join, including the rooms current topic.
+func (h *handler) sendJoinAlert(client *request, room *types.Room) error {
+	alert := types.NewJoinAlert(room)
+	alert.ID = client.RequestID
+
+	if err := client.Reply(alert); err != nil {
+		return errors.Wrap(err, "client.Reply")
+	}
+
+	return nil
+}
+
+/* handleTopic handles the "topic" action, sending the current topic of a room
+ * or, if a topic is given, setting it and notifying every member. Members may
+ * set the topic unless the room has topiclock set in its metadata, in which
+ * case only those allowed to manage the room can. */
+func (h *handler) handleTopic(client *request, name string, topic *string) (banScore int, err error) {
+	room, banScore, err := h.roomAccess(client, name)
+	if err != nil || room == nil {
+		return
+	}
+
+	if topic == nil {
+		if err = client.Reply(types.NewTopic(room)); err != nil {
+			err = errors.Wrap(err, "client.Reply")
+		}
+		return
+	}
+
+	_, member := room.Users[client.User.ID.String()]
+	if !member || (room.Meta[topicLock] == "true" && !canManageRoom(client.User, room)) {
+		banScore = 1
+		if err = client.Error(types.Forbidden, "not allowed to change the topic"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if !validText(*topic, maxTopicLength) {
+		if err = client.Error(types.BadRequestOrObject, "invalid topic"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	room.Topic = *topic
+	room.TopicBy = client.User.ID.String()
+	room.TopicTime = time.Now().Unix()
+	if err = h.groupHandler.WriteRoomData(room); err != nil {
+		err = errors.Wrap(err, "WriteRoomData")
+		return
+	}
+
+	go h.relayToRoom(room, types.NewTopic(room))
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
+
+// roomInfo sends the topic, description, creator and metadata of a room.
+func (h *handler) roomInfo(client *request, name string) (banScore int, err error) {
+	room, banScore, err := h.roomAccess(client, name)
+	if err != nil || room == nil {
+		return
+	}
+
+	if err = client.Reply(types.NewRoomInfo(room)); err != nil {
+		err = errors.Wrap(err, "client.Reply")
+	}
+
+	return
+}
+
+/* editRoom changes the description and metadata of a room, a nil metadata
+ * value removes the key. Only those allowed to manage the room may edit it. */
+func (h *handler) editRoom(client *request, name string, description *string, meta map[string]*string) (banScore int, err error) {
+	room, banScore, err := h.roomAccess(client, name)
+	if err != nil || room == nil {
+		return
+	}
+
+	if !canManageRoom(client.User, room) {
+		banScore = 1
+		if err = client.Error(types.Forbidden, ""); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	var reason string
+	if description != nil && !validText(*description, maxDescriptionLength) {
+		reason = "invalid description"
+	}
+	for k, v := range meta {
+		if k == "" || !validText(k, maxMetaKeyLength) || (v != nil && !validText(*v, maxMetaValueLength)) {
+			reason = "invalid metadata"
+		}
+	}
+
+	if reason != "" {
+		if err = client.Error(types.BadRequestOrObject, reason); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if description != nil {
+		room.Description = *description
+	}
+	if room.Meta == nil {
+		room.Meta = make(map[string]string)
+	}
+	for k, v := range meta {
+		if v == nil {
+			delete(room.Meta, k)
+		} else {
+			room.Meta[k] = *v
+		}
+	}
+
+	if len(room.Meta) > maxMetaKeys {
+		if err = client.Error(types.BadRequestOrObject, "too many metadata keys"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if err = h.groupHandler.WriteRoomData(room); err != nil {
+		err = errors.Wrap(err, "WriteRoomData")
+		return
+	}
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
@@ -0,0 +1,334 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tiberious/auth"
+	"tiberious/blob"
+	"tiberious/db"
+	"tiberious/handlers/group"
+	"tiberious/mailer"
+	"tiberious/settings"
+	"tiberious/types"
+
+	"gopkg.in/redis.v5"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestClient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Client handler tests")
+}
+
+/* fixture is a handler without database along with a client connected over a
+ * websocket, peer is the other end reading what the client is sent. */
+type fixture struct {
+	h      *handler
+	client *types.Client
+	peer   *websocket.Conn
+	server *httptest.Server
+}
+
+func newFixture() *fixture {
+	_, err := settings.Init(true)
+	Expect(err).To(BeNil())
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			panic(err)
+		}
+		conns <- conn
+	}))
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	Expect(err).To(BeNil())
+
+	client := types.NewClient()
+	client.Conn = <-conns
+	client.IP = "127.0.0.1"
+
+	return &fixture{
+		h:      &handler{config: settings.GetConfig(), log: logrus.New()},
+		client: client,
+		peer:   peer,
+		server: server,
+	}
+}
+
+func (f *fixture) close() {
+	f.peer.Close()
+	f.client.Conn.Close()
+	f.server.Close()
+}
+
+// request returns a request of the client with the given ID.
+func (f *fixture) request(id string) *request {
+	return &request{Client: f.client, RequestID: id}
+}
+
+// readError reads the next object sent to the client as an error.
+func (f *fixture) readError() *types.Error {
+	f.peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := f.peer.ReadMessage()
+	Expect(err).To(BeNil())
+
+	ret := new(types.Error)
+	Expect(json.Unmarshal(data, ret)).To(BeNil())
+	return ret
+}
+
+// dbClient is the test database used by testServer.
+var dbClient db.Client
+
+var _ = BeforeSuite(func() {
+	log := logrus.New()
+
+	fmt.Println("Before Suite")
+	defer fmt.Println("Done Before Suite")
+
+	db.TestMode = true
+
+	_, err := settings.Init(true)
+	if err != nil {
+		panic(err)
+	}
+	config := settings.GetConfig()
+	// Test servers store messages, the database must agree.
+	config.MessageStore = true
+
+	reconnect := false
+	dbClient, err = db.NewDB(config, log)
+	if err != nil {
+		panic(err)
+	}
+
+	dbi := config.DatabaseUser
+	for {
+		var (
+			sCmd *redis.StatusCmd
+			iCmd *redis.IntCmd
+		)
+
+		if _, err := dbClient.RedisClient().Pipelined(func(pipe *redis.Pipeline) error {
+			sCmd = pipe.Select(dbi)
+			iCmd = pipe.DbSize()
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+		size, err := iCmd.Result()
+		if err != nil {
+			panic(err)
+		}
+
+		if size > 0 {
+			dbi++
+			reconnect = true
+			continue
+		}
+
+		break
+	}
+
+	if reconnect {
+		// Quit panics with "not implemented" so for now just reassign a new client
+		config.DatabaseUser = dbi
+		dbClient, err = db.NewDB(config, log)
+		if err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println("using database", dbi)
+})
+
+var _ = AfterSuite(func() {
+	if err := dbClient.RedisClient().FlushDb().Err(); err != nil {
+		panic(err)
+	}
+})
+
+/* testServer is a handler backed by the test database, serving clients over
+ * websockets the way the connection handler does. */
+type testServer struct {
+	h      *handler
+	server *httptest.Server
+}
+
+/* newTestServer starts a server without guests, configure is called before
+ * the handler is created to adjust the default settings. */
+func newTestServer(configure func(config *settings.Config)) *testServer {
+	_, err := settings.Init(true)
+	Expect(err).To(BeNil())
+	config := settings.GetConfig()
+	config.AllowGuests = false
+	config.MessageStore = true
+	if configure != nil {
+		configure(config)
+	}
+
+	log := logrus.New()
+	log.Out = GinkgoWriter
+
+	groupHandler, err := group.NewHandler(config, dbClient, log, "#default", "#general")
+	Expect(err).To(BeNil())
+	mail, err := mailer.NewMailer(config, log)
+	Expect(err).To(BeNil())
+	authenticator, err := auth.NewAuthenticator(config, dbClient, log)
+	Expect(err).To(BeNil())
+	blobs, err := blob.NewStore(config, log)
+	Expect(err).To(BeNil())
+
+	h, err := NewHandler(config, dbClient, groupHandler, mail, authenticator, blobs, make(map[string]*types.Client), log)
+	Expect(err).To(BeNil())
+
+	ts := &testServer{h: h.(*handler)}
+	ts.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			panic(err)
+		}
+		go ts.h.HandleConnection(conn)
+	}))
+
+	return ts
+}
+
+func (ts *testServer) close() {
+	ts.server.Close()
+}
+
+/* user stores a new member of #default who logs in with its username and
+ * "enterprise". */
+func (ts *testServer) user(name string) *types.User {
+	id, err := dbClient.GetUniqueID()
+	Expect(err).To(BeNil())
+
+	user := &types.User{ID: id, Type: "user", Username: name, LoginName: name, Groups: []string{"#default"}}
+	user.SetPassword("enterprise")
+	Expect(dbClient.WriteUserData(user)).To(BeNil())
+
+	// The groups of a user are written in the background.
+	Eventually(func() []string {
+		stored, err := dbClient.GetUserData(id.String())
+		Expect(err).To(BeNil())
+		return stored.Groups
+	}).Should(HaveLen(1))
+
+	return user
+}
+
+// connect opens a new session, it has to log in before doing anything else.
+func (ts *testServer) connect() *peer {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.server.URL, "http"), nil)
+	Expect(err).To(BeNil())
+
+	p := &peer{conn: conn}
+	p.expect(func(obj map[string]interface{}) bool {
+		return obj["response"] == float64(types.OK)
+	})
+	return p
+}
+
+// login opens a new session of a user stored with ts.user.
+func (ts *testServer) login(user *types.User) *peer {
+	p := ts.connect()
+	p.send(map[string]interface{}{
+		"action": "authenticate",
+		"id":     "login",
+		"user":   map[string]string{"account_name": user.LoginName, "password": "enterprise"},
+	})
+	Expect(p.reply("login")["response"]).To(Equal(float64(types.OK)))
+
+	p.user = user
+	return p
+}
+
+// join joins a room and waits until the database lists the user in it.
+func (ts *testServer) join(p *peer, name string) {
+	p.send(map[string]interface{}{"action": "join", "id": "join", "room": name})
+	Expect(p.reply("join")).ToNot(HaveKey("error"))
+
+	slice := strings.Split(name, "/")
+	Eventually(func() map[string]*types.User {
+		room, err := dbClient.GetRoomData(slice[0], slice[1])
+		Expect(err).To(BeNil())
+		return room.Users
+	}).Should(HaveKey(p.user.ID.String()))
+}
+
+// peer is a session connected to a testServer, as user once logged in.
+type peer struct {
+	conn *websocket.Conn
+	user *types.User
+}
+
+// send writes an object, setting its time unless given.
+func (p *peer) send(obj map[string]interface{}) {
+	if _, ok := obj["time"]; !ok {
+		obj["time"] = time.Now().Unix()
+	}
+	Expect(p.conn.WriteJSON(obj)).To(BeNil())
+}
+
+// next reads the next object sent to the session.
+func (p *peer) next() map[string]interface{} {
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	var obj map[string]interface{}
+	Expect(p.conn.ReadJSON(&obj)).To(BeNil())
+	return obj
+}
+
+// expect skips objects until one matches, returning it.
+func (p *peer) expect(match func(obj map[string]interface{}) bool) map[string]interface{} {
+	for {
+		if obj := p.next(); match(obj) {
+			return obj
+		}
+	}
+}
+
+// reply skips objects until the alert or error with a request ID arrives.
+func (p *peer) reply(id string) map[string]interface{} {
+	return p.expect(func(obj map[string]interface{}) bool {
+		return obj["id"] == id
+	})
+}
+
+// expectAction skips objects until one with the given action arrives.
+func (p *peer) expectAction(action string) map[string]interface{} {
+	return p.expect(func(obj map[string]interface{}) bool {
+		return obj["action"] == action
+	})
+}
+
+/* expectNone makes sure nothing matching arrives for a while, the peer can't
+ * be read from afterwards. */
+func (p *peer) expectNone(match func(obj map[string]interface{}) bool, wait time.Duration) {
+	p.conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		var obj map[string]interface{}
+		if err := p.conn.ReadJSON(&obj); err != nil {
+			Expect(err.(net.Error).Timeout()).To(BeTrue())
+			return
+		}
+		Expect(match(obj)).To(BeFalse())
+	}
+}
+
+func (p *peer) close() {
+	p.conn.Close()
+}
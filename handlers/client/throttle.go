@@ -0,0 +1,46 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// throttleSize bounds the keys a throttle remembers, the oldest go first.
+const throttleSize = 1024
+
+/* throttle lets a key through at most once per interval, it's kept in memory
+ * as losing it on a restart only resets the interval. Keys are remembered in
+ * the order they passed so expired ones are dropped from the front. */
+type throttle struct {
+	sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+	order    []string
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// allow returns whether a key may pass now, recording it if so.
+func (t *throttle) allow(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	for len(t.order) > 0 && (now.Sub(t.last[t.order[0]]) >= t.interval || len(t.order) >= throttleSize) {
+		delete(t.last, t.order[0])
+		t.order = t.order[1:]
+	}
+
+	if _, ok := t.last[key]; ok {
+		return false
+	}
+	t.last[key] = now
+	t.order = append(t.order, key)
+
+	return true
+}
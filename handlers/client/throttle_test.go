@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("throttle", func() {
+	It("lets keys through once per interval", func() {
+		t := newThrottle(50 * time.Millisecond)
+		Expect(t.allow("a")).To(BeTrue())
+		Expect(t.allow("a")).To(BeFalse())
+		Expect(t.allow("b")).To(BeTrue())
+
+		time.Sleep(60 * time.Millisecond)
+		Expect(t.allow("a")).To(BeTrue())
+		Expect(t.last).To(HaveLen(1))
+	})
+
+	It("forgets the oldest keys when full", func() {
+		t := newThrottle(time.Hour)
+		for i := 0; i < throttleSize*2; i++ {
+			Expect(t.allow(fmt.Sprint(i))).To(BeTrue())
+		}
+		Expect(t.last).To(HaveLen(throttleSize))
+		Expect(t.order).To(HaveLen(throttleSize))
+
+		Expect(t.allow(fmt.Sprint(throttleSize * 2))).To(BeTrue())
+		Expect(t.allow(fmt.Sprint(throttleSize*2 - 1))).To(BeFalse())
+		Expect(t.allow("0")).To(BeTrue())
+	})
+})
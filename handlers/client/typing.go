@@ -0,0 +1,155 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"tiberious/types"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Repeated typing notifications within typingThrottle aren't relayed.
+	typingThrottle = 3 * time.Second
+	// Indicators are cleared if they aren't refreshed within typingExpire.
+	typingExpire = 6 * time.Second
+)
+
+type (
+	/* typingState tracks active typing indicators by sender and destination,
+	 * throttle and expire default to typingThrottle and typingExpire. */
+	typingState struct {
+		sync.Mutex
+		active   map[string]*indicator
+		throttle time.Duration
+		expire   time.Duration
+	}
+
+	indicator struct {
+		sent  time.Time
+		timer *time.Timer
+	}
+)
+
+func newTypingState() *typingState {
+	return &typingState{
+		active:   make(map[string]*indicator),
+		throttle: typingThrottle,
+		expire:   typingExpire,
+	}
+}
+
+/* handleTyping relays a "typing" action to the members of a room or a direct
+ * message peer. Nothing is sent back on success to keep typing lightweight,
+ * errors are reported as usual. */
+func (h *handler) handleTyping(client *request, to string, typing *bool) (banScore int, err error) {
+	// Typing defaults to true, clients send false when they stop.
+	started := typing == nil || *typing
+
+	var (
+		dest       string
+		recipients []string
+	)
+	if h.groupHandler.IsRoomName(to) {
+		var room *types.Room
+		room, banScore, err = h.roomAccess(client, to)
+		if err != nil || room == nil {
+			return
+		}
+
+		dest = room.Group + "/" + room.Title
+		for k := range room.Users {
+			recipients = append(recipients, k)
+		}
+	} else {
+		peer := uuid.Parse(to)
+		if peer == nil {
+			if err = client.Error(types.NotFound, ""); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return
+		}
+
+		dest = peer.String()
+		recipients = []string{dest}
+	}
+
+	from := client.User.ID.String()
+	key := from + " " + dest
+
+	h.typing.Lock()
+	ind, ok := h.typing.active[key]
+	switch {
+	case started && ok && time.Since(ind.sent) < h.typing.throttle:
+		// Keep the indicator alive without relaying anything.
+		ind.timer.Reset(h.typing.expire)
+		h.typing.Unlock()
+		return
+	case started && ok:
+		ind.sent = time.Now()
+		ind.timer.Reset(h.typing.expire)
+	case started:
+		ind = &indicator{sent: time.Now()}
+		ind.timer = time.AfterFunc(h.typing.expire, func() {
+			h.expireTyping(key, ind, recipients)
+		})
+		h.typing.active[key] = ind
+	case ok:
+		ind.timer.Stop()
+		delete(h.typing.active, key)
+	default:
+		// Nothing to stop.
+		h.typing.Unlock()
+		return
+	}
+	h.typing.Unlock()
+
+	h.relayTyping(types.NewTyping(dest, from, started, h.typing.expire), recipients)
+	return
+}
+
+// clearTyping silently drops an indicator, used once a message is sent since
+// clients clear the indicator when the message arrives.
+func (h *handler) clearTyping(from, dest string) {
+	h.typing.Lock()
+	defer h.typing.Unlock()
+
+	if ind, ok := h.typing.active[from+" "+dest]; ok {
+		ind.timer.Stop()
+		delete(h.typing.active, from+" "+dest)
+	}
+}
+
+// expireTyping clears an indicator that wasn't refreshed in time.
+func (h *handler) expireTyping(key string, ind *indicator, recipients []string) {
+	h.typing.Lock()
+	// The indicator may have been stopped or replaced in the meantime.
+	current := h.typing.active[key] == ind
+	if current {
+		delete(h.typing.active, key)
+	}
+	h.typing.Unlock()
+
+	if current {
+		slice := strings.SplitN(key, " ", 2)
+		h.relayTyping(types.NewTyping(slice[1], slice[0], false, 0), recipients)
+	}
+}
+
+// relayTyping sends a typing notification to every session of the recipients
+// other than the sender.
+func (h *handler) relayTyping(t *types.Typing, recipients []string) {
+	for _, id := range recipients {
+		if id == t.From {
+			continue
+		}
+		for _, c := range h.sessionsFor(id) {
+			if err := c.Send(t); err != nil {
+				h.log.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"time"
+
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("typing indicators", func() {
+	const (
+		throttle = 200 * time.Millisecond
+		expire   = 400 * time.Millisecond
+	)
+
+	var ts *testServer
+
+	BeforeEach(func() {
+		ts = newTestServer(nil)
+		ts.h.typing.throttle = throttle
+		ts.h.typing.expire = expire
+	})
+	AfterEach(func() {
+		ts.close()
+	})
+
+	// typingOrMsg matches what a direct message peer sees of the sender.
+	typingOrMsg := func(obj map[string]interface{}) bool {
+		return obj["action"] == "typing" || obj["action"] == "msg"
+	}
+
+	typing := func(p *peer, to *types.User) {
+		p.send(map[string]interface{}{"action": "typing", "to": to.ID.String()})
+	}
+
+	message := func(p *peer, to *types.User) {
+		p.send(map[string]interface{}{"action": "msg", "to": to.ID.String(), "message": "done"})
+	}
+
+	It("relays repeated notifications once per throttle interval", func() {
+		kirk, spock := ts.user("throttlekirk"), ts.user("throttlespock")
+		typist, recipient := ts.login(kirk), ts.login(spock)
+		defer typist.close()
+		defer recipient.close()
+
+		typing(typist, spock)
+		Expect(recipient.expect(typingOrMsg)["typing"]).To(BeTrue())
+
+		typing(typist, spock)
+		time.Sleep(throttle)
+		typing(typist, spock)
+		Expect(recipient.expect(typingOrMsg)["typing"]).To(BeTrue())
+
+		// Only the refresh after the interval was relayed.
+		message(typist, spock)
+		Expect(recipient.expect(typingOrMsg)["action"]).To(Equal("msg"))
+	})
+
+	It("clears indicators that aren't refreshed", func() {
+		kirk, spock := ts.user("expirekirk"), ts.user("expirespock")
+		typist, recipient := ts.login(kirk), ts.login(spock)
+		defer typist.close()
+		defer recipient.close()
+
+		start := time.Now()
+		typing(typist, spock)
+		Expect(recipient.expect(typingOrMsg)["typing"]).To(BeTrue())
+
+		stopped := recipient.expect(typingOrMsg)
+		Expect(stopped["typing"]).To(BeFalse())
+		Expect(stopped["from"]).To(Equal(kirk.ID.String()))
+		Expect(time.Since(start)).To(BeNumerically(">=", expire))
+	})
+
+	It("clears indicators silently once the message is sent", func() {
+		kirk, spock := ts.user("sentkirk"), ts.user("sentspock")
+		typist, recipient := ts.login(kirk), ts.login(spock)
+		defer typist.close()
+		defer recipient.close()
+
+		typing(typist, spock)
+		Expect(recipient.expect(typingOrMsg)["typing"]).To(BeTrue())
+
+		message(typist, spock)
+		Expect(recipient.expect(typingOrMsg)["action"]).To(Equal("msg"))
+
+		recipient.expectNone(typingOrMsg, 2*expire)
+	})
+})
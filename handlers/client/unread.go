@@ -0,0 +1,108 @@
+package client
+
+import (
+	"strings"
+
+	"tiberious/types"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// sendReadState sends the unread counts of every conversation of a user.
+func (h *handler) sendReadState(client *request) error {
+	id := client.User.ID.String()
+	convs, err := h.dbClient.ReadConversations(id)
+	if err != nil && err != types.NotInDB {
+		return errors.Wrap(err, "dbClient.ReadConversations")
+	}
+
+	// Rooms come from the user so rooms they left aren't counted.
+	list := append([]string(nil), client.User.Rooms...)
+	for _, c := range convs {
+		if !h.groupHandler.IsRoomName(c) {
+			list = append(list, c)
+		}
+	}
+
+	unread, err := h.dbClient.GetUnread(id, list)
+	if err != nil && err != types.NotInDB {
+		return errors.Wrap(err, "dbClient.GetUnread")
+	}
+
+	// Direct conversations are shown as the ID of the peer.
+	for _, u := range unread {
+		if slice := strings.Split(u.To, ":"); len(slice) == 2 {
+			u.To = slice[0]
+			if u.To == id {
+				u.To = slice[1]
+			}
+		}
+	}
+
+	if err = client.Reply(types.NewReadState(unread)); err != nil {
+		return errors.Wrap(err, "client.Reply")
+	}
+
+	return nil
+}
+
+// readState responds to a "state" action.
+func (h *handler) readState(client *request) (banScore int, err error) {
+	if !h.config.MessageStore {
+		if err = client.Error(types.NotFound, "message storage is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if err = h.sendReadState(client); err != nil {
+		err = errors.Wrap(err, "sendReadState")
+	}
+
+	return
+}
+
+/* markRead advances the clients read marker in a room or direct conversation
+ * up to the message with the given ID, or everything if the ID is empty. When
+ * ReadReceipts is enabled direct message peers are told. */
+func (h *handler) markRead(client *request, to, id string) (banScore int, err error) {
+	if !h.config.MessageStore {
+		if err = client.Error(types.NotFound, "message storage is disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	room, conv, ok, banScore, err := h.conversationAccess(client, to)
+	if err != nil || !ok {
+		return
+	}
+
+	ok, err = h.dbClient.SetReadMarker(client.User.ID.String(), conv, id)
+	if err != nil {
+		err = errors.Wrap(err, "dbClient.SetReadMarker")
+		return
+	}
+	if !ok {
+		if err = client.Error(types.NotFound, "no such message"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if room == nil && h.config.ReadReceipts {
+		receipt := types.NewReadReceipt(client.User.ID.String(), id)
+		for _, c := range h.sessionsFor(uuid.Parse(to).String()) {
+			if err := c.Send(receipt); err != nil {
+				h.clientLog(client).Error(err)
+			}
+		}
+	}
+
+	if err = client.Alert(types.OK, ""); err != nil {
+		err = errors.Wrap(err, "client.Alert")
+	}
+
+	return
+}
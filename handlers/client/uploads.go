@@ -0,0 +1,439 @@
+package client
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"tiberious/blob"
+	"tiberious/db"
+	"tiberious/types"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	downloadToken = "download"
+	// expiredUpload claims uploads that are being deleted.
+	expiredUpload = "expired"
+
+	// maxChunkSize limits the decoded data of a single "chunk".
+	maxChunkSize = 64 * 1024
+	// maxUploads limits the uploads a single session may have in progress.
+	maxUploads = 4
+	// maxAttachments limits the attachments of a single message.
+	maxAttachments  = 10
+	maxFileNameSize = 255
+)
+
+type (
+	// uploadState tracks the uploads in progress by attachment ID.
+	uploadState struct {
+		sync.Mutex
+		active map[string]*upload
+	}
+
+	upload struct {
+		client   *types.Client
+		att      *types.Attachment
+		w        io.WriteCloser
+		received int64
+	}
+)
+
+func newUploadState() *uploadState {
+	return &uploadState{active: make(map[string]*upload)}
+}
+
+// uploadTypeAllowed checks a content type against UploadTypes.
+func (h *handler) uploadTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range h.config.UploadTypes {
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+		if mediaType == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendUploadAlert responds to "upload" and "chunk" actions.
+func (h *handler) sendUploadAlert(client *request, code int, id string, received int64) error {
+	alert := types.NewUploadAlert(code, id, received)
+	alert.ID = client.RequestID
+
+	if err := client.Reply(alert); err != nil {
+		return errors.Wrap(err, "client.Reply")
+	}
+
+	return nil
+}
+
+/* startUpload starts an upload of a file for a room or direct message peer,
+ * the data is then sent in "chunk" actions. */
+func (h *handler) startUpload(client *request, to, name, contentType string, size int64) (banScore int, err error) {
+	switch {
+	case h.config.BlobStore == "":
+		if err = client.Error(types.NotFound, "uploads are disabled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case client.User.Type == guest:
+		if err = client.Error(types.Forbidden, "guest account, please authenticate"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case name == "" || len(name) > maxFileNameSize || strings.ContainsAny(name, "/\\\r\n"):
+		if err = client.Error(types.BadRequestOrObject, "invalid file name"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case size <= 0 || size > int64(h.config.MaxUploadSize)*1024:
+		if err = client.Error(types.BadRequestOrObject, "file too large or empty"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	case !h.uploadTypeAllowed(contentType):
+		if err = client.Error(types.BadRequestOrObject, "content type not allowed"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	room, _, ok, banScore, err := h.conversationAccess(client, to)
+	if err != nil || !ok {
+		return
+	}
+	// Store the canonical name that checkAttachments compares against.
+	if room != nil {
+		to = room.Group + "/" + room.Title
+	} else {
+		to = uuid.Parse(to).String()
+	}
+
+	h.uploads.Lock()
+	var count = 0
+	for _, u := range h.uploads.active {
+		if u.client == client.Client {
+			count++
+		}
+	}
+	h.uploads.Unlock()
+	if count >= maxUploads {
+		if err = client.Error(types.Conflict, "too many uploads in progress"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	att := types.NewAttachment(to, client.User.ID.String(), name, contentType, size)
+	w, err := h.blobs.Create(att.ID)
+	if err != nil {
+		err = errors.Wrap(err, "blobs.Create")
+		return
+	}
+	if err = h.dbClient.WriteAttachment(att); err != nil {
+		w.Close()
+		err = errors.Wrap(err, "dbClient.WriteAttachment")
+		return
+	}
+
+	h.uploads.Lock()
+	h.uploads.active[att.ID] = &upload{client: client.Client, att: att, w: w}
+	h.uploads.Unlock()
+
+	if err = h.sendUploadAlert(client, types.Accepted, att.ID, 0); err != nil {
+		err = errors.Wrap(err, "sendUploadAlert")
+	}
+
+	return
+}
+
+/* uploadChunk appends data to an upload of the same session, the upload is
+ * complete once the announced size was received. */
+func (h *handler) uploadChunk(client *request, id string, data []byte) (banScore int, err error) {
+	h.uploads.Lock()
+	u, ok := h.uploads.active[id]
+	h.uploads.Unlock()
+	if !ok || u.client != client.Client {
+		if err = client.Error(types.NotFound, "no such upload"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if len(data) == 0 || len(data) > maxChunkSize || u.received+int64(len(data)) > u.att.Size {
+		banScore = 1
+		h.abortUpload(u)
+		if err = client.Error(types.BadRequestOrObject, "invalid chunk, upload cancelled"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	if _, err = u.w.Write(data); err != nil {
+		h.abortUpload(u)
+		err = errors.Wrap(err, "w.Write")
+		return
+	}
+	u.received += int64(len(data))
+
+	if u.received < u.att.Size {
+		if err = h.sendUploadAlert(client, types.OK, id, u.received); err != nil {
+			err = errors.Wrap(err, "sendUploadAlert")
+		}
+		return
+	}
+
+	h.uploads.Lock()
+	delete(h.uploads.active, id)
+	h.uploads.Unlock()
+
+	if err = u.w.Close(); err != nil {
+		h.abortUpload(u)
+		err = errors.Wrap(err, "w.Close")
+		return
+	}
+	u.att.Complete = true
+	if err = h.dbClient.WriteAttachment(u.att); err != nil {
+		err = errors.Wrap(err, "dbClient.WriteAttachment")
+		return
+	}
+
+	if err = h.sendUploadAlert(client, types.Created, id, u.received); err != nil {
+		err = errors.Wrap(err, "sendUploadAlert")
+	}
+
+	return
+}
+
+// abortUpload drops an upload in progress along with anything stored.
+func (h *handler) abortUpload(u *upload) {
+	h.uploads.Lock()
+	delete(h.uploads.active, u.att.ID)
+	h.uploads.Unlock()
+
+	if err := u.w.Close(); err != nil {
+		h.log.Error(errors.Wrap(err, "w.Close"))
+	}
+	if err := h.blobs.Delete(u.att.ID); err != nil {
+		h.log.Error(errors.Wrap(err, "blobs.Delete"))
+	}
+	if err := h.dbClient.DeleteAttachment(u.att.ID); err != nil {
+		h.log.Error(errors.Wrap(err, "dbClient.DeleteAttachment"))
+	}
+}
+
+// abortUploads drops every upload in progress of a disconnected session.
+func (h *handler) abortUploads(client *types.Client) {
+	var list []*upload
+	h.uploads.Lock()
+	for _, u := range h.uploads.active {
+		if u.client == client {
+			list = append(list, u)
+		}
+	}
+	h.uploads.Unlock()
+
+	for _, u := range list {
+		h.abortUpload(u)
+	}
+}
+
+// deleteAttachments deletes the attachments of a deleted message or upload.
+func (h *handler) deleteAttachments(ids []string) {
+	for _, id := range ids {
+		if err := h.blobs.Delete(id); err != nil {
+			h.log.Error(errors.Wrap(err, "blobs.Delete"))
+		}
+		if err := h.dbClient.DeleteAttachment(id); err != nil {
+			h.log.Error(errors.Wrap(err, "dbClient.DeleteAttachment"))
+		}
+	}
+}
+
+/* checkAttachments makes sure every attachment of a message is a completed
+ * upload of the sender for the same destination. If ok is false an error was
+ * already sent to the client. */
+func (h *handler) checkAttachments(client *request, to string, ids []string) (ok bool, err error) {
+	if len(ids) > maxAttachments {
+		if err = client.Error(types.BadRequestOrObject, "too many attachments"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	for _, id := range ids {
+		var att *types.Attachment
+		att, err = h.dbClient.GetAttachment(id)
+		if err != nil && err != types.NotInDB {
+			err = errors.Wrap(err, "dbClient.GetAttachment")
+			return
+		}
+		if att == nil || !att.Complete || att.From != client.User.ID.String() || att.To != to {
+			if err = client.Error(types.NotFound, "no such attachment"); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return
+		}
+		if att.MessageID != "" {
+			if err = client.Error(types.Conflict, "attachment was already sent"); err != nil {
+				err = errors.Wrap(err, "client.Error")
+			}
+			return
+		}
+	}
+
+	return true, nil
+}
+
+/* claimAttachments marks the attachments of a message as sent with it, so they
+ * can't be shared with another message that could delete them. If ok is false
+ * an error was already sent to the client. */
+func (h *handler) claimAttachments(client *request, msg *types.Message) (ok bool, err error) {
+	err = h.dbClient.ClaimAttachments(msg.Attachments, msg.ID)
+	if err == db.ErrAttachmentUsed {
+		if err = client.Error(types.Conflict, "attachment was already sent"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+	if err != nil {
+		err = errors.Wrap(err, "dbClient.ClaimAttachments")
+		return
+	}
+
+	return true, nil
+}
+
+// releaseAttachments frees the attachments of a message that wasn't sent.
+func (h *handler) releaseAttachments(msg *types.Message) {
+	if err := h.dbClient.ReleaseAttachments(msg.Attachments, msg.ID); err != nil {
+		h.log.Error(errors.Wrap(err, "dbClient.ReleaseAttachments"))
+	}
+}
+
+/* expireUploads deletes uploads that weren't sent with a message within
+ * config.UploadExpire minutes. */
+func (h *handler) expireUploads() {
+	for range time.Tick(time.Minute) {
+		h.deleteUnusedUploads(time.Now().Add(-time.Duration(h.config.UploadExpire) * time.Minute))
+	}
+}
+
+// deleteUnusedUploads deletes the uploads started before cutoff that weren't
+// sent with a message and aren't in progress.
+func (h *handler) deleteUnusedUploads(cutoff time.Time) {
+	ids, err := h.dbClient.GetUnusedAttachments(cutoff.Unix())
+	if err != nil {
+		h.log.Error(errors.Wrap(err, "dbClient.GetUnusedAttachments"))
+		return
+	}
+
+	var unused []string
+	for _, id := range ids {
+		h.uploads.Lock()
+		_, active := h.uploads.active[id]
+		h.uploads.Unlock()
+		if active {
+			continue
+		}
+
+		// Claiming them first keeps messages from taking them meanwhile.
+		err = h.dbClient.ClaimAttachments([]string{id}, expiredUpload)
+		if err == db.ErrAttachmentUsed {
+			continue
+		}
+		if err != nil {
+			h.log.Error(errors.Wrap(err, "dbClient.ClaimAttachments"))
+			continue
+		}
+		unused = append(unused, id)
+	}
+
+	h.deleteAttachments(unused)
+}
+
+/* download sends a link to an attachment, only members of the room it was
+ * uploaded for (or both sides of a direct conversation) may download it. */
+func (h *handler) download(client *request, id string) (banScore int, err error) {
+	att, err := h.dbClient.GetAttachment(id)
+	if err != nil && err != types.NotInDB {
+		err = errors.Wrap(err, "dbClient.GetAttachment")
+		return
+	}
+
+	var allowed = false
+	if att != nil && att.Complete {
+		switch {
+		case h.groupHandler.IsRoomName(att.To):
+			var room *types.Room
+			room, banScore, err = h.roomAccess(client, att.To)
+			if err != nil || room == nil {
+				return
+			}
+			allowed = true
+		case client.User.ID.String() == att.From || client.User.ID.String() == att.To:
+			allowed = true
+		}
+	}
+	if !allowed {
+		if err = client.Error(types.NotFound, "no such attachment"); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	token := types.NewToken()
+	expire := time.Duration(h.config.DownloadExpire) * time.Minute
+	if err = h.dbClient.WriteToken(downloadToken, token, att.ID, expire); err != nil {
+		err = errors.Wrap(err, "dbClient.WriteToken")
+		return
+	}
+
+	if err = client.Reply(types.NewDownload(att, h.config.PublicURL+"/attachments/"+token, time.Now().Add(expire).Unix())); err != nil {
+		err = errors.Wrap(err, "client.Reply")
+	}
+
+	return
+}
+
+/* OpenAttachment returns an attachment and its data for a download token, the
+ * attachment is nil if the token is invalid or expired. */
+func (h *handler) OpenAttachment(token string) (*types.Attachment, io.ReadCloser, error) {
+	id, err := h.dbClient.GetToken(downloadToken, token)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "dbClient.GetToken")
+	}
+	if id == "" {
+		return nil, nil, nil
+	}
+
+	att, err := h.dbClient.GetAttachment(id)
+	if err != nil && err != types.NotInDB {
+		return nil, nil, errors.Wrap(err, "dbClient.GetAttachment")
+	}
+	if att == nil {
+		return nil, nil, nil
+	}
+
+	r, err := h.blobs.Open(att.ID)
+	if err == blob.ErrNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "blobs.Open")
+	}
+
+	return att, r, nil
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"tiberious/blob"
+	"tiberious/settings"
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("attachments", func() {
+	var (
+		ts   *testServer
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		path, err = ioutil.TempDir("", "tiberious-uploads")
+		Expect(err).To(BeNil())
+
+		ts = newTestServer(func(config *settings.Config) {
+			config.BlobPath = path
+		})
+	})
+	AfterEach(func() {
+		ts.close()
+		os.RemoveAll(path)
+	})
+
+	// upload sends a file for a user and returns its attachment ID.
+	upload := func(p *peer, to *types.User) string {
+		p.send(map[string]interface{}{"action": "upload", "id": "upload", "to": to.ID.String(), "name": "logs.txt", "size": 4, "content_type": "text/plain"})
+		started := p.reply("upload")
+		Expect(started["response"]).To(Equal(float64(types.Accepted)))
+		id := started["attachment_id"].(string)
+
+		p.send(map[string]interface{}{"action": "chunk", "id": "chunk", "attachment_id": id, "data": []byte("log!")})
+		Expect(p.reply("chunk")["response"]).To(Equal(float64(types.Created)))
+		return id
+	}
+
+	send := func(p *peer, to *types.User, id string, attachments ...string) map[string]interface{} {
+		p.send(map[string]interface{}{"action": "msg", "id": id, "to": to.ID.String(), "message": "see attached", "attachments": attachments})
+		return p.reply(id)
+	}
+
+	It("sends each upload with a single message", func() {
+		kirk, spock := ts.user("attachkirk"), ts.user("attachspock")
+		sender := ts.login(kirk)
+		defer sender.close()
+
+		id := upload(sender, spock)
+		Expect(send(sender, spock, "1", id)["response"]).To(Equal(float64(types.Accepted)))
+		Expect(send(sender, spock, "2", id)["response"]).To(Equal(float64(types.Conflict)))
+
+		// Refusing a message leaves its attachments unused.
+		other := upload(sender, spock)
+		Expect(send(sender, spock, "3", other, id)["response"]).To(Equal(float64(types.Conflict)))
+		Expect(send(sender, spock, "4", other)["response"]).To(Equal(float64(types.Accepted)))
+	})
+
+	It("deletes uploads that are never sent", func() {
+		kirk, spock := ts.user("unusedkirk"), ts.user("unusedspock")
+		sender := ts.login(kirk)
+		defer sender.close()
+
+		unused, sent := upload(sender, spock), upload(sender, spock)
+		Expect(send(sender, spock, "1", sent)["response"]).To(Equal(float64(types.Accepted)))
+
+		ts.h.deleteUnusedUploads(time.Now().Add(time.Minute))
+
+		att, err := dbClient.GetAttachment(unused)
+		Expect(err).To(BeNil())
+		Expect(att).To(BeNil())
+		_, err = ts.h.blobs.Open(unused)
+		Expect(err).To(Equal(blob.ErrNotFound))
+
+		att, err = dbClient.GetAttachment(sent)
+		Expect(err).To(BeNil())
+		Expect(att.MessageID).NotTo(BeEmpty())
+		r, err := ts.h.blobs.Open(sent)
+		Expect(err).To(BeNil())
+		r.Close()
+	})
+})
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxCardTitleLength = 256
+	maxCardTextLength  = 4096
+	maxCardFields      = 25
+	maxCardFieldLength = 1024
+)
+
+// validBodyText returns whether s is valid UTF-8 without control characters
+// other than newlines and tabs.
+func validBodyText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+
+	for _, c := range s {
+		if unicode.IsControl(c) && c != '\n' && c != '\t' {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* validEmoji returns whether s can be a reaction, text of at most
+ * maxEmojiLength bytes without spaces or format characters. Zero width joiners
+ * and tags are allowed as emoji sequences are built with them. */
+func validEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiLength || !validText(s, maxEmojiLength) {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c == '\u200d', c >= 0xe0020 && c <= 0xe007f:
+		case unicode.IsSpace(c), unicode.Is(unicode.Cf, c):
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateCard checks the body of a "card" message.
+func validateCard(body string) error {
+	var card types.Card
+	dec := json.NewDecoder(bytes.NewReader([]byte(body)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&card); err != nil {
+		return errors.New("card messages should be a JSON card object")
+	}
+	if dec.More() {
+		return errors.New("card messages should hold a single JSON object")
+	}
+
+	switch {
+	case card.Title == "" || !validText(card.Title, maxCardTitleLength):
+		return errors.Errorf("cards need a title of at most %d characters", maxCardTitleLength)
+	case utf8.RuneCountInString(card.Text) > maxCardTextLength || !validBodyText(card.Text):
+		return errors.Errorf("card text is limited to %d characters without control characters", maxCardTextLength)
+	case card.URL != "" && !validAvatarURL(card.URL):
+		return errors.New("card URLs should be absolute http or https URLs")
+	case card.ImageURL != "" && !validAvatarURL(card.ImageURL):
+		return errors.New("card image URLs should be absolute http or https URLs")
+	case len(card.Fields) > maxCardFields:
+		return errors.Errorf("cards are limited to %d fields", maxCardFields)
+	}
+
+	for _, f := range card.Fields {
+		if f.Name == "" || !validText(f.Name, maxCardFieldLength) || !validText(f.Value, maxCardFieldLength) {
+			return errors.Errorf("card fields need a name and value of at most %d characters", maxCardFieldLength)
+		}
+	}
+
+	return nil
+}
+
+/* checkBody validates a message body against MaxBodySize and the rules of its
+ * content type. If ok is false a descriptive error was already sent to the
+ * client, empty bodies are only allowed if allowEmpty is set (for messages
+ * with attachments). */
+func (h *handler) checkBody(client *request, contentType, body string, allowEmpty bool) (ok bool, err error) {
+	var (
+		code   = types.BadRequestOrObject
+		reason string
+	)
+	switch {
+	case body == "" && !allowEmpty:
+		reason = "empty message"
+	case h.config.MaxBodySize > 0 && len(body) > h.config.MaxBodySize:
+		code = types.TooLarge
+		reason = fmt.Sprintf("messages are limited to %d bytes", h.config.MaxBodySize)
+	case !validBodyText(body):
+		reason = "messages should be valid UTF-8 without control characters"
+	}
+
+	if reason == "" {
+		switch contentType {
+		case types.ContentPlain, types.ContentMarkdown:
+		case types.ContentCard:
+			if verr := validateCard(body); verr != nil {
+				reason = verr.Error()
+			}
+		default:
+			reason = "content type should be one of plain, markdown or card"
+		}
+	}
+
+	if reason != "" {
+		if err = client.Error(code, reason); err != nil {
+			err = errors.Wrap(err, "client.Error")
+		}
+		return
+	}
+
+	return true, nil
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"strings"
+
+	"tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("validation", func() {
+	DescribeTable("validBodyText",
+		func(s string, valid bool) {
+			Expect(validBodyText(s)).To(Equal(valid))
+		},
+		Entry("empty text", "", true),
+		Entry("plain text", "hello world", true),
+		Entry("newlines and tabs", "one\n\ttwo", true),
+		Entry("unicode", "ünïcode 😀", true),
+		Entry("carriage returns", "one\r\ntwo", false),
+		Entry("NUL", "a\x00b", false),
+		Entry("escape sequences", "\x1b[31mred", false),
+		Entry("DEL", "a\x7fb", false),
+		Entry("C1 controls", "a\u0085b", false),
+		Entry("invalid UTF-8", "a\xffb", false),
+		Entry("truncated UTF-8", "\xe2\x82", false),
+	)
+
+	DescribeTable("validEmoji",
+		func(s string, valid bool) {
+			Expect(validEmoji(s)).To(Equal(valid))
+		},
+		Entry("an emoji", "😀", true),
+		Entry("a variation sequence", "❤️", true),
+		Entry("a joined sequence", "👩\u200d🚀", true),
+		Entry("a tagged flag", "🏴\U000e0067\U000e0062\U000e0073\U000e0063\U000e0074\U000e007f", true),
+		Entry("a shortcode", ":vulcan_salute:", true),
+		Entry("empty text", "", false),
+		Entry("too long", strings.Repeat("😀", maxEmojiLength/4+1), false),
+		Entry("spaces", "😀 😀", false),
+		Entry("no-break spaces", "😀\u00a0", false),
+		Entry("newlines", "😀\n", false),
+		Entry("NUL", "\x00", false),
+		Entry("escape sequences", "\x1b[31m😀", false),
+		Entry("bidi overrides", "\u202e😀", false),
+		Entry("zero width spaces", "\u200b", false),
+		Entry("byte order marks", "\ufeff😀", false),
+		Entry("invalid UTF-8", "\xff", false),
+	)
+
+	DescribeTable("validateCard",
+		func(body string, valid bool) {
+			if valid {
+				Expect(validateCard(body)).To(BeNil())
+			} else {
+				Expect(validateCard(body)).NotTo(BeNil())
+			}
+		},
+		Entry("a title", `{"title":"t"}`, true),
+		Entry("every field", `{"title":"t","text":"line\nline","url":"https://example.com","image_url":"http://example.com/a.png","fields":[{"name":"n","value":"v"}]}`, true),
+		Entry("surrounding whitespace", " {\"title\":\"t\"}\n", true),
+		Entry("an empty body", ``, false),
+		Entry("not an object", `"title"`, false),
+		Entry("an array", `[{"title":"t"}]`, false),
+		Entry("malformed JSON", `{"title":"t"`, false),
+		Entry("unknown fields", `{"title":"t","color":"red"}`, false),
+		Entry("a second object", `{"title":"t"}{"title":"u"}`, false),
+		Entry("trailing data", `{"title":"t"} x`, false),
+		Entry("no title", `{"text":"t"}`, false),
+		Entry("a long title", `{"title":"`+strings.Repeat("t", maxCardTitleLength+1)+`"}`, false),
+		Entry("a title with newlines", `{"title":"t\nt"}`, false),
+		Entry("long text", `{"title":"t","text":"`+strings.Repeat("t", maxCardTextLength+1)+`"}`, false),
+		Entry("text with control characters", `{"title":"t","text":"\u0000"}`, false),
+		Entry("a relative URL", `{"title":"t","url":"/path"}`, false),
+		Entry("a javascript URL", `{"title":"t","url":"javascript:alert(1)"}`, false),
+		Entry("a data image URL", `{"title":"t","image_url":"data:image/png;base64,AA=="}`, false),
+		Entry("too many fields", `{"title":"t","fields":[`+strings.Repeat(`{"name":"n","value":"v"},`, maxCardFields)+`{"name":"n","value":"v"}]}`, false),
+		Entry("a field without name", `{"title":"t","fields":[{"value":"v"}]}`, false),
+		Entry("a long field value", `{"title":"t","fields":[{"name":"n","value":"`+strings.Repeat("v", maxCardFieldLength+1)+`"}]}`, false),
+	)
+
+	Describe("calling checkBody", func() {
+		var f *fixture
+
+		BeforeEach(func() {
+			f = newFixture()
+			f.h.config.MaxBodySize = 16
+		})
+		AfterEach(func() {
+			f.close()
+		})
+
+		DescribeTable("accepts valid bodies",
+			func(contentType, body string, allowEmpty bool) {
+				ok, err := f.h.checkBody(f.request(""), contentType, body, allowEmpty)
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeTrue())
+			},
+			Entry("plain text", types.ContentPlain, "hello", false),
+			Entry("markdown", types.ContentMarkdown, "*hello*", false),
+			Entry("a card", types.ContentCard, `{"title":"t"}`, false),
+			Entry("the size limit", types.ContentPlain, strings.Repeat("a", 16), false),
+			Entry("empty bodies with attachments", types.ContentPlain, "", true),
+		)
+
+		DescribeTable("refuses invalid bodies",
+			func(contentType, body string, code int, reason string) {
+				ok, err := f.h.checkBody(f.request(""), contentType, body, false)
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeFalse())
+
+				e := f.readError()
+				Expect(e.Response).To(Equal(code))
+				Expect(e.Error).To(ContainSubstring(reason))
+			},
+			Entry("empty bodies", types.ContentPlain, "", types.BadRequestOrObject, "empty"),
+			Entry("bodies over the limit", types.ContentPlain, strings.Repeat("a", 17), types.TooLarge, "16 bytes"),
+			Entry("multi-byte text over the limit", types.ContentPlain, strings.Repeat("ü", 9), types.TooLarge, "16 bytes"),
+			Entry("control characters", types.ContentPlain, "a\x07b", types.BadRequestOrObject, "control characters"),
+			Entry("invalid UTF-8", types.ContentMarkdown, "a\xffb", types.BadRequestOrObject, "UTF-8"),
+			Entry("unknown content types", "html", "<b>", types.BadRequestOrObject, "content type"),
+			Entry("malformed cards", types.ContentCard, `{"title":1}`, types.BadRequestOrObject, "card"),
+		)
+	})
+})
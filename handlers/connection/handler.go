@@ -1,9 +1,12 @@
 package connection
 
 import (
+	"tiberious/auth"
+	"tiberious/blob"
 	"tiberious/db"
 	"tiberious/handlers/client"
 	"tiberious/handlers/group"
+	"tiberious/mailer"
 	"tiberious/settings"
 	"tiberious/types"
 
@@ -37,7 +40,22 @@ func NewHandler(config *settings.Config, log *logrus.Logger) (Handler, error) {
 		return nil, errors.Wrap(err, "group.NewHandler")
 	}
 
-	clientHandler, err := client.NewHandler(config, dbClient, groupHandler, make(map[string]*types.Client), log)
+	mail, err := mailer.NewMailer(config, log)
+	if err != nil {
+		return nil, errors.Wrap(err, "mailer.NewMailer")
+	}
+
+	authenticator, err := auth.NewAuthenticator(config, dbClient, log)
+	if err != nil {
+		return nil, errors.Wrap(err, "auth.NewAuthenticator")
+	}
+
+	blobs, err := blob.NewStore(config, log)
+	if err != nil {
+		return nil, errors.Wrap(err, "blob.NewStore")
+	}
+
+	clientHandler, err := client.NewHandler(config, dbClient, groupHandler, mail, authenticator, blobs, make(map[string]*types.Client), log)
 	if err != nil {
 		return nil, errors.Wrap(err, "client.NewHandler")
 	}
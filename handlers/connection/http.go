@@ -6,7 +6,12 @@ package connection
 // Add perms!!!
 
 import (
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"tiberious/handlers/client"
 	"tiberious/types"
 
 	"github.com/ant0ine/go-json-rest/rest"
@@ -15,15 +20,104 @@ import (
 
 func (h *handler) getClients(w rest.ResponseWriter, req *rest.Request) {
 	type clients struct {
-		Clients map[string]*types.Client
+		Clients map[string]*types.PublicUser
 	}
 
-	c := clients{Clients: h.clientHandler.GetClients()}
+	// Only public user data is sent, never the raw clients.
+	c := clients{Clients: make(map[string]*types.PublicUser)}
+	for k, client := range h.clientHandler.GetClients() {
+		if client.User != nil {
+			c.Clients[k] = client.User.Public()
+		}
+	}
 	if err := w.WriteJson(&c); err != nil {
 		h.log.Error(errors.Wrap(err, "w.WriteJson"))
 	}
 }
 
+func (h *handler) verifyEmail(w rest.ResponseWriter, req *rest.Request) {
+	ok, err := h.clientHandler.VerifyEmail(req.PathParam("token"))
+	if err != nil {
+		h.log.Error(errors.Wrap(err, "clientHandler.VerifyEmail"))
+		rest.Error(w, "unable to verify email address", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		rest.Error(w, "invalid or expired token", http.StatusNotFound)
+		return
+	}
+
+	if err = w.WriteJson(map[string]bool{"verified": true}); err != nil {
+		h.log.Error(errors.Wrap(err, "w.WriteJson"))
+	}
+}
+
+func (h *handler) resetPassword(w rest.ResponseWriter, req *rest.Request) {
+	var reset struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := req.DecodeJsonPayload(&reset); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	ok, err := h.clientHandler.ResetPassword(ip, reset.Token, reset.Password)
+	switch err {
+	case client.ErrShortPassword:
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case client.ErrTooManyAttempts:
+		rest.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		h.log.Error(errors.Wrap(err, "clientHandler.ResetPassword"))
+		rest.Error(w, "unable to reset password", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		rest.Error(w, "invalid or expired token", http.StatusNotFound)
+		return
+	}
+
+	if err = w.WriteJson(map[string]bool{"reset": true}); err != nil {
+		h.log.Error(errors.Wrap(err, "w.WriteJson"))
+	}
+}
+
+/* getAttachment serves an attachment for a download token handed out over the
+ * websocket, which is where access to the attachment is checked. */
+func (h *handler) getAttachment(w rest.ResponseWriter, req *rest.Request) {
+	att, r, err := h.clientHandler.OpenAttachment(req.PathParam("token"))
+	if err != nil {
+		h.log.Error(errors.Wrap(err, "clientHandler.OpenAttachment"))
+		rest.Error(w, "unable to open attachment", http.StatusInternalServerError)
+		return
+	}
+	if att == nil {
+		rest.Error(w, "invalid or expired token", http.StatusNotFound)
+		return
+	}
+	defer r.Close()
+
+	// Never let browsers render uploads inline as something else.
+	w.Header().Set("Content-Type", att.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(att.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err = io.Copy(w.(http.ResponseWriter), r); err != nil {
+		h.log.Error(errors.Wrap(err, "io.Copy"))
+	}
+}
+
 // TODO getRooms and getGroups (requires modifications to db)
 //
 // getRoom and getGroup (requires either json formatted requests or replacing
@@ -34,6 +128,9 @@ func (h *handler) startAPIRoute() error {
 	api.Use(rest.DefaultDevStack...)
 	router, err := rest.MakeRouter(
 		rest.Get("/clients", h.getClients),
+		rest.Get("/verify/:token", h.verifyEmail),
+		rest.Post("/reset", h.resetPassword),
+		rest.Get("/attachments/:token", h.getAttachment),
 	)
 	if err != nil {
 		return errors.Wrap(err, "rest.MakeRouter")
@@ -3,6 +3,8 @@ package connection
 import (
 	"net/http"
 
+	"tiberious/codec"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -10,6 +12,8 @@ func (h *handler) newWebsocketConnection(w http.ResponseWriter, r *http.Request)
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  h.config.ReadBufferSize,
 		WriteBufferSize: h.config.WriteBufferSize,
+		// Clients pick an encoding through Sec-WebSocket-Protocol.
+		Subprotocols: codec.Subprotocols(),
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"tiberious/settings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+/* logMailer is meant for development, instead of sending messages it appends
+ * them to MailLog (or the server log if MailLog isn't set). */
+type logMailer struct {
+	mu  sync.Mutex
+	out io.Writer
+	log *logrus.Logger
+}
+
+func newLogMailer(config *settings.Config, log *logrus.Logger) (Mailer, error) {
+	m := &logMailer{
+		log: log,
+	}
+
+	if config.MailLog != "" {
+		f, err := os.OpenFile(config.MailLog, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "os.OpenFile")
+		}
+		m.out = f
+	}
+
+	return m, nil
+}
+
+// Send writes the message to the mail log.
+func (m *logMailer) Send(to, subject, body string) error {
+	if err := checkHeaders(to, subject); err != nil {
+		return errors.Wrap(err, "checkHeaders")
+	}
+
+	if m.out == nil {
+		m.log.Infof("mail to %s: %s\n%s", to, subject, body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := fmt.Fprintf(m.out, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, subject, body); err != nil {
+		return errors.Wrap(err, "fmt.Fprintf")
+	}
+
+	return nil
+}
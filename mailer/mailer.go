@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"strings"
+
+	"tiberious/settings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrDisabled is returned when sending mail without a configured mailer.
+	ErrDisabled = errors.New("mailer disabled")
+
+	// ErrInvalidHeader is returned when an address or subject would inject
+	// additional headers into a message.
+	ErrInvalidHeader = errors.New("invalid mail header")
+)
+
+type (
+	// Mailer provides access to outgoing mail.
+	Mailer interface {
+		Send(to, subject, body string) error
+	}
+
+	disabledMailer struct{}
+)
+
+// NewMailer returns a new Mailer for the mailer set in config ("smtp", "log"
+// or "" to disable sending mail).
+func NewMailer(config *settings.Config, log *logrus.Logger) (Mailer, error) {
+	switch config.Mailer {
+	case "smtp":
+		return newSMTPMailer(config)
+	case "log":
+		return newLogMailer(config, log)
+	case "":
+		return disabledMailer{}, nil
+	default:
+		return nil, errors.Errorf("unknown mailer %q", config.Mailer)
+	}
+}
+
+func (disabledMailer) Send(to, subject, body string) error {
+	return ErrDisabled
+}
+
+// checkHeaders makes sure none of the given header values contain newlines.
+func checkHeaders(values ...string) error {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return ErrInvalidHeader
+		}
+	}
+
+	return nil
+}
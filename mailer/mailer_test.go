@@ -0,0 +1,140 @@
+package mailer_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tiberious/mailer"
+	"tiberious/settings"
+
+	"github.com/Sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// smtpStandIn accepts a single SMTP session and sends the received DATA on
+// the returned channel.
+func smtpStandIn() (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	data := make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		write := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		write("220 localhost stand-in")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				write("250 localhost")
+			case cmd == "DATA":
+				write("354 go ahead")
+				var msg []string
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					msg = append(msg, l)
+				}
+				data <- strings.Join(msg, "")
+				write("250 ok")
+			case cmd == "QUIT":
+				write("221 bye")
+				return
+			default:
+				write("250 ok")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), data
+}
+
+var _ = Describe("mailer", func() {
+	var config *settings.Config
+
+	BeforeEach(func() {
+		_, err := settings.Init(true)
+		Expect(err).To(BeNil())
+		config = settings.GetConfig()
+	})
+
+	Describe("calling NewMailer", func() {
+		It("is disabled by default", func() {
+			m, err := mailer.NewMailer(config, logrus.New())
+			Expect(err).To(BeNil())
+			Expect(m.Send("someone@tiberious.nowhere", "test", "test")).To(Equal(mailer.ErrDisabled))
+		})
+		It("rejects unknown mailers", func() {
+			config.Mailer = "pigeon"
+			_, err := mailer.NewMailer(config, logrus.New())
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("using the smtp mailer", func() {
+		It("sends mail", func() {
+			addr, data := smtpStandIn()
+			config.Mailer = "smtp"
+			config.SMTPAddress = addr
+
+			m, err := mailer.NewMailer(config, logrus.New())
+			Expect(err).To(BeNil())
+			Expect(m.Send("someone@tiberious.nowhere", "Hello", "the body")).To(BeNil())
+
+			msg := <-data
+			Expect(msg).To(ContainSubstring("To: someone@tiberious.nowhere\r\n"))
+			Expect(msg).To(ContainSubstring("Subject: Hello\r\n"))
+			Expect(msg).To(ContainSubstring("the body"))
+		})
+		It("rejects header injection", func() {
+			config.Mailer = "smtp"
+			m, err := mailer.NewMailer(config, logrus.New())
+			Expect(err).To(BeNil())
+			Expect(m.Send("someone@tiberious.nowhere\r\nBcc: else@tiberious.nowhere", "Hello", "")).ToNot(BeNil())
+		})
+	})
+
+	Describe("using the log mailer", func() {
+		It("writes mail to the log file", func() {
+			dir, err := ioutil.TempDir("", "tiberious-mailer")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+
+			config.Mailer = "log"
+			config.MailLog = filepath.Join(dir, "mail.log")
+
+			m, err := mailer.NewMailer(config, logrus.New())
+			Expect(err).To(BeNil())
+			Expect(m.Send("someone@tiberious.nowhere", "Hello", "the body")).To(BeNil())
+
+			b, err := ioutil.ReadFile(config.MailLog)
+			Expect(err).To(BeNil())
+			Expect(string(b)).To(ContainSubstring("Subject: Hello"))
+			Expect(string(b)).To(ContainSubstring("the body"))
+		})
+	})
+})
@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"bytes"
+	"net"
+	"net/smtp"
+	"time"
+
+	"tiberious/settings"
+
+	"github.com/pkg/errors"
+)
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(config *settings.Config) (Mailer, error) {
+	if config.SMTPAddress == "" {
+		return nil, errors.New("Missing SMTPAddress in config file")
+	}
+
+	if err := checkHeaders(config.MailFrom); err != nil {
+		return nil, errors.Wrap(err, "checkHeaders")
+	}
+
+	m := &smtpMailer{
+		addr: config.SMTPAddress,
+		from: config.MailFrom,
+	}
+
+	if config.SMTPUser != "" {
+		host, _, err := net.SplitHostPort(config.SMTPAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.SplitHostPort")
+		}
+		m.auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPass, host)
+	}
+
+	return m, nil
+}
+
+// Send sends a plain text message through the configured SMTP server.
+func (m *smtpMailer) Send(to, subject, body string) error {
+	if err := checkHeaders(to, subject); err != nil {
+		return errors.Wrap(err, "checkHeaders")
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + m.from + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(body)
+
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg.Bytes()); err != nil {
+		return errors.Wrap(err, "smtp.SendMail")
+	}
+
+	return nil
+}
@@ -39,4 +39,99 @@ type Config struct {
 	Log string `yaml:"log"`
 	// AllowGuests determines if guest connections are allowed, default is true
 	AllowGuests bool `yaml:"allowguests"`
+	/* BanWarnScore, BanTempScore and BanPermScore set the ban-score at which
+	 * a client is warned, temporarily banned and permanently banned (0
+	 * disables the given threshold). Ban-scores are tracked for both the
+	 * user and the IP address of a client. */
+	BanWarnScore int `yaml:"banwarnscore"`
+	BanTempScore int `yaml:"bantempscore"`
+	BanPermScore int `yaml:"banpermscore"`
+	// BanTempDuration sets the length of a temporary ban in minutes.
+	BanTempDuration int `yaml:"bantempduration"`
+	/* BanDecay sets how many points are removed from a ban-score for every
+	 * hour without a new offense (0 means ban-scores never decay). */
+	BanDecay int `yaml:"bandecay"`
+	/* GuestPrefix is the prefix used for guest usernames, guests may only
+	 * change their nick to names starting with it and registered users may
+	 * not use it at all. */
+	GuestPrefix string `yaml:"guestprefix"`
+	// ReservedNames lists nicks that can't be taken by anyone (ignoring case).
+	ReservedNames []string `yaml:"reservednames"`
+	/* Mailer selects how mail (verification and password reset tokens) is
+	 * sent: "smtp", "log" (for development) or "" to disable mail. */
+	Mailer string `yaml:"mailer"`
+	// MailFrom is the address mail is sent from.
+	MailFrom string `yaml:"mailfrom"`
+	// SMTPAddress is the SMTP server used by the "smtp" mailer (host:port).
+	SMTPAddress string `yaml:"smtpaddress"`
+	// SMTPUser and SMTPPass are optional SMTP credentials.
+	SMTPUser string `yaml:"smtpuser"`
+	SMTPPass string `yaml:"smtppass"`
+	/* MailLog sets a file for the "log" mailer to write mail to, if empty
+	 * mail is written to the server log. */
+	MailLog string `yaml:"maillog"`
+	// TokenExpire sets how long verification and reset tokens last in hours.
+	TokenExpire int `yaml:"tokenexpire"`
+	/* PublicURL is the base URL of the HTTP API used for links sent in mail,
+	 * example: https://chat.example.com:8080 */
+	PublicURL string `yaml:"publicurl"`
+	/* AuthProvider selects how users are authenticated: "db" (default) checks
+	 * the user database, "ldap" binds to an LDAP server and "http" posts the
+	 * credentials to AuthURL. Users authenticated by an external provider
+	 * are created in the database on their first login. */
+	AuthProvider string `yaml:"authprovider"`
+	// AuthUserType is the user type given to users created on first login.
+	AuthUserType string `yaml:"authusertype"`
+	/* AuthURL is the endpoint used by the "http" provider, it receives a JSON
+	 * object with account_name and password and should respond with 200 for
+	 * valid credentials (optionally including username and email) or 401. */
+	AuthURL string `yaml:"authurl"`
+	// LDAPAddress is the LDAP server used by the "ldap" provider (host:port).
+	LDAPAddress string `yaml:"ldapaddress"`
+	// LDAPTLS connects to the LDAP server using TLS (ldaps).
+	LDAPTLS bool `yaml:"ldaptls"`
+	/* LDAPBindDN is the DN to bind as where %s is replaced by the account
+	 * name, example: uid=%s,ou=people,dc=example,dc=com */
+	LDAPBindDN string `yaml:"ldapbinddn"`
+	/* LDAPMailDomain (optional) sets the email address of LDAP users to
+	 * <account name>@<LDAPMailDomain>. */
+	LDAPMailDomain string `yaml:"ldapmaildomain"`
+	/* OfflineQueueLimit sets how many direct messages are queued for a
+	 * registered user while they're offline, further messages are refused
+	 * once the limit is reached (0 disables the queue). */
+	OfflineQueueLimit int `yaml:"offlinequeuelimit"`
+	/* OfflineQueueExpire sets how long queued direct messages are kept in
+	 * days (0 means they do not expire). */
+	OfflineQueueExpire int `yaml:"offlinequeueexpire"`
+	/* AutoAway sets how many minutes a session may be idle before it's shown
+	 * as away (0 disables auto-away). */
+	AutoAway int `yaml:"autoaway"`
+	/* MaxMessageSize limits the size of a single websocket message in bytes,
+	 * clients sending larger messages are disconnected (0 means no limit).
+	 * Keep it above 90000 so attachment chunks fit. */
+	MaxMessageSize int `yaml:"maxmessagesize"`
+	// MaxBodySize limits the body of a chat message in bytes (0 means no limit).
+	MaxBodySize int `yaml:"maxbodysize"`
+	/* ReadReceipts tells direct message peers when a user reads their
+	 * messages (if MessageStore is enabled). */
+	ReadReceipts bool `yaml:"readreceipts"`
+	/* MentionWarnings tells senders when they mention users that aren't in
+	 * the room. */
+	MentionWarnings bool `yaml:"mentionwarnings"`
+	/* BlobStore selects where uploaded attachments are stored: "disk" keeps
+	 * them under BlobPath or "" disables uploads. */
+	BlobStore string `yaml:"blobstore"`
+	// BlobPath is the directory used by the "disk" blob store.
+	BlobPath string `yaml:"blobpath"`
+	// MaxUploadSize limits the size of a single attachment in kilobytes.
+	MaxUploadSize int `yaml:"maxuploadsize"`
+	/* UploadTypes lists the content types that may be uploaded, a type may
+	 * end in "/*" to allow every subtype. */
+	UploadTypes []string `yaml:"uploadtypes"`
+	/* DownloadExpire sets how long attachment download links last in
+	 * minutes. */
+	DownloadExpire int `yaml:"downloadexpire"`
+	/* UploadExpire sets how long in minutes uploads are kept until they're
+	 * sent with a message, 0 keeps them forever. */
+	UploadExpire int `yaml:"uploadexpire"`
 }
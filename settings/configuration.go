@@ -13,30 +13,38 @@ const usingDefaults = "Using default settings"
 
 // Init loads are configuration data.
 func Init(test bool) (string, error) {
+	if !test {
+		return InitFile("./config.yml")
+	}
+
+	config = &Config{}
+	setDefaults()
+	return usingDefaults, nil
+}
+
+// InitFile loads our configuration data from the given yml file.
+func InitFile(path string) (string, error) {
 	/* Set default values then overwrite them with ones in the yml, this way
 	 * if something is missing from the yml the defaults apply properly. */
 	config = &Config{}
 	setDefaults()
 
-	if !test {
-		// If no config file is found set defaults.
-		configfile, err := filepath.Abs("./config.yml")
-		if err != nil {
-			return usingDefaults, err
-		}
-		// If unable to read the file set defaults.
-		configyaml, err := ioutil.ReadFile(configfile)
-		if err != nil {
-			return usingDefaults, err
-		}
-		// If unable to parse the yaml set defaults.
-		if err := yaml.Unmarshal([]byte(configyaml), &config); err != nil {
-			return usingDefaults, err
-		}
-
-		return "Settings loaded from config.yml", nil
+	// If no config file is found set defaults.
+	configfile, err := filepath.Abs(path)
+	if err != nil {
+		return usingDefaults, err
 	}
-	return usingDefaults, nil
+	// If unable to read the file set defaults.
+	configyaml, err := ioutil.ReadFile(configfile)
+	if err != nil {
+		return usingDefaults, err
+	}
+	// If unable to parse the yaml set defaults.
+	if err := yaml.Unmarshal([]byte(configyaml), &config); err != nil {
+		return usingDefaults, err
+	}
+
+	return "Settings loaded from " + filepath.Base(configfile), nil
 }
 
 func setDefaults() {
@@ -53,6 +61,41 @@ func setDefaults() {
 	config.DatabaseAddress = "localhost:6379"
 	config.DatabasePass = ""
 	config.DatabaseUser = 0
+	config.BanWarnScore = 5
+	config.BanTempScore = 10
+	config.BanPermScore = 50
+	config.BanTempDuration = 60
+	config.BanDecay = 1
+	config.GuestPrefix = "guest"
+	config.ReservedNames = []string{"admin", "administrator", "moderator", "root", "server", "system"}
+	config.Mailer = ""
+	config.MailFrom = "tiberious@localhost"
+	config.SMTPAddress = "localhost:25"
+	config.SMTPUser = ""
+	config.SMTPPass = ""
+	config.MailLog = ""
+	config.TokenExpire = 24
+	config.PublicURL = "http://localhost:8080"
+	config.AuthProvider = "db"
+	config.AuthUserType = "user"
+	config.AuthURL = ""
+	config.LDAPAddress = ""
+	config.LDAPTLS = false
+	config.LDAPBindDN = ""
+	config.LDAPMailDomain = ""
+	config.OfflineQueueLimit = 100
+	config.OfflineQueueExpire = 7
+	config.AutoAway = 10
+	config.MaxMessageSize = 131072
+	config.MaxBodySize = 8192
+	config.ReadReceipts = false
+	config.MentionWarnings = true
+	config.BlobStore = "disk"
+	config.BlobPath = "attachments"
+	config.MaxUploadSize = 10240
+	config.UploadTypes = []string{"image/*", "text/plain", "application/pdf", "application/zip"}
+	config.DownloadExpire = 10
+	config.UploadExpire = 60
 }
 
 // GetConfig returns the current configuration file.
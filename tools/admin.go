@@ -0,0 +1,133 @@
+package main
+
+/* Administrative CLI for Tiberious, it works directly against the database
+ * configured in config.yml (or the file given with -config), using the default
+ * settings when there is no config.yml.
+ *
+ * go build -o tiberious-admin ./tools
+ * tiberious-admin [-config config.yml] <user|group|room> <command> [flags]
+ */
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"tiberious/db"
+	"tiberious/settings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const usage = `usage: tiberious-admin [-config config.yml] <command> [flags]
+
+commands:
+  user create -login NAME [-username NAME] [-email ADDR] [-type TYPE] [-password PASS]
+  user delete (-id UUID | -login NAME)
+  user list
+  user set-password (-id UUID | -login NAME) [-password PASS]
+  user set-type (-id UUID | -login NAME) -type TYPE
+  user promote (-id UUID | -login NAME)
+  user reindex
+  group create -name #GROUP
+  group delete -name #GROUP
+  group list
+  room create -group #GROUP -name #ROOM [-private]
+  room delete -group #GROUP -name #ROOM
+  room list -group #GROUP
+
+Passwords are read from stdin when -password isn't given. "user reindex"
+rewrites every user, indexing the usernames and login names of users stored by
+older versions.
+`
+
+type command func(dbClient db.Client, args []string) error
+
+var commands = map[string]command{
+	"user create":       createUser,
+	"user delete":       deleteUser,
+	"user list":         listUsers,
+	"user set-password": setPassword,
+	"user set-type":     setType,
+	"user promote":      promoteUser,
+	"user reindex":      reindexUsers,
+	"group create":      createGroup,
+	"group delete":      deleteGroup,
+	"group list":        listGroups,
+	"room create":       createRoom,
+	"room delete":       deleteRoom,
+	"room list":         listRooms,
+}
+
+func main() {
+	configFile := flag.String("config", "./config.yml", "configuration file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Keep our output clean, only log warnings and errors.
+	log := logrus.New()
+	log.Out = os.Stderr
+	log.Level = logrus.WarnLevel
+
+	/* Like the server, fall back to the defaults when config.yml can't be
+	 * read, a file given with -config has to exist though. */
+	if _, err := settings.InitFile(*configFile); err != nil {
+		if configSet() {
+			log.Fatal(err)
+		}
+		log.Warn(err)
+	}
+
+	dbClient, err := db.NewDB(settings.GetConfig(), log)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cmd(dbClient, args[2:])
+	// Shutdown waits for any pending writes.
+	dbClient.Shutdown()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// configSet returns whether -config was given on the command line.
+func configSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// readPassword reads a password from the first line of r.
+func readPassword(r io.Reader) (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
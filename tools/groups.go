@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"tiberious/db"
+	"tiberious/types"
+
+	"github.com/pkg/errors"
+)
+
+// keyChars are the separators used in room names and database keys, and the
+// wildcards of key patterns.
+const keyChars = "/-*?[]"
+
+// checkName makes sure group and room names start with "#" and don't contain
+// the separators used in room names and database keys.
+func checkName(kind, name string) error {
+	if !strings.HasPrefix(name, "#") || len(name) < 2 || strings.ContainsAny(name, keyChars) {
+		return errors.Errorf("invalid %s name %q (should start with '#' and not contain '/', '-' or wildcards)", kind, name)
+	}
+
+	return nil
+}
+
+// checkKeyName makes sure login names and user types, which are part of the
+// user keys, don't contain their separators.
+func checkKeyName(kind, name string) error {
+	if name == "" || strings.ContainsAny(name, keyChars) {
+		return errors.Errorf("invalid %s %q (shouldn't be empty or contain '/', '-' or wildcards)", kind, name)
+	}
+
+	return nil
+}
+
+func createGroup(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("group create", flag.ExitOnError)
+	name := fs.String("name", "", "group name (required)")
+	fs.Parse(args)
+
+	if err := checkName("group", *name); err != nil {
+		return err
+	}
+
+	exists, err := dbClient.GroupExists(*name)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GroupExists")
+	}
+	if exists {
+		return errors.Errorf("group %s already exists", *name)
+	}
+
+	return dbClient.WriteGroupData(&types.Group{
+		Title: *name,
+		Rooms: make(map[string]*types.Room),
+		Users: make(map[string]*types.User),
+	})
+}
+
+func deleteGroup(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("group delete", flag.ExitOnError)
+	name := fs.String("name", "", "group name (required)")
+	fs.Parse(args)
+
+	if err := checkName("group", *name); err != nil {
+		return err
+	}
+
+	exists, err := dbClient.GroupExists(*name)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GroupExists")
+	}
+	if !exists {
+		return errors.Errorf("group %s does not exist", *name)
+	}
+
+	return dbClient.DeleteGroup(*name)
+}
+
+func listGroups(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("group list", flag.ExitOnError)
+	fs.Parse(args)
+
+	groups, err := dbClient.ListGroups()
+	if err != nil {
+		return errors.Wrap(err, "dbClient.ListGroups")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tROOMS\tUSERS")
+	for _, g := range groups {
+		group, err := dbClient.GetGroupData(g)
+		if err != nil {
+			return errors.Wrap(err, "dbClient.GetGroupData")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", group.Title, len(group.Rooms), len(group.Users))
+	}
+
+	return w.Flush()
+}
+
+func createRoom(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("room create", flag.ExitOnError)
+	gname := fs.String("group", "", "group name (required)")
+	rname := fs.String("name", "", "room name (required)")
+	private := fs.Bool("private", false, "make the room private")
+	fs.Parse(args)
+
+	if err := checkName("group", *gname); err != nil {
+		return err
+	}
+	if err := checkName("room", *rname); err != nil {
+		return err
+	}
+
+	exists, err := dbClient.GroupExists(*gname)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GroupExists")
+	}
+	if !exists {
+		return errors.Errorf("group %s does not exist", *gname)
+	}
+
+	exists, err = dbClient.RoomExists(*gname, *rname)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.RoomExists")
+	}
+	if exists {
+		return errors.Errorf("room %s/%s already exists", *gname, *rname)
+	}
+
+	group, err := dbClient.GetGroupData(*gname)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GetGroupData")
+	}
+
+	room := &types.Room{
+		Title:   *rname,
+		Group:   *gname,
+		Private: *private,
+		Users:   make(map[string]*types.User),
+	}
+	group.Rooms[room.Title] = room
+
+	if err = dbClient.WriteRoomData(room); err != nil {
+		return errors.Wrap(err, "dbClient.WriteRoomData")
+	}
+
+	return dbClient.WriteGroupData(group)
+}
+
+func deleteRoom(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("room delete", flag.ExitOnError)
+	gname := fs.String("group", "", "group name (required)")
+	rname := fs.String("name", "", "room name (required)")
+	fs.Parse(args)
+
+	if err := checkName("group", *gname); err != nil {
+		return err
+	}
+	if err := checkName("room", *rname); err != nil {
+		return err
+	}
+
+	exists, err := dbClient.RoomExists(*gname, *rname)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.RoomExists")
+	}
+	if !exists {
+		return errors.Errorf("room %s/%s does not exist", *gname, *rname)
+	}
+
+	return dbClient.DeleteRoom(*gname, *rname)
+}
+
+func listRooms(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("room list", flag.ExitOnError)
+	gname := fs.String("group", "", "group name (required)")
+	fs.Parse(args)
+
+	if err := checkName("group", *gname); err != nil {
+		return err
+	}
+
+	exists, err := dbClient.GroupExists(*gname)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GroupExists")
+	}
+	if !exists {
+		return errors.Errorf("group %s does not exist", *gname)
+	}
+
+	group, err := dbClient.GetGroupData(*gname)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GetGroupData")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ROOM\tPRIVATE\tUSERS")
+	for _, r := range group.Rooms {
+		fmt.Fprintf(w, "%s/%s\t%t\t%d\n", group.Title, r.Title, r.Private, len(r.Users))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"tiberious/db"
+	"tiberious/types"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const minPasswordLength = 8
+
+// userFlags adds the flags used to select an existing user.
+func userFlags(fs *flag.FlagSet) (id, login *string) {
+	id = fs.String("id", "", "user ID")
+	login = fs.String("login", "", "user login name")
+	return
+}
+
+// findUser returns the user selected by either an ID or a login name.
+func findUser(dbClient db.Client, id, login string) (*types.User, error) {
+	var (
+		user *types.User
+		err  error
+	)
+	switch {
+	case id != "":
+		if uuid.Parse(id) == nil {
+			return nil, errors.Errorf("invalid user ID %q", id)
+		}
+		user, err = dbClient.GetUserData(id)
+		if err != nil && err != types.NotInDB {
+			return nil, errors.Wrap(err, "dbClient.GetUserData")
+		}
+	case login != "":
+		if err = checkKeyName("login name", login); err != nil {
+			return nil, err
+		}
+		user, err = dbClient.GetUserByLoginName(login)
+		if err != nil {
+			return nil, errors.Wrap(err, "dbClient.GetUserByLoginName")
+		}
+	default:
+		return nil, errors.New("either -id or -login is required")
+	}
+
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+
+	return user, nil
+}
+
+// getPassword returns the password flag or reads one from stdin.
+func getPassword(password string) (string, error) {
+	if password == "" {
+		var err error
+		if password, err = readPassword(os.Stdin); err != nil {
+			return "", errors.Wrap(err, "readPassword")
+		}
+	}
+
+	if len(password) < minPasswordLength {
+		return "", errors.Errorf("passwords must be at least %d characters", minPasswordLength)
+	}
+
+	return password, nil
+}
+
+func createUser(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ExitOnError)
+	login := fs.String("login", "", "login name (required)")
+	username := fs.String("username", "", "username (defaults to the login name)")
+	email := fs.String("email", "", "email address")
+	userType := fs.String("type", "user", "user type")
+	password := fs.String("password", "", "password")
+	fs.Parse(args)
+
+	if *login == "" {
+		return errors.New("-login is required")
+	}
+	if err := checkKeyName("login name", *login); err != nil {
+		return err
+	}
+	if err := checkKeyName("user type", *userType); err != nil {
+		return err
+	}
+	if *userType == "guest" {
+		return errors.New("guest users can't be created")
+	}
+	if *username == "" {
+		*username = *login
+	}
+
+	existing, err := dbClient.GetUserByLoginName(*login)
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GetUserByLoginName")
+	}
+	if existing != nil {
+		return errors.Errorf("login name %q already exists", *login)
+	}
+
+	pass, err := getPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	id, err := dbClient.GetUniqueID()
+	if err != nil {
+		return errors.Wrap(err, "dbClient.GetUniqueID")
+	}
+
+	ok, err := dbClient.ReserveUsername(*username, id.String())
+	if err != nil {
+		return errors.Wrap(err, "dbClient.ReserveUsername")
+	}
+	if !ok {
+		return errors.Errorf("username %q is already in use", *username)
+	}
+
+	user := &types.User{
+		ID:        id,
+		Type:      *userType,
+		Username:  *username,
+		LoginName: *login,
+		Email:     *email,
+	}
+	user.SetPassword(pass)
+
+	if err = dbClient.WriteUserData(user); err != nil {
+		return errors.Wrap(err, "dbClient.WriteUserData")
+	}
+
+	fmt.Println(user.ID.String())
+	return nil
+}
+
+func deleteUser(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("user delete", flag.ExitOnError)
+	id, login := userFlags(fs)
+	fs.Parse(args)
+
+	user, err := findUser(dbClient, *id, *login)
+	if err != nil {
+		return err
+	}
+
+	return dbClient.DeleteUser(user)
+}
+
+func listUsers(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ExitOnError)
+	fs.Parse(args)
+
+	users, err := dbClient.ListUsers()
+	if err != nil {
+		return errors.Wrap(err, "dbClient.ListUsers")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tLOGIN\tUSERNAME\tEMAIL\tVERIFIED\tCONNECTED")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%t\n", u.ID.String(), u.Type, u.LoginName, u.Username, u.Email, u.Verified, u.Connected)
+	}
+
+	return w.Flush()
+}
+
+func setPassword(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("user set-password", flag.ExitOnError)
+	id, login := userFlags(fs)
+	password := fs.String("password", "", "new password")
+	fs.Parse(args)
+
+	user, err := findUser(dbClient, *id, *login)
+	if err != nil {
+		return err
+	}
+
+	pass, err := getPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	user.SetPassword(pass)
+	return dbClient.WriteUserData(user)
+}
+
+func setType(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("user set-type", flag.ExitOnError)
+	id, login := userFlags(fs)
+	userType := fs.String("type", "", "new user type (required)")
+	fs.Parse(args)
+
+	if *userType == "" {
+		return errors.New("-type is required")
+	}
+	if err := checkKeyName("user type", *userType); err != nil {
+		return err
+	}
+	if *userType == "guest" {
+		return errors.New("users can't be made guests")
+	}
+
+	user, err := findUser(dbClient, *id, *login)
+	if err != nil {
+		return err
+	}
+
+	return dbClient.SetUserType(user, *userType)
+}
+
+func promoteUser(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("user promote", flag.ExitOnError)
+	id, login := userFlags(fs)
+	fs.Parse(args)
+
+	user, err := findUser(dbClient, *id, *login)
+	if err != nil {
+		return err
+	}
+
+	return dbClient.SetUserType(user, "admin")
+}
+
+// reindexUsers writes every user again, which fills the name indexes.
+func reindexUsers(dbClient db.Client, args []string) error {
+	fs := flag.NewFlagSet("user reindex", flag.ExitOnError)
+	fs.Parse(args)
+
+	users, err := dbClient.ListUsers()
+	if err != nil {
+		return errors.Wrap(err, "dbClient.ListUsers")
+	}
+
+	for _, u := range users {
+		if err = dbClient.WriteUserData(u); err != nil {
+			return errors.Wrap(err, "dbClient.WriteUserData")
+		}
+	}
+
+	fmt.Printf("%d users reindexed\n", len(users))
+	return nil
+}
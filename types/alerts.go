@@ -20,6 +20,8 @@ type Alert struct {
 	Response int    `json:"response"`
 	Time     int64  `json:"time"`
 	Alert    string `json:"alert"`
+	// ID echoes the request ID of the message being handled, if any.
+	ID string `json:"id,omitempty"`
 }
 
 // NewAlert returns a new alert with the current timestamp.
@@ -30,3 +32,18 @@ func NewAlert(response int, message string) *Alert {
 	ret.Alert = message
 	return ret
 }
+
+// MessageAlert is the alert sent in response to a "msg", carrying the ID the
+// server gave the message.
+type MessageAlert struct {
+	Alert
+	MessageID string `json:"message_id"`
+}
+
+// NewMessageAlert returns an alert for a sent message.
+func NewMessageAlert(response int, message, id string) *MessageAlert {
+	ret := new(MessageAlert)
+	ret.Alert = *NewAlert(response, message)
+	ret.MessageID = id
+	return ret
+}
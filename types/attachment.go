@@ -0,0 +1,74 @@
+package types
+
+import (
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+/* Attachment describes an uploaded file, To is the room (as "group/room") or
+ * user ID it was uploaded for and decides who may download it. */
+type Attachment struct {
+	ID          string `json:"attachment_id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	To          string `json:"to"`
+	From        string `json:"from"`
+	Time        int64  `json:"time"`
+	// Complete is set once every byte was received.
+	Complete bool `json:"complete"`
+	// MessageID is the message the attachment was sent with, there's only one.
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// NewAttachment returns a new incomplete attachment with a new ID.
+func NewAttachment(to, from, name, contentType string, size int64) *Attachment {
+	ret := new(Attachment)
+	ret.ID = uuid.NewRandom().String()
+	ret.Name = name
+	ret.Size = size
+	ret.ContentType = contentType
+	ret.To = to
+	ret.From = from
+	ret.Time = time.Now().Unix()
+	return ret
+}
+
+// UploadAlert is the alert sent in response to "upload" and "chunk" actions
+// with the number of bytes received so far.
+type UploadAlert struct {
+	Alert
+	AttachmentID string `json:"attachment_id"`
+	Received     int64  `json:"received"`
+}
+
+// NewUploadAlert returns an alert for an upload.
+func NewUploadAlert(response int, id string, received int64) *UploadAlert {
+	ret := new(UploadAlert)
+	ret.Alert = *NewAlert(response, "")
+	ret.AttachmentID = id
+	ret.Received = received
+	return ret
+}
+
+// Download is sent in response to a "download" action with a link to the
+// attachment that works until Expires (unix time).
+type Download struct {
+	Action     string      `json:"action"`
+	Time       int64       `json:"time"`
+	Attachment *Attachment `json:"attachment"`
+	URL        string      `json:"url"`
+	Expires    int64       `json:"expires"`
+}
+
+// NewDownload returns a "download" response with the current timestamp.
+func NewDownload(att *Attachment, url string, expires int64) *Download {
+	ret := new(Download)
+	ret.Action = "download"
+	ret.Time = time.Now().Unix()
+	ret.Attachment = att
+	ret.URL = url
+	ret.Expires = expires
+	return ret
+}
@@ -0,0 +1,18 @@
+package types
+
+// Ban holds the ban-score and ban state for a single user or IP address.
+type Ban struct {
+	// Key identifies what the ban applies to ("user-<uuid>" or "ip-<address>").
+	Key   string
+	Score int
+	// Updated is the last time (unix) the score was changed or decayed.
+	Updated int64
+	// Expires is the time (unix) a temporary ban ends, 0 if there is none.
+	Expires   int64
+	Permanent bool
+}
+
+// Banned returns whether the ban is in effect at the given time (unix).
+func (b *Ban) Banned(now int64) bool {
+	return b.Permanent || b.Expires > now
+}
@@ -1,7 +1,7 @@
 package types
 
 import (
-	"encoding/json"
+	"tiberious/codec"
 
 	"github.com/gorilla/websocket"
 )
@@ -14,33 +14,115 @@ type Client struct {
 	User       *User
 	Authorized bool
 	BanScore   int
+	// Store the remote IP address for ban-score tracking.
+	IP string
+	// Codec encodes everything sent to the client, as negotiated on connect.
+	Codec codec.Codec
+	/* Protocol, ClientName, ClientVersion and Features are set by the
+	 * optional "hello" exchange, Protocol is 0 until then. */
+	Protocol      int
+	ClientName    string
+	ClientVersion string
+	Features      []string
+
+	out *outbox
 }
 
 // NewClient returns a Client
 func NewClient() (client *Client) {
-	return &Client{}
+	return &Client{Codec: codec.Default, out: newOutbox()}
 }
 
-// Alert sends an alert with the current timestamp
-func (c Client) Alert(code int, message string) error {
-	ret, err := json.Marshal(NewAlert(code, message))
+// HasFeature checks whether the client announced a feature in its "hello".
+func (c Client) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Client) codec() codec.Codec {
+	if c.Codec == nil {
+		return codec.Default
+	}
+
+	return c.Codec
+}
 
+/* Send encodes an object with the codec of the client and writes it, every
+ * object sent to a client goes through here or Reply. Clients that announced
+ * the "batch" feature may get several objects coalesced into one array. */
+func (c Client) Send(v interface{}) error {
+	return c.send(v, false)
+}
+
+/* Reply sends the response to the object being handled, it's only meant for
+ * the goroutine reading from the client. Replies are collected while handling
+ * a batch, relays and other objects sent meanwhile are written as usual. */
+func (c Client) Reply(v interface{}) error {
+	return c.send(v, true)
+}
+
+/* Deliver sends an object like Send but waits until it was written, the
+ * error returned is that of writing this object even if it was coalesced with
+ * others. It's meant for objects that must be sent again if they were lost. */
+func (c Client) Deliver(v interface{}) error {
+	enc := c.codec()
+	ret, err := enc.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	c.Conn.WriteMessage(websocket.BinaryMessage, ret)
-	return nil
-}
+	if c.out == nil {
+		return c.Conn.WriteMessage(enc.MessageType(), ret)
+	}
 
-// Error sends an error with the current timestamp
-func (c Client) Error(code int, message string) error {
-	ret, err := json.Marshal(NewError(code, message))
+	return c.out.send(c.Conn, enc, &frame{objs: [][]byte{ret}}, c.HasFeature(FeatureBatch), true)
+}
 
+func (c Client) send(v interface{}, reply bool) error {
+	enc := c.codec()
+	ret, err := enc.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	c.Conn.WriteMessage(websocket.BinaryMessage, ret)
-	return nil
+	if c.out == nil {
+		return c.Conn.WriteMessage(enc.MessageType(), ret)
+	}
+
+	return c.out.send(c.Conn, enc, &frame{objs: [][]byte{ret}, reply: reply}, c.HasFeature(FeatureBatch), false)
+}
+
+/* StartBatch collects the replies sent to the client until EndBatch, while
+ * the objects of an inbound batch are handled. */
+func (c Client) StartBatch() {
+	if c.out == nil {
+		return
+	}
+
+	c.out.startBatch()
+}
+
+// EndBatch sends the replies collected since StartBatch as a single array.
+func (c Client) EndBatch() error {
+	if c.out == nil {
+		return nil
+	}
+
+	objs := c.out.endBatch()
+	return c.out.send(c.Conn, c.codec(), &frame{objs: objs, array: true}, c.HasFeature(FeatureBatch), false)
+}
+
+// Alert sends an alert with the current timestamp
+func (c Client) Alert(code int, message string) error {
+	return c.Reply(NewAlert(code, message))
+}
+
+// Error sends an error with the current timestamp
+func (c Client) Error(code int, message string) error {
+	return c.Reply(NewError(code, message))
 }
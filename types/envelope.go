@@ -0,0 +1,121 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Errors returned while decoding client objects, they're safe to send back.
+var (
+	ErrInvalidObject = errors.New("invalid object")
+	ErrUnknownAction = errors.New("unknown action")
+)
+
+/* Envelope holds the fields shared by every client object, the object itself
+ * is kept raw (as JSON, whatever the wire encoding) as the payload of its
+ * action. Objects stay flat on the wire so the payload fields sit next to
+ * "action", "id" and "time". */
+type Envelope struct {
+	Action string
+	// Optional client supplied request ID, echoed in alerts and errors
+	ID      string
+	Time    int64
+	Payload json.RawMessage
+}
+
+/* Frame holds the envelopes read from a single websocket frame, clients may
+ * batch several objects by sending an array of them. */
+type Frame struct {
+	Envelopes []*Envelope
+	Batch     bool
+}
+
+// UnmarshalJSON reads either a single object or an array of them.
+func (f *Frame) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '[' {
+		f.Batch = true
+		return json.Unmarshal(data, &f.Envelopes)
+	}
+
+	env := new(Envelope)
+	if err := json.Unmarshal(data, env); err != nil {
+		return err
+	}
+	f.Envelopes = []*Envelope{env}
+	return nil
+}
+
+type envelopeHeader struct {
+	Action string `json:"action"`
+	ID     string `json:"id,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// NewEnvelope returns an envelope for a payload with the current timestamp.
+func NewEnvelope(action, id string, payload interface{}) (*Envelope, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(Envelope)
+	ret.Action = action
+	ret.ID = id
+	ret.Time = time.Now().Unix()
+	ret.Payload = raw
+	return ret, nil
+}
+
+// UnmarshalJSON reads the shared fields and keeps the whole object as payload.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var header envelopeHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	e.Action = header.Action
+	e.ID = header.ID
+	e.Time = header.Time
+	e.Payload = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON writes the payload fields next to the shared ones.
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(e.Payload) > 0 {
+		if err := json.Unmarshal(e.Payload, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := json.Marshal(envelopeHeader{Action: e.Action, ID: e.ID, Time: e.Time})
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(header, &fields); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+/* Decode returns the validated payload for the action of the envelope, the
+ * errors returned are meant for the client. */
+func (e *Envelope) Decode() (Payload, error) {
+	payload := NewPayload(e.Action)
+	if payload == nil {
+		return nil, ErrUnknownAction
+	}
+
+	if err := json.Unmarshal(e.Payload, payload); err != nil {
+		return nil, ErrInvalidObject
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
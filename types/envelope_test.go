@@ -0,0 +1,37 @@
+package types_test
+
+import (
+	"encoding/json"
+
+	. "tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Frame", func() {
+	It("reads single objects", func() {
+		frame := new(Frame)
+		Expect(json.Unmarshal([]byte(`{"action":"join","id":"1","time":2,"room":"r"}`), frame)).To(BeNil())
+		Expect(frame.Batch).To(BeFalse())
+		Expect(frame.Envelopes).To(HaveLen(1))
+		Expect(frame.Envelopes[0].Action).To(Equal("join"))
+		Expect(frame.Envelopes[0].ID).To(Equal("1"))
+		Expect(frame.Envelopes[0].Time).To(Equal(int64(2)))
+	})
+
+	It("reads batches", func() {
+		frame := new(Frame)
+		Expect(json.Unmarshal([]byte(` [{"action":"join","id":"1"},{"action":"part","id":"2"}]`), frame)).To(BeNil())
+		Expect(frame.Batch).To(BeTrue())
+		Expect(frame.Envelopes).To(HaveLen(2))
+		Expect(frame.Envelopes[0].ID).To(Equal("1"))
+		Expect(frame.Envelopes[1].Action).To(Equal("part"))
+	})
+
+	It("refuses anything else", func() {
+		for _, raw := range []string{`"join"`, `1`, `[1]`, `{"action":1}`, `[{"action":"join"}`} {
+			Expect(json.Unmarshal([]byte(raw), new(Frame))).NotTo(BeNil(), raw)
+		}
+	})
+})
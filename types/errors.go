@@ -20,6 +20,14 @@ const (
 	Conflict = 409
 	// Gone response code
 	Gone = 410
+	// TooLarge response code, for messages over the configured size limits
+	TooLarge = 413
+	// Banned response code, sent to clients refused because of their ban-score
+	Banned = 423
+	// UpgradeRequired response code, for clients speaking an unsupported protocol
+	UpgradeRequired = 426
+	// TooManyRequests response code, for requests repeated too often
+	TooManyRequests = 429
 	// ServerError response code
 	ServerError = 500
 )
@@ -34,6 +42,8 @@ type Error struct {
 	Response int    `json:"response"`
 	Time     int64  `json:"time"`
 	Error    string `json:"error"`
+	// ID echoes the request ID of the message being handled, if any.
+	ID string `json:"id,omitempty"`
 }
 
 // NewError returns a new error with the current timestamp.
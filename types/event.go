@@ -0,0 +1,26 @@
+package types
+
+import "time"
+
+// RoomEvent is sent to room members when a user joins, parts or quits.
+type RoomEvent struct {
+	Action   string `json:"action"`
+	Time     int64  `json:"time"`
+	Room     string `json:"room"`
+	User     string `json:"user"`
+	Username string `json:"username"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// NewRoomEvent returns a "join", "part" or "quit" event with the current
+// timestamp.
+func NewRoomEvent(action, room string, user *User, reason string) *RoomEvent {
+	ret := new(RoomEvent)
+	ret.Action = action
+	ret.Time = time.Now().Unix()
+	ret.Room = room
+	ret.User = user.ID.String()
+	ret.Username = user.Username
+	ret.Reason = reason
+	return ret
+}
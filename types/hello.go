@@ -0,0 +1,62 @@
+package types
+
+import "time"
+
+const (
+	// ServerName and ServerVersion identify the server in "hello" responses.
+	ServerName    = "tiberious"
+	ServerVersion = "0.1.0"
+	// ProtocolVersion is the newest protocol version the server speaks.
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest protocol version the server speaks.
+	MinProtocolVersion = 1
+)
+
+// Limits tells clients the limits enforced by the server, sizes are in bytes.
+type Limits struct {
+	MaxMessageSize int   `json:"max_message_size"`
+	MaxBodySize    int   `json:"max_body_size"`
+	MaxUploadSize  int64 `json:"max_upload_size"`
+	MaxChunkSize   int   `json:"max_chunk_size"`
+	MaxAttachments int   `json:"max_attachments"`
+	MaxHistory     int   `json:"max_history"`
+	// TypingInterval is the number of seconds between relayed typing updates.
+	TypingInterval int `json:"typing_interval"`
+}
+
+// Session describes the identity of a connection.
+type Session struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	Type       string `json:"type"`
+	Authorized bool   `json:"authorized"`
+}
+
+// Hello is sent in response to a "hello" action.
+type Hello struct {
+	Action   string   `json:"action"`
+	Time     int64    `json:"time"`
+	ID       string   `json:"id,omitempty"`
+	Protocol int      `json:"protocol"`
+	Server   string   `json:"server"`
+	Version  string   `json:"version"`
+	Encoding string   `json:"encoding"`
+	Limits   *Limits  `json:"limits"`
+	Features []string `json:"features"`
+	Session  *Session `json:"session"`
+}
+
+// NewHello returns a "hello" response with the current timestamp.
+func NewHello(protocol int, encoding string, limits *Limits, features []string, session *Session) *Hello {
+	ret := new(Hello)
+	ret.Action = "hello"
+	ret.Time = time.Now().Unix()
+	ret.Protocol = protocol
+	ret.Server = ServerName
+	ret.Version = ServerVersion
+	ret.Encoding = encoding
+	ret.Limits = limits
+	ret.Features = features
+	ret.Session = session
+	return ret
+}
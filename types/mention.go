@@ -0,0 +1,34 @@
+package types
+
+import "time"
+
+// Highlight is sent to users mentioned in a room message, including mentioned
+// members of the group that aren't in the room.
+type Highlight struct {
+	Action    string `json:"action"`
+	Time      int64  `json:"time"`
+	MessageID string `json:"message_id"`
+	To        string `json:"to"`
+	From      string `json:"from"`
+	Body      string `json:"message"`
+}
+
+// NewHighlight returns a "highlight" notification for a message.
+func NewHighlight(msg *Message) *Highlight {
+	ret := new(Highlight)
+	ret.Action = "highlight"
+	ret.Time = time.Now().Unix()
+	ret.MessageID = msg.ID
+	ret.To = msg.To
+	ret.From = msg.From
+	ret.Body = msg.Body
+	return ret
+}
+
+// NewMentions returns a "mentions" response listing messages mentioning a
+// user, oldest first.
+func NewMentions(messages []*Message, more bool) *History {
+	ret := NewHistory("", messages, more)
+	ret.Action = "mentions"
+	return ret
+}
@@ -1,23 +1,117 @@
 package types
 
-import "time"
+import (
+	"strings"
+	"time"
 
-// Message (used for channel and direct messages)
+	"github.com/pborman/uuid"
+)
+
+// Content types of a message body, plain is used when none is given.
+const (
+	ContentPlain    = "plain"
+	ContentMarkdown = "markdown"
+	ContentCard     = "card"
+)
+
+/* Message (used for channel and direct messages), messages are always built by
+ * the server so the ID, sender and time can be trusted by clients. */
 type Message struct {
 	Action string `json:"action"`
+	ID     string `json:"message_id"`
 	Time   int64  `json:"time"`
 	To     string `json:"to"`
 	From   string `json:"from"`
 	Body   string `json:"message"`
+	// ContentType tells clients how to render the body.
+	ContentType string `json:"content_type"`
+	// Edited is the time of the last edit, deleted messages keep only their
+	// ID, sender and time.
+	Edited  int64 `json:"edited,omitempty"`
+	Deleted bool  `json:"deleted,omitempty"`
+	// Attachments lists the IDs of files attached to the message.
+	Attachments []string `json:"attachments,omitempty"`
+	// Mentions lists the IDs of the users mentioned in the body.
+	Mentions []string `json:"mentions,omitempty"`
+	// Reactions holds the number of users per emoji for stored messages.
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// Parent is the ID of the room message a thread reply belongs to, thread
+	// parents carry the number of replies and the time of the last one.
+	Parent    string `json:"parent,omitempty"`
+	Replies   int    `json:"replies,omitempty"`
+	LastReply int64  `json:"last_reply,omitempty"`
 }
 
-// NewMessage returns a standard pre-constructed "msg"
+// NewMessage returns a standard pre-constructed plain "msg" with a new
+// message ID
 func NewMessage(to, from, body string) *Message {
 	ret := new(Message)
 	ret.Action = "msg"
+	ret.ID = uuid.NewRandom().String()
 	ret.Time = time.Now().Unix()
 	ret.To = to
 	ret.From = from
 	ret.Body = body
+	ret.ContentType = ContentPlain
+	return ret
+}
+
+// Card is the body of a "card" message, a JSON object rendered by clients.
+type Card struct {
+	Title    string      `json:"title"`
+	Text     string      `json:"text,omitempty"`
+	URL      string      `json:"url,omitempty"`
+	ImageURL string      `json:"image_url,omitempty"`
+	Fields   []CardField `json:"fields,omitempty"`
+}
+
+// CardField is a name/value pair shown in a card.
+type CardField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+/* Conversation returns the name a message is stored under, rooms use their
+ * "group/room" name and direct messages use both user IDs in sorted order so
+ * both sides share a conversation. */
+func Conversation(to, from string) string {
+	if strings.HasPrefix(to, "#") {
+		return to
+	}
+
+	if from < to {
+		return from + ":" + to
+	}
+
+	return to + ":" + from
+}
+
+// History is sent in response to a "history" or "thread" action, messages are
+// ordered oldest first and More is set when older messages exist.
+type History struct {
+	Action   string     `json:"action"`
+	Time     int64      `json:"time"`
+	To       string     `json:"to"`
+	Parent   string     `json:"parent,omitempty"`
+	Messages []*Message `json:"messages"`
+	More     bool       `json:"more"`
+}
+
+// NewHistory returns a "history" response with the current timestamp.
+func NewHistory(to string, messages []*Message, more bool) *History {
+	ret := new(History)
+	ret.Action = "history"
+	ret.Time = time.Now().Unix()
+	ret.To = to
+	ret.Messages = messages
+	ret.More = more
+	return ret
+}
+
+// NewThread returns a "thread" response holding replies to a room message.
+func NewThread(to, parent string, messages []*Message, more bool) *History {
+	ret := NewHistory(to, messages, more)
+	ret.Action = "thread"
+	ret.Parent = parent
 	return ret
 }
@@ -0,0 +1,23 @@
+package types
+
+import "time"
+
+// NickChange is sent to room members when a user changes their username.
+type NickChange struct {
+	Action string `json:"action"`
+	Time   int64  `json:"time"`
+	User   string `json:"user"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+}
+
+// NewNickChange returns a "nick" notification with the current timestamp.
+func NewNickChange(user, oldNick, newNick string) *NickChange {
+	ret := new(NickChange)
+	ret.Action = "nick"
+	ret.Time = time.Now().Unix()
+	ret.User = user
+	ret.Old = oldNick
+	ret.New = newNick
+	return ret
+}
@@ -0,0 +1,174 @@
+package types
+
+import (
+	"sync"
+
+	"tiberious/codec"
+)
+
+const (
+	// FeatureBatch is announced in "hello" by clients reading arrays of objects.
+	FeatureBatch = "batch"
+
+	// maxCoalesce limits the objects combined into a single outbound frame.
+	maxCoalesce = 64
+)
+
+type (
+	// writer is the part of a websocket connection the outbox writes to.
+	writer interface {
+		WriteMessage(messageType int, data []byte) error
+	}
+
+	/* outbox serializes the writes to a connection. Objects sent while a write
+	 * is in progress wait for the writer, which may coalesce them into one
+	 * frame. */
+	outbox struct {
+		sync.Mutex
+		pending []*frame
+		writing bool
+		/* batch collects the replies to an inbound batch while not nil,
+		 * anything else sent meanwhile is written as usual. */
+		batch [][]byte
+	}
+
+	/* frame holds encoded objects, array frames are sent as an array even
+	 * with a single object. Replies answer the object being handled. */
+	frame struct {
+		objs  [][]byte
+		array bool
+		reply bool
+		/* done is closed once a frame sent with wait was written, err is
+		 * the error writing it. */
+		done chan struct{}
+		err  error
+		// sources are the frames coalesced into this one.
+		sources []*frame
+	}
+)
+
+func newOutbox() *outbox {
+	return new(outbox)
+}
+
+// startBatch collects the replies sent until endBatch.
+func (o *outbox) startBatch() {
+	o.Lock()
+	o.batch = [][]byte{}
+	o.Unlock()
+}
+
+// endBatch returns the replies collected since startBatch.
+func (o *outbox) endBatch() [][]byte {
+	o.Lock()
+	defer o.Unlock()
+
+	ret := o.batch
+	o.batch = nil
+	return ret
+}
+
+/* send queues an encoded object and writes everything queued unless another
+ * goroutine is already doing so. With coalesce several queued objects are
+ * written as arrays. Replies are collected instead while a batch is handled.
+ * With wait send returns once the frame was written and only its error, as
+ * otherwise the goroutine writing it gets the error. */
+func (o *outbox) send(conn writer, enc codec.Codec, f *frame, coalesce, wait bool) error {
+	if wait {
+		f.done = make(chan struct{})
+	}
+
+	o.Lock()
+	if o.batch != nil && f.reply {
+		o.batch = append(o.batch, f.objs...)
+		o.Unlock()
+		return nil
+	}
+	o.pending = append(o.pending, f)
+	if o.writing {
+		o.Unlock()
+		if wait {
+			<-f.done
+			return f.err
+		}
+		return nil
+	}
+	o.writing = true
+
+	var err error
+	for len(o.pending) > 0 {
+		frames := o.pending
+		o.pending = nil
+		o.Unlock()
+
+		written := frames
+		if coalesce {
+			written = coalesceFrames(frames)
+		}
+		for _, w := range written {
+			data := w.objs[0]
+			if w.array {
+				data = enc.Join(w.objs)
+			}
+			if e := conn.WriteMessage(enc.MessageType(), data); e != nil {
+				if err == nil {
+					err = e
+				}
+				w.fail(e)
+			}
+		}
+		for _, q := range frames {
+			if q.done != nil {
+				close(q.done)
+			}
+		}
+
+		o.Lock()
+	}
+	o.writing = false
+	o.Unlock()
+
+	if wait {
+		return f.err
+	}
+	return err
+}
+
+// fail records the error writing a frame on it and the frames it coalesced.
+func (f *frame) fail(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+	for _, s := range f.sources {
+		if s.err == nil {
+			s.err = err
+		}
+	}
+}
+
+// coalesceFrames combines frames into arrays of up to maxCoalesce objects.
+func coalesceFrames(frames []*frame) []*frame {
+	if len(frames) < 2 {
+		return frames
+	}
+
+	var (
+		ret     []*frame
+		current = &frame{array: true}
+	)
+	for _, f := range frames {
+		for i, obj := range f.objs {
+			if len(current.objs) == maxCoalesce {
+				ret = append(ret, current)
+				current = &frame{array: true}
+			}
+			current.objs = append(current.objs, obj)
+			// Frames split across arrays fail with either of them.
+			if i == 0 || len(current.objs) == 1 {
+				current.sources = append(current.sources, f)
+			}
+		}
+	}
+
+	return append(ret, current)
+}
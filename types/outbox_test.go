@@ -0,0 +1,193 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"tiberious/codec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/* fakeConn records the frames written to it. While blocked is set writes wait
+ * for it to be closed, writes fail once failing is set. */
+type fakeConn struct {
+	sync.Mutex
+	frames  []string
+	blocked chan struct{}
+	writes  chan struct{}
+	failing error
+}
+
+func (c *fakeConn) WriteMessage(messageType int, data []byte) error {
+	c.Lock()
+	blocked := c.blocked
+	c.Unlock()
+	if blocked != nil {
+		c.writes <- struct{}{}
+		<-blocked
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.failing != nil {
+		return c.failing
+	}
+	c.frames = append(c.frames, string(data))
+	return nil
+}
+
+func (c *fakeConn) written() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.frames...)
+}
+
+var _ = Describe("outbox", func() {
+	var (
+		out  *outbox
+		conn *fakeConn
+		enc  = codec.Default
+	)
+
+	obj := func(id string) *frame {
+		return &frame{objs: [][]byte{[]byte(`{"id":"` + id + `"}`)}}
+	}
+	reply := func(id string) *frame {
+		f := obj(id)
+		f.reply = true
+		return f
+	}
+	ids := func(data string) []string {
+		var objs []map[string]string
+		Expect(json.Unmarshal([]byte(data), &objs)).To(BeNil())
+		var ret []string
+		for _, o := range objs {
+			ret = append(ret, o["id"])
+		}
+		return ret
+	}
+
+	// block holds the next write until the returned function is called.
+	block := func() func() {
+		conn.Lock()
+		conn.blocked = make(chan struct{})
+		conn.writes = make(chan struct{}, 1)
+		blocked := conn.blocked
+		conn.Unlock()
+		return func() {
+			conn.Lock()
+			conn.blocked = nil
+			conn.Unlock()
+			close(blocked)
+		}
+	}
+
+	BeforeEach(func() {
+		out = newOutbox()
+		conn = new(fakeConn)
+	})
+
+	It("collects replies while handling a batch", func() {
+		out.startBatch()
+		Expect(out.send(conn, enc, reply("1"), true, false)).To(BeNil())
+		Expect(out.send(conn, enc, reply("2"), true, false)).To(BeNil())
+		Expect(conn.written()).To(BeEmpty())
+
+		Expect(out.send(conn, enc, &frame{objs: out.endBatch(), array: true}, true, false)).To(BeNil())
+		Expect(conn.written()).To(HaveLen(1))
+		Expect(ids(conn.written()[0])).To(Equal([]string{"1", "2"}))
+	})
+
+	It("writes everything else sent during a batch directly", func() {
+		out.startBatch()
+		Expect(out.send(conn, enc, obj("relay"), true, false)).To(BeNil())
+		Expect(conn.written()).To(Equal([]string{`{"id":"relay"}`}))
+
+		Expect(out.endBatch()).To(BeEmpty())
+		Expect(out.send(conn, enc, reply("1"), true, false)).To(BeNil())
+		Expect(conn.written()).To(HaveLen(2))
+	})
+
+	It("coalesces objects sent during a write", func() {
+		release := block()
+		done := make(chan error)
+		go func() { done <- out.send(conn, enc, obj("1"), true, false) }()
+		<-conn.writes
+
+		Expect(out.send(conn, enc, obj("2"), true, false)).To(BeNil())
+		Expect(out.send(conn, enc, obj("3"), true, false)).To(BeNil())
+		release()
+		Expect(<-done).To(BeNil())
+
+		frames := conn.written()
+		Expect(frames).To(HaveLen(2))
+		Expect(frames[0]).To(Equal(`{"id":"1"}`))
+		Expect(ids(frames[1])).To(Equal([]string{"2", "3"}))
+	})
+
+	It("only coalesces for clients reading arrays", func() {
+		release := block()
+		done := make(chan error)
+		go func() { done <- out.send(conn, enc, obj("1"), false, false) }()
+		<-conn.writes
+
+		Expect(out.send(conn, enc, obj("2"), false, false)).To(BeNil())
+		Expect(out.send(conn, enc, obj("3"), false, false)).To(BeNil())
+		release()
+		Expect(<-done).To(BeNil())
+
+		Expect(conn.written()).To(Equal([]string{`{"id":"1"}`, `{"id":"2"}`, `{"id":"3"}`}))
+	})
+
+	It("tells waiting senders whether their coalesced object was written", func() {
+		release := block()
+		done := make(chan error)
+		go func() { done <- out.send(conn, enc, obj("1"), true, false) }()
+		<-conn.writes
+
+		// Queued behind the write in progress.
+		Expect(out.send(conn, enc, obj("2"), true, false)).To(BeNil())
+		waited := make(chan error)
+		go func() { waited <- out.send(conn, enc, obj("3"), true, true) }()
+		Eventually(func() int {
+			out.Lock()
+			defer out.Unlock()
+			return len(out.pending)
+		}).Should(Equal(2))
+
+		conn.Lock()
+		conn.failing = errors.New("broken pipe")
+		conn.Unlock()
+		release()
+
+		Expect(<-waited).To(MatchError("broken pipe"))
+		Expect(<-done).To(MatchError("broken pipe"))
+	})
+
+	It("returns once a waiting sender's object was written", func() {
+		Expect(out.send(conn, enc, obj("1"), true, true)).To(BeNil())
+		Expect(conn.written()).To(Equal([]string{`{"id":"1"}`}))
+	})
+})
+
+var _ = Describe("coalesceFrames", func() {
+	It("splits long runs into arrays of maxCoalesce objects", func() {
+		var frames []*frame
+		for i := 0; i < maxCoalesce+1; i++ {
+			frames = append(frames, &frame{objs: [][]byte{[]byte("{}")}})
+		}
+		batch := &frame{objs: [][]byte{[]byte("{}"), []byte("{}")}, array: true}
+		frames = append(frames[:maxCoalesce-1], append([]*frame{batch}, frames[maxCoalesce-1:]...)...)
+
+		ret := coalesceFrames(frames)
+		Expect(ret).To(HaveLen(2))
+		Expect(ret[0].objs).To(HaveLen(maxCoalesce))
+		Expect(ret[1].objs).To(HaveLen(3))
+		// The batch split across both arrays fails with either.
+		Expect(ret[0].sources).To(ContainElement(batch))
+		Expect(ret[1].sources).To(ContainElement(batch))
+	})
+})
@@ -0,0 +1,415 @@
+package types
+
+import "errors"
+
+// Payload is the action specific part of a client object.
+type Payload interface {
+	// Validate checks the fields the action can't do without.
+	Validate() error
+}
+
+/* payloads maps every client action to a constructor of its payload, new
+ * actions only need their own payload type and an entry here. */
+var payloads = map[string]func() Payload{
+	"authenticate": func() Payload { return new(AuthenticatePayload) },
+	"verify":       func() Payload { return new(VerifyPayload) },
+	"forgot":       func() Payload { return new(ForgotPayload) },
+	"reset":        func() Payload { return new(ResetPayload) },
+	"hello":        func() Payload { return new(HelloPayload) },
+	"nick":         func() Payload { return new(NickPayload) },
+	"whois":        func() Payload { return new(WhoisPayload) },
+	"profile":      func() Payload { return new(ProfilePayload) },
+	"presence":     func() Payload { return new(PresencePayload) },
+	"typing":       func() Payload { return new(TypingPayload) },
+	"topic":        func() Payload { return new(TopicPayload) },
+	"roominfo":     func() Payload { return new(RoomInfoPayload) },
+	"roomedit":     func() Payload { return new(RoomEditPayload) },
+	"history":      func() Payload { return new(HistoryPayload) },
+	"edit":         func() Payload { return new(EditPayload) },
+	"delete":       func() Payload { return new(DeletePayload) },
+	"upload":       func() Payload { return new(UploadPayload) },
+	"chunk":        func() Payload { return new(ChunkPayload) },
+	"download":     func() Payload { return new(DownloadPayload) },
+	"mentions":     func() Payload { return new(MentionsPayload) },
+	"read":         func() Payload { return new(ReadPayload) },
+	"state":        func() Payload { return new(StatePayload) },
+	"thread":       func() Payload { return new(ThreadPayload) },
+	"react":        func() Payload { return new(ReactPayload) },
+	"unreact":      func() Payload { return new(ReactPayload) },
+	"msg":          func() Payload { return new(MsgPayload) },
+	"join":         func() Payload { return new(JoinPayload) },
+	"leave":        func() Payload { return new(PartPayload) },
+	"part":         func() Payload { return new(PartPayload) },
+}
+
+// NewPayload returns an empty payload for an action, nil if it's unknown.
+func NewPayload(action string) Payload {
+	if fn, ok := payloads[action]; ok {
+		return fn()
+	}
+
+	return nil
+}
+
+func errMissing(field string) error {
+	return errors.New("missing " + field)
+}
+
+type (
+	// AuthenticatePayload is found in authenticate messages.
+	AuthenticatePayload struct {
+		User AuthToken `json:"user"`
+	}
+
+	// VerifyPayload requests a verification mail, or redeems its token.
+	VerifyPayload struct {
+		Token string `json:"token"`
+	}
+
+	// ForgotPayload requests a password reset mail for an account.
+	ForgotPayload struct {
+		User AuthToken `json:"user"`
+	}
+
+	// ResetPayload redeems a password reset token, with the new password.
+	ResetPayload struct {
+		Token string    `json:"token"`
+		User  AuthToken `json:"user"`
+	}
+
+	// HelloPayload introduces a client, see Hello for the response.
+	HelloPayload struct {
+		Protocol      int      `json:"protocol"`
+		ClientName    string   `json:"client"`
+		ClientVersion string   `json:"client_version"`
+		Features      []string `json:"features"`
+	}
+
+	// NickPayload changes the nick of a user.
+	NickPayload struct {
+		Nick string `json:"nick"`
+	}
+
+	// WhoisPayload looks up a user by ID or username.
+	WhoisPayload struct {
+		Target string `json:"target"`
+	}
+
+	// ProfilePayload updates the profile of a user.
+	ProfilePayload struct {
+		Profile Profile `json:"profile"`
+	}
+
+	/* PresencePayload sets the status of a user, or looks up the status of
+	 * Target. A null status text clears it. */
+	PresencePayload struct {
+		Status     string  `json:"status"`
+		StatusText *string `json:"status_text"`
+		Target     string  `json:"target"`
+	}
+
+	// TypingPayload is sent while typing, Typing defaults to true when left out.
+	TypingPayload struct {
+		To     string `json:"to"`
+		Typing *bool  `json:"typing"`
+	}
+
+	// TopicPayload sets the topic of a room, or requests it when left out.
+	TopicPayload struct {
+		Room  string  `json:"room"`
+		Topic *string `json:"topic"`
+	}
+
+	// RoomInfoPayload requests the details of a room.
+	RoomInfoPayload struct {
+		Room string `json:"room"`
+	}
+
+	// RoomEditPayload changes a room, a null meta value removes the key.
+	RoomEditPayload struct {
+		Room        string             `json:"room"`
+		Description *string            `json:"description"`
+		Meta        map[string]*string `json:"meta"`
+	}
+
+	// HistoryPayload pages through the messages of a room or direct conversation.
+	HistoryPayload struct {
+		To     string `json:"to"`
+		Before string `json:"before"`
+		Limit  int    `json:"limit"`
+	}
+
+	// EditPayload replaces the body of a message.
+	EditPayload struct {
+		MessageID string  `json:"message_id"`
+		Body      *string `json:"message"`
+	}
+
+	// DeletePayload deletes a message.
+	DeletePayload struct {
+		MessageID string `json:"message_id"`
+	}
+
+	// UploadPayload starts an upload of a file for a room or user.
+	UploadPayload struct {
+		To          string `json:"to"`
+		Name        string `json:"name"`
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+	}
+
+	// ChunkPayload carries base64 encoded data of an upload in progress.
+	ChunkPayload struct {
+		AttachmentID string `json:"attachment_id"`
+		Data         []byte `json:"data"`
+	}
+
+	// DownloadPayload requests a link to an attachment.
+	DownloadPayload struct {
+		AttachmentID string `json:"attachment_id"`
+	}
+
+	// MentionsPayload pages through the mentions of a user.
+	MentionsPayload struct {
+		Before string `json:"before"`
+		Limit  int    `json:"limit"`
+	}
+
+	/* ReadPayload moves the read marker of a conversation, up to now if
+	 * MessageID is left out. */
+	ReadPayload struct {
+		To        string `json:"to"`
+		MessageID string `json:"message_id"`
+	}
+
+	// StatePayload requests the unread counts, it has no fields.
+	StatePayload struct{}
+
+	// ThreadPayload pages through the replies to a message.
+	ThreadPayload struct {
+		MessageID string `json:"message_id"`
+		Before    string `json:"before"`
+		Limit     int    `json:"limit"`
+	}
+
+	// ReactPayload adds or removes a reaction to a message.
+	ReactPayload struct {
+		MessageID string `json:"message_id"`
+		Emoji     string `json:"emoji"`
+	}
+
+	/* MsgPayload sends a message to a room or user. ContentType is one of
+	 * "plain" (default), "markdown" or "card", Parent makes the message a
+	 * reply in a thread and Attachments are IDs of completed uploads. */
+	MsgPayload struct {
+		To          string   `json:"to"`
+		Body        string   `json:"message"`
+		ContentType string   `json:"content_type"`
+		Parent      string   `json:"parent"`
+		Attachments []string `json:"attachments"`
+	}
+
+	// JoinPayload joins a room, named as "group/room".
+	JoinPayload struct {
+		Room string `json:"room"`
+	}
+
+	// PartPayload leaves a room with an optional reason.
+	PartPayload struct {
+		Room   string `json:"room"`
+		Reason string `json:"reason"`
+	}
+)
+
+// Validate AuthenticatePayload, bad credentials are left to the authenticator.
+func (p *AuthenticatePayload) Validate() error { return nil }
+
+// Validate VerifyPayload, a missing token requests a new mail.
+func (p *VerifyPayload) Validate() error { return nil }
+
+// Validate ForgotPayload
+func (p *ForgotPayload) Validate() error {
+	if p.User.AccountName == "" {
+		return errMissing("account name")
+	}
+	return nil
+}
+
+// Validate ResetPayload
+func (p *ResetPayload) Validate() error {
+	if p.Token == "" {
+		return errMissing("token")
+	}
+	return nil
+}
+
+// Validate HelloPayload
+func (p *HelloPayload) Validate() error {
+	if p.Protocol <= 0 {
+		return errMissing("protocol version")
+	}
+	return nil
+}
+
+// Validate NickPayload
+func (p *NickPayload) Validate() error {
+	if p.Nick == "" {
+		return errMissing("nick")
+	}
+	return nil
+}
+
+// Validate WhoisPayload
+func (p *WhoisPayload) Validate() error {
+	if p.Target == "" {
+		return errMissing("target")
+	}
+	return nil
+}
+
+// Validate ProfilePayload
+func (p *ProfilePayload) Validate() error { return nil }
+
+// Validate PresencePayload
+func (p *PresencePayload) Validate() error { return nil }
+
+// Validate TypingPayload
+func (p *TypingPayload) Validate() error {
+	if p.To == "" {
+		return errMissing("to")
+	}
+	return nil
+}
+
+// Validate TopicPayload
+func (p *TopicPayload) Validate() error {
+	if p.Room == "" {
+		return errMissing("room")
+	}
+	return nil
+}
+
+// Validate RoomInfoPayload
+func (p *RoomInfoPayload) Validate() error {
+	if p.Room == "" {
+		return errMissing("room")
+	}
+	return nil
+}
+
+// Validate RoomEditPayload
+func (p *RoomEditPayload) Validate() error {
+	if p.Room == "" {
+		return errMissing("room")
+	}
+	return nil
+}
+
+// Validate HistoryPayload
+func (p *HistoryPayload) Validate() error {
+	if p.To == "" {
+		return errMissing("to")
+	}
+	return nil
+}
+
+// Validate EditPayload
+func (p *EditPayload) Validate() error {
+	if p.MessageID == "" {
+		return errMissing("message_id")
+	}
+	if p.Body == nil {
+		return errMissing("message")
+	}
+	return nil
+}
+
+// Validate DeletePayload
+func (p *DeletePayload) Validate() error {
+	if p.MessageID == "" {
+		return errMissing("message_id")
+	}
+	return nil
+}
+
+// Validate UploadPayload, names, sizes and types are checked by the handler.
+func (p *UploadPayload) Validate() error {
+	if p.To == "" {
+		return errMissing("to")
+	}
+	return nil
+}
+
+// Validate ChunkPayload, the data is checked against the upload.
+func (p *ChunkPayload) Validate() error {
+	if p.AttachmentID == "" {
+		return errMissing("attachment_id")
+	}
+	return nil
+}
+
+// Validate DownloadPayload
+func (p *DownloadPayload) Validate() error {
+	if p.AttachmentID == "" {
+		return errMissing("attachment_id")
+	}
+	return nil
+}
+
+// Validate MentionsPayload
+func (p *MentionsPayload) Validate() error { return nil }
+
+// Validate ReadPayload
+func (p *ReadPayload) Validate() error {
+	if p.To == "" {
+		return errMissing("to")
+	}
+	return nil
+}
+
+// Validate StatePayload
+func (p *StatePayload) Validate() error { return nil }
+
+// Validate ThreadPayload
+func (p *ThreadPayload) Validate() error {
+	if p.MessageID == "" {
+		return errMissing("message_id")
+	}
+	return nil
+}
+
+// Validate ReactPayload
+func (p *ReactPayload) Validate() error {
+	if p.MessageID == "" {
+		return errMissing("message_id")
+	}
+	if p.Emoji == "" {
+		return errMissing("emoji")
+	}
+	return nil
+}
+
+/* Validate MsgPayload, the body is checked against its content type by the
+ * handler as it may be empty with attachments. */
+func (p *MsgPayload) Validate() error {
+	if p.To == "" {
+		return errMissing("to")
+	}
+	return nil
+}
+
+// Validate JoinPayload
+func (p *JoinPayload) Validate() error {
+	if p.Room == "" {
+		return errMissing("room")
+	}
+	return nil
+}
+
+// Validate PartPayload
+func (p *PartPayload) Validate() error {
+	if p.Room == "" {
+		return errMissing("room")
+	}
+	return nil
+}
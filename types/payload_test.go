@@ -0,0 +1,109 @@
+package types_test
+
+import (
+	"encoding/json"
+
+	. "tiberious/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// decode reads a single client object and returns its validated payload.
+func decode(raw string) (Payload, error) {
+	env := new(Envelope)
+	Expect(json.Unmarshal([]byte(raw), env)).To(BeNil())
+	return env.Decode()
+}
+
+var _ = Describe("Payload", func() {
+	DescribeTable("accepts complete objects",
+		func(raw string) {
+			payload, err := decode(raw)
+			Expect(err).To(BeNil())
+			Expect(payload).NotTo(BeNil())
+		},
+		Entry("authenticate", `{"action":"authenticate"}`),
+		Entry("verify", `{"action":"verify"}`),
+		Entry("forgot", `{"action":"forgot","user":{"account_name":"a"}}`),
+		Entry("reset", `{"action":"reset","token":"t"}`),
+		Entry("hello", `{"action":"hello","protocol":1}`),
+		Entry("nick", `{"action":"nick","nick":"n"}`),
+		Entry("whois", `{"action":"whois","target":"t"}`),
+		Entry("profile", `{"action":"profile"}`),
+		Entry("presence", `{"action":"presence"}`),
+		Entry("typing", `{"action":"typing","to":"t"}`),
+		Entry("topic", `{"action":"topic","room":"r"}`),
+		Entry("roominfo", `{"action":"roominfo","room":"r"}`),
+		Entry("roomedit", `{"action":"roomedit","room":"r"}`),
+		Entry("history", `{"action":"history","to":"t"}`),
+		Entry("edit", `{"action":"edit","message_id":"m","message":""}`),
+		Entry("delete", `{"action":"delete","message_id":"m"}`),
+		Entry("upload", `{"action":"upload","to":"t"}`),
+		Entry("chunk", `{"action":"chunk","attachment_id":"a"}`),
+		Entry("download", `{"action":"download","attachment_id":"a"}`),
+		Entry("mentions", `{"action":"mentions"}`),
+		Entry("read", `{"action":"read","to":"t"}`),
+		Entry("state", `{"action":"state"}`),
+		Entry("thread", `{"action":"thread","message_id":"m"}`),
+		Entry("react", `{"action":"react","message_id":"m","emoji":"e"}`),
+		Entry("unreact", `{"action":"unreact","message_id":"m","emoji":"e"}`),
+		Entry("msg", `{"action":"msg","to":"t"}`),
+		Entry("join", `{"action":"join","room":"r"}`),
+		Entry("leave", `{"action":"leave","room":"r"}`),
+		Entry("part", `{"action":"part","room":"r"}`),
+	)
+
+	DescribeTable("refuses incomplete objects",
+		func(raw, reason string) {
+			payload, err := decode(raw)
+			Expect(payload).To(BeNil())
+			Expect(err).To(MatchError(reason))
+		},
+		Entry("forgot without account", `{"action":"forgot","user":{}}`, "missing account name"),
+		Entry("reset without token", `{"action":"reset"}`, "missing token"),
+		Entry("hello without protocol", `{"action":"hello"}`, "missing protocol version"),
+		Entry("hello with a negative protocol", `{"action":"hello","protocol":-1}`, "missing protocol version"),
+		Entry("nick without nick", `{"action":"nick","nick":""}`, "missing nick"),
+		Entry("whois without target", `{"action":"whois"}`, "missing target"),
+		Entry("typing without recipient", `{"action":"typing"}`, "missing to"),
+		Entry("topic without room", `{"action":"topic"}`, "missing room"),
+		Entry("roominfo without room", `{"action":"roominfo"}`, "missing room"),
+		Entry("roomedit without room", `{"action":"roomedit"}`, "missing room"),
+		Entry("history without recipient", `{"action":"history"}`, "missing to"),
+		Entry("edit without message ID", `{"action":"edit","message":"m"}`, "missing message_id"),
+		Entry("edit without message", `{"action":"edit","message_id":"m"}`, "missing message"),
+		Entry("edit with a null message", `{"action":"edit","message_id":"m","message":null}`, "missing message"),
+		Entry("delete without message ID", `{"action":"delete"}`, "missing message_id"),
+		Entry("upload without recipient", `{"action":"upload","name":"n"}`, "missing to"),
+		Entry("chunk without attachment", `{"action":"chunk"}`, "missing attachment_id"),
+		Entry("download without attachment", `{"action":"download"}`, "missing attachment_id"),
+		Entry("read without recipient", `{"action":"read"}`, "missing to"),
+		Entry("thread without message ID", `{"action":"thread"}`, "missing message_id"),
+		Entry("react without message ID", `{"action":"react","emoji":"e"}`, "missing message_id"),
+		Entry("react without emoji", `{"action":"react","message_id":"m"}`, "missing emoji"),
+		Entry("msg without recipient", `{"action":"msg","message":"m"}`, "missing to"),
+		Entry("join without room", `{"action":"join"}`, "missing room"),
+		Entry("part without room", `{"action":"part"}`, "missing room"),
+	)
+
+	DescribeTable("refuses invalid objects",
+		func(raw string, expected error) {
+			payload, err := decode(raw)
+			Expect(payload).To(BeNil())
+			Expect(err).To(Equal(expected))
+		},
+		Entry("no action", `{"room":"r"}`, ErrUnknownAction),
+		Entry("unknown actions", `{"action":"bogus"}`, ErrUnknownAction),
+		Entry("mistyped fields", `{"action":"join","room":1}`, ErrInvalidObject),
+		Entry("mistyped nested fields", `{"action":"forgot","user":"a"}`, ErrInvalidObject),
+		Entry("mistyped lists", `{"action":"msg","to":"t","attachments":"a"}`, ErrInvalidObject),
+	)
+
+	It("keeps the payload fields", func() {
+		payload, err := decode(`{"action":"msg","id":"1","to":"t","message":"m","attachments":["a"]}`)
+		Expect(err).To(BeNil())
+		Expect(payload).To(Equal(&MsgPayload{To: "t", Body: "m", Attachments: []string{"a"}}))
+	})
+})
@@ -0,0 +1,32 @@
+package types
+
+import "time"
+
+// Presence states, a user is offline once their last session disconnects.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceDND     = "dnd"
+	PresenceOffline = "offline"
+)
+
+// Presence is sent to users sharing a group or room with a user whenever the
+// users presence changes, and in response to a "presence" query.
+type Presence struct {
+	Action     string `json:"action"`
+	Time       int64  `json:"time"`
+	User       string `json:"user"`
+	Status     string `json:"status"`
+	StatusText string `json:"status_text,omitempty"`
+}
+
+// NewPresence returns a "presence" notification with the current timestamp.
+func NewPresence(user, status, statusText string) *Presence {
+	ret := new(Presence)
+	ret.Action = "presence"
+	ret.Time = time.Now().Unix()
+	ret.User = user
+	ret.Status = status
+	ret.StatusText = statusText
+	return ret
+}
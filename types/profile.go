@@ -0,0 +1,28 @@
+package types
+
+import "time"
+
+// Whois is sent in response to a "whois" action.
+type Whois struct {
+	Action string      `json:"action"`
+	Time   int64       `json:"time"`
+	User   *PublicUser `json:"user"`
+}
+
+// NewWhois returns a "whois" response for a user with the current timestamp.
+func NewWhois(user *User) *Whois {
+	ret := new(Whois)
+	ret.Action = "whois"
+	ret.Time = time.Now().Unix()
+	ret.User = user.Public()
+	return ret
+}
+
+// Profile holds the profile fields a user may change with a "profile" action,
+// fields left out are not changed.
+type Profile struct {
+	DisplayName *string `json:"display_name"`
+	StatusText  *string `json:"status_text"`
+	AvatarURL   *string `json:"avatar_url"`
+	TimeZone    *string `json:"time_zone"`
+}
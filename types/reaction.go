@@ -0,0 +1,29 @@
+package types
+
+import "time"
+
+// Reaction is sent to everyone in a conversation when a user adds or removes
+// an emoji reaction, Count is the new number of users with that reaction.
+type Reaction struct {
+	Action    string `json:"action"`
+	Time      int64  `json:"time"`
+	MessageID string `json:"message_id"`
+	To        string `json:"to"`
+	User      string `json:"user"`
+	Emoji     string `json:"emoji"`
+	Count     int    `json:"count"`
+}
+
+// NewReaction returns a "react" or "unreact" notification with the current
+// timestamp.
+func NewReaction(action string, msg *Message, user, emoji string, count int) *Reaction {
+	ret := new(Reaction)
+	ret.Action = action
+	ret.Time = time.Now().Unix()
+	ret.MessageID = msg.ID
+	ret.To = msg.To
+	ret.User = user
+	ret.Emoji = emoji
+	ret.Count = count
+	return ret
+}
@@ -1,9 +1,97 @@
 package types
 
+import "time"
+
 // Room struct contains the RoomList and RoomFlags for a given room.
 type Room struct {
 	Title   string
 	Group   string
 	Private bool
 	Users   map[string]*User
+
+	Topic string
+	// ID of the user who last set the topic and when (unix time).
+	TopicBy   string
+	TopicTime int64
+	// Description is a longer, rarely changing explanation of the room.
+	Description string
+	// ID of the user that created the room, empty for server created rooms.
+	Creator string
+	Created int64
+	// Meta holds arbitrary key/value metadata set by room operators.
+	Meta map[string]string
+}
+
+// Topic is sent to room members when a rooms topic changes and in response to
+// a "topic" query.
+type Topic struct {
+	Action string `json:"action"`
+	Time   int64  `json:"time"`
+	Room   string `json:"room"`
+	Topic  string `json:"topic"`
+	By     string `json:"by,omitempty"`
+	Set    int64  `json:"set,omitempty"`
+}
+
+// NewTopic returns a "topic" notification for a room with the current
+// timestamp.
+func NewTopic(room *Room) *Topic {
+	ret := new(Topic)
+	ret.Action = "topic"
+	ret.Time = time.Now().Unix()
+	ret.Room = room.Group + "/" + room.Title
+	ret.Topic = room.Topic
+	ret.By = room.TopicBy
+	ret.Set = room.TopicTime
+	return ret
+}
+
+// RoomInfo is sent in response to a "roominfo" action.
+type RoomInfo struct {
+	Action      string            `json:"action"`
+	Time        int64             `json:"time"`
+	Room        string            `json:"room"`
+	Private     bool              `json:"private"`
+	Topic       string            `json:"topic"`
+	Description string            `json:"description"`
+	Creator     string            `json:"creator,omitempty"`
+	Created     int64             `json:"created"`
+	Meta        map[string]string `json:"meta"`
+	Users       []string          `json:"users"`
+}
+
+// NewRoomInfo returns a "roominfo" response for a room with the current
+// timestamp.
+func NewRoomInfo(room *Room) *RoomInfo {
+	ret := new(RoomInfo)
+	ret.Action = "roominfo"
+	ret.Time = time.Now().Unix()
+	ret.Room = room.Group + "/" + room.Title
+	ret.Private = room.Private
+	ret.Topic = room.Topic
+	ret.Description = room.Description
+	ret.Creator = room.Creator
+	ret.Created = room.Created
+	ret.Meta = room.Meta
+	for k := range room.Users {
+		ret.Users = append(ret.Users, k)
+	}
+	return ret
+}
+
+// JoinAlert is the OK alert sent in response to a "join", carrying the room
+// and its current topic.
+type JoinAlert struct {
+	Alert
+	Room  string `json:"room"`
+	Topic string `json:"topic"`
+}
+
+// NewJoinAlert returns an OK alert for joining a room.
+func NewJoinAlert(room *Room) *JoinAlert {
+	ret := new(JoinAlert)
+	ret.Alert = *NewAlert(OK, "")
+	ret.Room = room.Group + "/" + room.Title
+	ret.Topic = room.Topic
+	return ret
 }
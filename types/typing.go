@@ -0,0 +1,29 @@
+package types
+
+import "time"
+
+// Typing is relayed to room members or a direct message peer while a user is
+// typing, it's never stored.
+type Typing struct {
+	Action string `json:"action"`
+	Time   int64  `json:"time"`
+	To     string `json:"to"`
+	From   string `json:"from"`
+	Typing bool   `json:"typing"`
+	// Expires is the number of seconds the indicator lasts without a refresh.
+	Expires int `json:"expires,omitempty"`
+}
+
+// NewTyping returns a "typing" notification with the current timestamp.
+func NewTyping(to, from string, typing bool, expires time.Duration) *Typing {
+	ret := new(Typing)
+	ret.Action = "typing"
+	ret.Time = time.Now().Unix()
+	ret.To = to
+	ret.From = from
+	ret.Typing = typing
+	if typing {
+		ret.Expires = int(expires / time.Second)
+	}
+	return ret
+}
@@ -0,0 +1,44 @@
+package types
+
+import "time"
+
+// Unread holds the number of unread messages and mentions in a conversation.
+type Unread struct {
+	To       string `json:"to"`
+	Unread   int    `json:"unread"`
+	Mentions int    `json:"mentions"`
+}
+
+// ReadState is sent in response to a "state" action and on login.
+type ReadState struct {
+	Action        string    `json:"action"`
+	Time          int64     `json:"time"`
+	Conversations []*Unread `json:"conversations"`
+}
+
+// NewReadState returns a "state" response with the current timestamp.
+func NewReadState(conversations []*Unread) *ReadState {
+	ret := new(ReadState)
+	ret.Action = "state"
+	ret.Time = time.Now().Unix()
+	ret.Conversations = conversations
+	return ret
+}
+
+// ReadReceipt tells a direct message peer how far a user has read.
+type ReadReceipt struct {
+	Action    string `json:"action"`
+	Time      int64  `json:"time"`
+	From      string `json:"from"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// NewReadReceipt returns a "read" receipt with the current timestamp.
+func NewReadReceipt(from, id string) *ReadReceipt {
+	ret := new(ReadReceipt)
+	ret.Action = "read"
+	ret.Time = time.Now().Unix()
+	ret.From = from
+	ret.MessageID = id
+	return ret
+}
@@ -3,7 +3,9 @@ package types
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 
 	"github.com/pborman/uuid"
 
@@ -16,21 +18,93 @@ type User struct {
 	Type      string
 	Username  string
 	LoginName string
-	Email     string
-	Password  string
-	Salt      string
+	// Private fields are never encoded, use Public for anything sent out.
+	Email     string `json:"-"`
+	Password  string `json:"-"`
+	Salt      string `json:"-"`
 	Connected bool
+	Verified  bool
 	Rooms     []string
 	Groups    []string
+
+	// PasswordHash names the hash of Password, see SetPassword.
+	PasswordHash string `json:"-"`
+	// Provider is the external auth provider that created the user, if any.
+	Provider string `json:"-"`
+
+	// Profile fields set by the user.
+	DisplayName string
+	StatusText  string
+	AvatarURL   string
+	TimeZone    string
+	// Unix timestamps of account creation and the last connect/disconnect.
+	Created  int64
+	LastSeen int64
 }
 
+// PublicUser is the view of a user that is safe to send to other clients.
+type PublicUser struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+	StatusText  string `json:"status_text,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	TimeZone    string `json:"time_zone,omitempty"`
+	Created     int64  `json:"created"`
+	LastSeen    int64  `json:"last_seen"`
+	Connected   bool   `json:"connected"`
+}
+
+// Public returns the public view of a user.
+func (user *User) Public() *PublicUser {
+	return &PublicUser{
+		ID:          user.ID.String(),
+		Type:        user.Type,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		StatusText:  user.StatusText,
+		AvatarURL:   user.AvatarURL,
+		TimeZone:    user.TimeZone,
+		Created:     user.Created,
+		LastSeen:    user.LastSeen,
+		Connected:   user.Connected,
+	}
+}
+
+// PasswordPBKDF2 is the PasswordHash of passwords hashed by HashPassword.
+const PasswordPBKDF2 = "pbkdf2-sha256"
+
 //HashPassword ..
 func HashPassword(password, salt string) string {
 	return string(base64.StdEncoding.EncodeToString(pbkdf2.Key([]byte(password), []byte(salt), 4096, 32, sha256.New)))
 }
 
-func (user *User) isPassword(passwordTest string) bool {
-	return HashPassword(passwordTest, user.Salt) == user.Password
+// IsPassword returns whether a plain text password matches the users hashed
+// password, or their plain text one if it was never hashed.
+func (user *User) IsPassword(passwordTest string) bool {
+	if user.Password == "" {
+		return false
+	}
+	if user.HasLegacyPassword() {
+		return subtle.ConstantTimeCompare([]byte(passwordTest), []byte(user.Password)) == 1
+	}
+
+	return subtle.ConstantTimeCompare([]byte(HashPassword(passwordTest, user.Salt)), []byte(user.Password)) == 1
+}
+
+/* HasLegacyPassword returns whether the password was stored as plain text by an
+ * older version, these are replaced with a hash on the next login. Older
+ * versions didn't store a PasswordHash. */
+func (user *User) HasLegacyPassword() bool {
+	return user.Password != "" && user.PasswordHash == ""
+}
+
+// SetPassword stores a plain text password as a hash with a new salt.
+func (user *User) SetPassword(password string) {
+	user.Salt = NewSalt()
+	user.Password = HashPassword(password, user.Salt)
+	user.PasswordHash = PasswordPBKDF2
 }
 
 //NewSalt returns a new, 7 character salt. TODO make this a common method of sorts?
@@ -43,3 +117,11 @@ func NewSalt() string {
 	}
 	return string(bytes)
 }
+
+// NewToken returns a new random token for use in verification and password
+// reset links.
+func NewToken() string {
+	var bytes = make([]byte, 20)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
@@ -0,0 +1,25 @@
+package types_test
+
+import (
+	"encoding/json"
+
+	. "tiberious/types"
+
+	"github.com/pborman/uuid"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("User", func() {
+	It("keeps credentials out of the public view", func() {
+		user := &User{ID: uuid.NewRandom(), Type: "user", Username: "kirk", LoginName: "jtkirk", Email: "kirk@tiberious.nowhere"}
+		user.SetPassword("enterprise")
+
+		raw, err := json.Marshal(user.Public())
+		Expect(err).To(BeNil())
+		Expect(string(raw)).To(ContainSubstring(`"username":"kirk"`))
+		Expect(string(raw)).ToNot(ContainSubstring("jtkirk"))
+		Expect(string(raw)).ToNot(ContainSubstring("tiberious.nowhere"))
+	})
+})